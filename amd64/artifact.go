@@ -0,0 +1,53 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"fmt"
+
+	"github.com/nelhage/gojit"
+)
+
+// Artifact returns the code assembled so far, which must have been
+// assembled in PIC mode, as a gojit.Artifact with the given key. The
+// functions that CallFunc calls become callback imports, in the
+// order of the calls, and the names given to external addresses by
+// Extern become symbol imports.
+func (a *Assembler) Artifact(key string) (*gojit.Artifact, error) {
+	if !a.PIC {
+		return nil, fmt.Errorf("Artifact: code is not position-independent")
+	}
+	a.flushPool()
+	if a.unbound > 0 {
+		return nil, fmt.Errorf("Artifact: reference to unbound label")
+	}
+
+	art := &gojit.Artifact{
+		Key:  key,
+		Cgo:  a.ABI == CgoABI,
+		Code: append([]byte(nil), a.Buf[:a.Off]...),
+	}
+	for _, r := range a.relocs {
+		if r.typ == relPC32 && r.off+4 <= a.Off {
+			return nil, fmt.Errorf("Artifact: PC-relative reference to %#x at +%d", r.addr, r.off)
+		}
+	}
+	for _, imp := range a.imports {
+		if imp.Off+8 > a.Off {
+			continue
+		}
+		if imp.Kind == gojit.ImportSymbol {
+			addr := uintptr(binary.LittleEndian.Uint64(a.Buf[imp.Off:]))
+			name, ok := a.externs[addr]
+			if !ok {
+				return nil, fmt.Errorf("Artifact: no Extern for reference to %#x at +%d", addr, imp.Off)
+			}
+			imp.Name = name
+		}
+		// The slots hold addresses that mean nothing to Load.
+		for i := 0; i < 8; i++ {
+			art.Code[imp.Off+i] = 0
+		}
+		art.Imports = append(art.Imports, imp)
+	}
+	return art, nil
+}
@@ -0,0 +1,91 @@
+package amd64
+
+import (
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+func TestArtifact(t *testing.T) {
+	for _, abi := range abis {
+		// double(x) = 2*x
+		helper := newAsmABI(t, abi)
+		defer gojit.Release(helper.Buf)
+		helper.Mov(Rdi, Rax)
+		helper.Add(Rdi, Rax)
+		helper.Ret()
+
+		asm := newAsmABI(t, abi)
+		asm.PIC = true
+		defer gojit.Release(asm.Buf)
+
+		// f(x) = double(x) + g(), for a Go func g
+		asm.Extern("double", gojit.Addr(helper.Buf))
+		asm.Push(Rdi)
+		asm.Sub(Imm{16}, Rsp)
+		asm.CallFunc(func() int { return 1 })
+		asm.Mov(Indirect{Rsp, 0, 64}, Rcx)
+		asm.Add(Imm{16}, Rsp)
+		asm.Pop(Rdi)
+		asm.Push(Rdi)
+		asm.Push(Rcx)
+		asm.Mov(Indirect{Rdi, 0, 64}, Rdi)
+		asm.CallRel(gojit.Addr(helper.Buf))
+		asm.Pop(Rcx)
+		asm.Pop(Rdi)
+		asm.Add(Rcx, Rax)
+		asm.Mov(Rax, Indirect{Rdi, 8, 64})
+		asm.Ret()
+
+		art, e := asm.Artifact("test-v1")
+		if e != nil {
+			t.Fatalf("Artifact: %s", e.Error())
+		}
+		data, e := art.MarshalBinary()
+		if e != nil {
+			t.Fatalf("MarshalBinary: %s", e.Error())
+		}
+		for i := range asm.Buf {
+			asm.Buf[i] = 0xcc
+		}
+
+		imports := gojit.Imports{
+			Callbacks: []interface{}{func() int { return 100 }},
+			Symbols:   map[string]uintptr{"double": gojit.Addr(helper.Buf)},
+		}
+		var f func(uintptr) uintptr
+		b, e := gojit.Load(data, "test-v1", imports, &f)
+		if e != nil {
+			t.Fatalf("[abi=%d] Load: %s", abi, e.Error())
+		}
+		if got := f(21); got != 142 {
+			t.Errorf("[abi=%d] f(21) = %d, expected 142", abi, got)
+		}
+		gojit.Release(b)
+
+		if _, e := gojit.Load(data, "test-v2", imports, &f); e != gojit.ErrStale {
+			t.Errorf("[abi=%d] Load with the wrong key: %v", abi, e)
+		}
+		bad := gojit.Imports{Callbacks: []interface{}{func() {}}, Symbols: imports.Symbols}
+		if _, e := gojit.Load(data, "test-v1", bad, &f); e == nil {
+			t.Errorf("[abi=%d] Load with a mistyped callback succeeded", abi)
+		}
+		if _, e := gojit.Load(data, "test-v1", gojit.Imports{Callbacks: imports.Callbacks}, &f); e == nil {
+			t.Errorf("[abi=%d] Load with an undefined symbol succeeded", abi)
+		}
+		corrupt := append([]byte(nil), data...)
+		corrupt[len(corrupt)-1] ^= 1
+		if _, e := gojit.Load(corrupt, "test-v1", imports, &f); e == nil {
+			t.Errorf("[abi=%d] Load of a corrupt artifact succeeded", abi)
+		}
+	}
+}
+
+func TestArtifactNotPIC(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+	asm.Ret()
+	if _, e := asm.Artifact(""); e == nil {
+		t.Error("Artifact of non-PIC code succeeded")
+	}
+}
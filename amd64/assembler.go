@@ -14,10 +14,40 @@ const (
 // Assembler will emit code to Buf[Off:] and advances Off. Buf will
 // never be reallocated, and attempts to assemble off the end of Buf
 // will panic.
+//
+// If PIC is set, the Assembler emits position-independent code: the
+// addresses that CallFunc, CallRel, JmpRel and JccRel would otherwise
+// embed in the code, or reach with a rel32 from Buf, are instead
+// loaded from the constant pool of the current function (see Const).
+// The built code can then be copied elsewhere and run there, as long
+// as each function's pool goes with it. MovAbsLabel panics in PIC
+// mode; use LeaLabel instead.
 type Assembler struct {
 	Buf []byte
 	Off int
 	ABI ABI
+	PIC bool
+
+	syms       []Symbol
+	lines      []gojit.Line
+	registered int
+
+	relocs  []reloc
+	externs map[uintptr]string
+	unbound int
+	pool    []*poolEntry
+
+	imports   []gojit.Import
+	callbacks int
+
+	spans []span
+}
+
+// A Symbol names a function within an Assembler's buffer.
+type Symbol struct {
+	Name string
+	Off  int
+	Len  int
 }
 
 func New(size int) (*Assembler, error) {
@@ -40,7 +70,59 @@ func (a *Assembler) Release() {
 	gojit.Release(a.Buf)
 }
 
+// Func starts a function named name at the current offset, ending
+// the previous one, if any. BuildTo registers the functions it
+// covers with gojit.Register, so that profilers can name them. An
+// error writing one to the perf map or registering it with gdb is
+// reported by gojit.EnablePerfMap or gojit.EnableGDB.
+func (a *Assembler) Func(name string) {
+	a.flushPool()
+	a.endFunc()
+	a.syms = append(a.syms, Symbol{name, a.Off, -1})
+}
+
+func (a *Assembler) endFunc() {
+	if n := len(a.syms); n > 0 && a.syms[n-1].Len < 0 {
+		a.syms[n-1].Len = a.Off - a.syms[n-1].Off
+	}
+}
+
+// Symbols returns the functions started with Func. The last one
+// extends to the current offset.
+func (a *Assembler) Symbols() []Symbol {
+	syms := append([]Symbol(nil), a.syms...)
+	if n := len(syms); n > 0 && syms[n-1].Len < 0 {
+		syms[n-1].Len = a.Off - syms[n-1].Off
+	}
+	return syms
+}
+
+// Line records that the code emitted from the current offset on
+// comes from line of file, until the next call to Line. BuildTo
+// registers these with gojit.RegisterLines, so that debuggers can
+// step through the functions started with Func by source line.
+func (a *Assembler) Line(file string, line int) {
+	a.lines = append(a.lines, gojit.Line{Off: a.Off, File: file, Line: line})
+}
+
 func (a *Assembler) BuildTo(out interface{}) {
+	a.flushPool()
+	if a.unbound > 0 {
+		panic("BuildTo: reference to unbound label")
+	}
+	a.endFunc()
+	for _, s := range a.syms[a.registered:] {
+		var lines []gojit.Line
+		for _, l := range a.lines {
+			if l.Off >= s.Off && l.Off < s.Off+s.Len {
+				l.Off -= s.Off
+				lines = append(lines, l)
+			}
+		}
+		gojit.RegisterLines(a.Buf[s.Off:s.Off+s.Len], s.Name, lines)
+	}
+	a.registered = len(a.syms)
+
 	switch a.ABI {
 	case CgoABI:
 		gojit.BuildToCgo(a.Buf, out)
@@ -51,6 +133,10 @@ func (a *Assembler) BuildTo(out interface{}) {
 	}
 }
 
+func (a *Assembler) addr(off int) uintptr {
+	return gojit.Addr(a.Buf) + uintptr(off)
+}
+
 func (a *Assembler) byte(b byte) {
 	a.Buf[a.Off] = b
 	a.Off++
@@ -83,6 +169,9 @@ func (a *Assembler) int64(i uint64) {
 }
 
 func (a *Assembler) rel32(addr uintptr) {
+	if a.external(addr) {
+		a.relocs = append(a.relocs, reloc{off: a.Off, typ: relPC32, addr: addr})
+	}
 	off := uintptr(addr) - gojit.Addr(a.Buf[a.Off:]) - 4
 	if uintptr(int32(off)) != off {
 		panic("call rel: target out of range")
@@ -90,6 +179,15 @@ func (a *Assembler) rel32(addr uintptr) {
 	a.int32(uint32(off))
 }
 
+// branch32 is like rel32, for the target of a jmp, jcc or call.
+func (a *Assembler) branch32(addr uintptr) {
+	n := len(a.relocs)
+	a.rel32(addr)
+	if len(a.relocs) > n {
+		a.relocs[n].branch = true
+	}
+}
+
 func (a *Assembler) rex(w, r, x, b bool) {
 	var bits byte
 	if w {
@@ -117,9 +215,18 @@ func (a *Assembler) rexBits(lsize, rsize byte, r, x, b bool) {
 	if lsize == 0 {
 		lsize = 64
 	}
+	a.opsize(lsize)
 	a.rex(lsize == 64, r, x, b)
 }
 
+// opsize emits the operand-size prefix, which goes ahead of any REX
+// prefix, if bits is 16.
+func (a *Assembler) opsize(bits byte) {
+	if bits == 16 {
+		a.byte(PREFIX_OPSIZE)
+	}
+}
+
 func (a *Assembler) modrm(mod, reg, rm byte) {
 	a.byte((mod << 6) | (reg << 3) | rm)
 }
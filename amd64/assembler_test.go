@@ -30,9 +30,38 @@ func finish(a *Assembler) func(uintptr) uintptr {
 }
 
 func newAsm(t testing.TB) *Assembler {
+	return newAsmABI(t, CgoABI)
+}
+
+func newAsmABI(t testing.TB, abi ABI) *Assembler {
 	buf, e := gojit.Alloc(gojit.PageSize)
 	if e != nil {
-		t.Fatalf("alloc: ", e.Error())
+		t.Fatalf("alloc: %s", e.Error())
+	}
+	return &Assembler{Buf: buf, ABI: abi}
+}
+
+func TestFunc(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	asm.Func("one")
+	asm.Ret()
+	asm.Func("two")
+	asm.Int3()
+	asm.Ret()
+
+	var f func()
+	asm.BuildTo(&f)
+
+	syms := asm.Symbols()
+	if len(syms) != 2 || syms[0] != (Symbol{"one", 0, 1}) || syms[1] != (Symbol{"two", 1, 2}) {
+		t.Errorf("bad symbols: %v", syms)
+	}
+	for off, name := range []string{"one", "two", "two"} {
+		r, ok := gojit.Lookup(gojit.Addr(asm.Buf[off:]))
+		if !ok || r.Name != name {
+			t.Errorf("Lookup(+%d) = %v, %v; expected %s", off, r, ok, name)
+		}
 	}
-	return &Assembler{buf, 0, CgoABI}
 }
@@ -2,7 +2,8 @@ package amd64
 
 import (
 	"reflect"
-	"unsafe"
+
+	"github.com/nelhage/gojit"
 )
 
 func (a *Assembler) CallFunc(f interface{}) {
@@ -16,26 +17,36 @@ func (a *Assembler) CallFunc(f interface{}) {
 	}
 }
 
-// CallFuncGo assembles a call directly to the go function 'f'. No stack
-// swtitching or other setup is performed.
+// CallFuncGo assembles a call to the go function 'f' from code built
+// with gojit.Build. As with CallFuncCgo, a 6c/6g-layout stack frame
+// should be set up at 0(%rsp) containing arguments and return slots
+// for f. The call will be effected by way of gojit.GoCallbackAddr,
+// which runs f on the goroutine stack, where it is free to grow the
+// stack or be scanned by the GC.
+//
+// f stays registered until a.Buf is released. All registers other
+// than %rsp and %rbp should be assumed clobbered.
 func (a *Assembler) CallFuncGo(f interface{}) {
 	if reflect.TypeOf(f).Kind() != reflect.Func {
 		panic("CallFunc: Can't call non-func")
 	}
-	ival := *(*struct {
-		typ uintptr
-		fun uintptr
-	})(unsafe.Pointer(&f))
-	a.MovAbs(uint64(ival.fun), Rdx)
-	a.Call(Indirect{Rdx, 0, 64})
+	handle := gojit.RegisterCallback(a.Buf, f)
+
+	a.Mov(Rsp, Rsi)
+	a.loadAddr(handle, a.callbackImport(f), Rdi)
+	a.loadAddr(gojit.GoCallbackAddr(), gojit.Import{Kind: gojit.ImportGoCallback}, Rax)
+	a.Call(Rax)
 }
 
 // CallFuncCgo assembles a sequence to call into the go function 'f',
 // using the cgo callback runtime interface. Prior to CallFunc, a
-// 6c/6g-layout stack frame should be set up containing arguments and
-// return slots for f. The call will be effected by way of
-// runtime.cgocallback_gofunc, involving a stack switch back to the
-// goroutine stack.
+// 6c/6g-layout stack frame should be set up at 0(%rsp) containing
+// arguments and return slots for f. The call will be effected by way
+// of a cgo exported function (see gojit.RegisterCallback), involving
+// a stack switch back to the goroutine stack. The stack need not be
+// aligned.
+//
+// f stays registered until a.Buf is released.
 //
 // All registers are caller-save in the 6c ABI, and so all registers
 // should be assumed clobbered across a CallFunc.
@@ -43,38 +54,27 @@ func (a *Assembler) CallFuncCgo(f interface{}) {
 	if reflect.TypeOf(f).Kind() != reflect.Func {
 		panic("CallFunc: Can't call non-func")
 	}
-	ival := *(*struct {
-		typ uintptr
-		fun uintptr
-	})(unsafe.Pointer(&f))
+	handle := gojit.RegisterCallback(a.Buf, f)
 
-	// runtime·cgocallback_gofunc(f, frame, framesize)
-	// plan9 ABI
-
-	framesize := calculateFramesize(f)
-
-	a.Sub(Imm{24}, Rsp)
-	a.Mov(Imm{int32(framesize)}, Indirect{Rsp, 16, 64})
-	a.Lea(Indirect{Rsp, 24, 64}, Rax)
-	a.Mov(Rax, Indirect{Rsp, 8, 64})
-	a.MovAbs(uint64(ival.fun), Rax)
-	a.Mov(Rax, Indirect{Rsp, 0, 64})
-	a.MovAbs(uint64(get_runtime_cgocallback_gofunc()), Rax)
+	// gojitCallback(handle, frame), C ABI
+	a.Mov(Rsp, Rsi)
+	a.Push(Rbp)
+	a.Mov(Rsp, Rbp)
+	a.And(Imm{-16}, Rsp)
+	a.loadAddr(handle, a.callbackImport(f), Rdi)
+	a.loadAddr(gojit.CgoCallbackAddr(), gojit.Import{Kind: gojit.ImportCgoCallback}, Rax)
 	a.Call(Rax)
-	a.Add(Imm{24}, Rsp)
+	a.Mov(Rbp, Rsp)
+	a.Pop(Rbp)
 }
 
-func calculateFramesize(f interface{}) uintptr {
-	t := reflect.TypeOf(f)
-	s := uintptr(0)
-
-	for i := 0; i < t.NumIn(); i++ {
-		s += t.In(i).Size()
+// callbackImport records f as the next of the callbacks an Artifact
+// imports.
+func (a *Assembler) callbackImport(f interface{}) gojit.Import {
+	a.callbacks++
+	return gojit.Import{
+		Kind:  gojit.ImportCallback,
+		Index: a.callbacks - 1,
+		Name:  reflect.TypeOf(f).String(),
 	}
-	for i := 0; i < t.NumOut(); i++ {
-		s += t.Out(i).Size()
-	}
-	return s
 }
-
-func get_runtime_cgocallback_gofunc() uintptr
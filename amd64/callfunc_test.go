@@ -7,61 +7,167 @@ import (
 	"github.com/nelhage/gojit"
 )
 
+var abis = []ABI{CgoABI, GoABI}
+
 func TestCallFunc(t *testing.T) {
-	asm := newAsm(t)
-	defer gojit.Release(asm.Buf)
+	for _, abi := range abis {
+		asm := newAsmABI(t, abi)
+		defer gojit.Release(asm.Buf)
 
-	called := false
+		called := false
 
-	asm.CallFunc(func() { called = true })
-	asm.Ret()
+		asm.CallFunc(func() { called = true })
+		asm.Ret()
 
-	var f func()
-	asm.BuildTo(&f)
-	f()
+		var f func()
+		asm.BuildTo(&f)
+		f()
 
-	if !called {
-		t.Error("CallFunc did not call the function")
+		if !called {
+			t.Errorf("[abi=%d] CallFunc did not call the function", abi)
+		}
 	}
 }
 
 func TestRecursion(t *testing.T) {
-	asm := newAsm(t)
-	defer gojit.Release(asm.Buf)
-
-	var jitf func(i int)
-	gof := func(i int) {
-		if i > 0 {
-			jitf(i - 1)
+	for _, abi := range abis {
+		asm := newAsmABI(t, abi)
+		defer gojit.Release(asm.Buf)
+
+		var jitf func(i int)
+		gof := func(i int) {
+			if i > 0 {
+				jitf(i - 1)
+			}
 		}
+
+		asm.Mov(Indirect{Rdi, 0, 64}, Rax)
+		asm.Push(Rax)
+		asm.CallFunc(gof)
+		asm.Pop(Rax)
+		asm.Ret()
+
+		asm.BuildTo(&jitf)
+
+		jitf(1024)
 	}
+}
 
-	asm.Mov(Indirect{Rdi, 0, 64}, Rax)
-	asm.Push(Rax)
-	asm.CallFunc(gof)
-	asm.Pop(Rax)
-	asm.Ret()
+//go:noinline
+func grow(n int) int {
+	var pad [128]byte
+	pad[n%len(pad)] = 1
+	if n == 0 {
+		runtime.GC()
+		return 0
+	}
+	return grow(n-1) + int(pad[n%len(pad)])
+}
 
-	asm.BuildTo(&jitf)
+func TestStackGrowthInCallback(t *testing.T) {
+	for _, abi := range abis {
+		asm := newAsmABI(t, abi)
+		defer gojit.Release(asm.Buf)
+
+		var jitf func(i int)
+		depth := 0
+		gof := func(i int) {
+			depth += grow(4096)
+			if i > 0 {
+				jitf(i - 1)
+			}
+		}
+
+		asm.Mov(Indirect{Rdi, 0, 64}, Rax)
+		asm.Push(Rax)
+		asm.CallFunc(gof)
+		asm.Pop(Rax)
+		asm.Ret()
+
+		asm.BuildTo(&jitf)
 
-	jitf(1024)
+		jitf(64)
+		if depth != 65*4096 {
+			t.Errorf("[abi=%d] depth=%d, expected %d", abi, depth, 65*4096)
+		}
+	}
 }
 
 func TestGCInCallback(t *testing.T) {
-	asm := newAsm(t)
+	for _, abi := range abis {
+		asm := newAsmABI(t, abi)
+		defer gojit.Release(asm.Buf)
+
+		gof := func(i int) {
+			runtime.GC()
+		}
+		var jitf func()
+
+		asm.CallFunc(gof)
+		asm.Ret()
+
+		asm.BuildTo(&jitf)
+
+		jitf()
+	}
+}
+
+func TestCallbackGCPressure(t *testing.T) {
+	for _, abi := range abis {
+		testCallbackGCPressure(t, abi)
+	}
+}
+
+func testCallbackGCPressure(t *testing.T, abi ABI) {
+	asm := newAsmABI(t, abi)
 	defer gojit.Release(asm.Buf)
 
-	gof := func(i int) {
-		runtime.GC()
+	const iterations = 10000
+
+	var garbage [][]byte
+	count := 0
+	gof := func() {
+		count++
+		garbage = append(garbage, make([]byte, 1024))
+		if len(garbage) > 64 {
+			garbage = nil
+		}
 	}
-	var jitf func()
 
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				runtime.GC()
+			}
+		}
+	}()
+
+	// CallFunc clobbers every register, so keep the loop
+	// counter on the stack.
+	asm.Push(Imm{iterations})
+	loop := asm.Off
 	asm.CallFunc(gof)
+	asm.Dec(Indirect{Rsp, 0, 64})
+	asm.JccRel(CC_NZ, gojit.Addr(asm.Buf[loop:]))
+	asm.Pop(Rax)
 	asm.Ret()
 
+	var jitf func()
 	asm.BuildTo(&jitf)
 
-	jitf()
+	for i := 0; i < 4; i++ {
+		count = 0
+		jitf()
+		if count != iterations {
+			t.Fatalf("[abi=%d] called %d times, expected %d",
+				abi, count, iterations)
+		}
+	}
 }
 
 func BenchmarkGoCall(b *testing.B) {
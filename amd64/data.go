@@ -0,0 +1,152 @@
+package amd64
+
+import (
+	"fmt"
+	"io"
+)
+
+// nops are the recommended multi-byte nop forms, from the Intel
+// optimization manual, indexed by length.
+var nops = [][]byte{
+	nil,
+	{0x90},
+	{0x66, 0x90},
+	{0x0f, 0x1f, 0x00},
+	{0x0f, 0x1f, 0x40, 0x00},
+	{0x0f, 0x1f, 0x44, 0x00, 0x00},
+	{0x66, 0x0f, 0x1f, 0x44, 0x00, 0x00},
+	{0x0f, 0x1f, 0x80, 0x00, 0x00, 0x00, 0x00},
+	{0x0f, 0x1f, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+	{0x66, 0x0f, 0x1f, 0x84, 0x00, 0x00, 0x00, 0x00, 0x00},
+}
+
+type spanKind int
+
+const (
+	spanPadding spanKind = iota
+	spanData
+)
+
+// A span records bytes of padding or data, for Sizes.
+type span struct {
+	off, len int
+	kind     spanKind
+}
+
+func (a *Assembler) span(kind spanKind, start int) {
+	if a.Off > start {
+		a.spans = append(a.spans, span{start, a.Off - start, kind})
+	}
+}
+
+// Nop assembles n bytes of nops, using as few instructions as
+// possible.
+func (a *Assembler) Nop(n int) {
+	start := a.Off
+	for n > 0 {
+		k := n
+		if k >= len(nops) {
+			k = len(nops) - 1
+		}
+		copy(a.Buf[a.Off:], nops[k])
+		a.Off += k
+		n -= k
+	}
+	a.span(spanPadding, start)
+}
+
+// Align pads with nops up to the next multiple of n, which must be a
+// power of two, in memory. Buffers from gojit.Alloc are page-aligned,
+// so this is also a multiple of n within Buf.
+func (a *Assembler) Align(n int) {
+	if n <= 0 || n&(n-1) != 0 {
+		panic(fmt.Sprintf("Align: %d is not a power of two", n))
+	}
+	a.Nop(int(-a.addr(a.Off) & uintptr(n-1)))
+}
+
+// Bytes embeds b in the code. Bind a Label first to refer to it.
+func (a *Assembler) Bytes(b []byte) {
+	start := a.Off
+	copy(a.Buf[a.Off:a.Off+len(b)], b)
+	a.Off += len(b)
+	a.span(spanData, start)
+}
+
+// Long embeds the little-endian 32-bit value v in the code.
+func (a *Assembler) Long(v uint32) {
+	start := a.Off
+	a.int32(v)
+	a.span(spanData, start)
+}
+
+// Quad embeds the little-endian 64-bit value v in the code.
+func (a *Assembler) Quad(v uint64) {
+	start := a.Off
+	a.int64(v)
+	a.span(spanData, start)
+}
+
+// A FuncSize breaks down the size of a function started with Func,
+// including its constant pool.
+type FuncSize struct {
+	Name    string
+	Code    int
+	Padding int
+	Data    int
+}
+
+// Total returns the size of the function.
+func (s FuncSize) Total() int {
+	return s.Code + s.Padding + s.Data
+}
+
+// Sizes returns the size of each function started with Func, or of
+// all the code assembled so far if Func has not been called.
+func (a *Assembler) Sizes() []FuncSize {
+	syms := a.Symbols()
+	if len(syms) == 0 {
+		syms = []Symbol{{"", 0, a.Off}}
+	}
+	out := make([]FuncSize, len(syms))
+	for i, s := range syms {
+		out[i].Name = s.Name
+		for _, sp := range a.spans {
+			start, end := sp.off, sp.off+sp.len
+			if start < s.Off {
+				start = s.Off
+			}
+			if end > s.Off+s.Len {
+				end = s.Off + s.Len
+			}
+			if end <= start {
+				continue
+			}
+			if sp.kind == spanPadding {
+				out[i].Padding += end - start
+			} else {
+				out[i].Data += end - start
+			}
+		}
+		out[i].Code = s.Len - out[i].Padding - out[i].Data
+	}
+	return out
+}
+
+// WriteSizes writes a table of Sizes to w.
+func (a *Assembler) WriteSizes(w io.Writer) error {
+	var total FuncSize
+	if _, err := fmt.Fprintf(w, "%8s %8s %8s %8s  %s\n", "total", "code", "padding", "data", "function"); err != nil {
+		return err
+	}
+	for _, s := range a.Sizes() {
+		total.Code += s.Code
+		total.Padding += s.Padding
+		total.Data += s.Data
+		if _, err := fmt.Fprintf(w, "%8d %8d %8d %8d  %s\n", s.Total(), s.Code, s.Padding, s.Data, s.Name); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "%8d %8d %8d %8d  %s\n", total.Total(), total.Code, total.Padding, total.Data, "(total)")
+	return err
+}
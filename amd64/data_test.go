@@ -0,0 +1,108 @@
+package amd64
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+func TestNop(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for n := 0; n <= 32; n++ {
+		begin(asm)
+		asm.Mov(Imm{int64(n)}, Rax)
+		start := asm.Off
+		asm.Nop(n)
+		if asm.Off-start != n {
+			t.Errorf("Nop(%d) assembled %d bytes", n, asm.Off-start)
+		}
+		f := finish(asm)
+		if got := f(0); got != uintptr(n) {
+			t.Errorf("Nop(%d): f() = %d", n, got)
+		}
+	}
+}
+
+func TestAlign(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for _, n := range []int{1, 2, 4, 8, 16, 32} {
+		asm.Ret()
+		asm.Align(n)
+		if a := gojit.Addr(asm.Buf[asm.Off:]); a%uintptr(n) != 0 {
+			t.Errorf("Align(%d) left us at %#x", n, a)
+		}
+	}
+
+	defer func() {
+		if recover() == nil {
+			t.Error("Align(3) did not panic")
+		}
+	}()
+	asm.Align(3)
+}
+
+func TestData(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	var quad, long, bytes_, code Label
+	asm.Func("data")
+	begin(asm)
+	asm.LeaLabel(&quad, Rcx)
+	asm.Mov(Indirect{Rcx, 0, 64}, Rax)
+	asm.LeaLabel(&long, Rcx)
+	asm.Mov(Indirect{Rcx, 0, 32}, Edx)
+	asm.Add(Rdx, Rax)
+	asm.JmpLabel(&code)
+	asm.Align(8)
+	asm.Bind(&quad)
+	asm.Quad(1 << 40)
+	asm.Bind(&long)
+	asm.Long(1 << 20)
+	asm.Bind(&bytes_)
+	asm.Bytes([]byte{1, 2, 3})
+	asm.Bind(&code)
+	if b := asm.Buf[bytes_.Off() : bytes_.Off()+3]; !bytes.Equal(b, []byte{1, 2, 3}) {
+		t.Errorf("Bytes embedded %v", b)
+	}
+	f := finish(asm)
+
+	if got, expect := f(0), uintptr(1<<40+1<<20); got != expect {
+		t.Errorf("f() = %#x, expected %#x", got, expect)
+	}
+}
+
+func TestSizes(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	asm.Func("one")
+	asm.Ret()
+	asm.Align(16)
+	asm.Func("two")
+	asm.Nop(3)
+	asm.Ret()
+	asm.Quad(0)
+
+	sizes := asm.Sizes()
+	expect := []FuncSize{{"one", 1, 15, 0}, {"two", 1, 3, 8}}
+	if len(sizes) != 2 || sizes[0] != expect[0] || sizes[1] != expect[1] {
+		t.Errorf("Sizes() = %+v, expected %+v", sizes, expect)
+	}
+
+	var w bytes.Buffer
+	if e := asm.WriteSizes(&w); e != nil {
+		t.Fatalf("WriteSizes: %s", e.Error())
+	}
+	lines := strings.Split(strings.TrimSpace(w.String()), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[3], "(total)") ||
+		strings.Fields(lines[3])[0] != "28" {
+		t.Errorf("WriteSizes:\n%s", w.String())
+	}
+}
@@ -0,0 +1,612 @@
+package amd64
+
+import (
+	"bufio"
+	"bytes"
+	"debug/elf"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+// The tests in this file check the assembler's encodings byte for
+// byte against GNU as. TestGoldenEncodings compares every case in
+// encCases against testdata/encodings.golden, which
+//
+//    go test -run TestGoldenEncodings -update
+//
+// regenerates by running as. FuzzEncoding assembles random operand
+// combinations with both, when as is installed.
+
+var update = flag.Bool("update", false, "regenerate "+goldenFile+" with GNU as")
+
+const goldenFile = "testdata/encodings.golden"
+
+// An encOperand is an operand along with how to write it as Go and
+// in GNU as syntax.
+type encOperand struct {
+	op   Operand
+	name string
+	att  string
+	bits byte // the operand size; 0 for an immediate
+}
+
+func (o encOperand) isImm() bool {
+	_, ok := o.op.(Imm)
+	return ok
+}
+
+func (o encOperand) isReg() bool {
+	_, ok := o.op.(Register)
+	return ok
+}
+
+var regNames = map[Register][2]string{
+	Rax: {"Rax", "rax"}, Rcx: {"Rcx", "rcx"}, Rdx: {"Rdx", "rdx"}, Rbx: {"Rbx", "rbx"},
+	Rsp: {"Rsp", "rsp"}, Rbp: {"Rbp", "rbp"}, Rsi: {"Rsi", "rsi"}, Rdi: {"Rdi", "rdi"},
+	R8: {"R8", "r8"}, R9: {"R9", "r9"}, R10: {"R10", "r10"}, R11: {"R11", "r11"},
+	R12: {"R12", "r12"}, R13: {"R13", "r13"}, R14: {"R14", "r14"}, R15: {"R15", "r15"},
+
+	Eax: {"Eax", "eax"}, Ecx: {"Ecx", "ecx"}, Edx: {"Edx", "edx"}, Ebx: {"Ebx", "ebx"},
+	Esp: {"Esp", "esp"}, Ebp: {"Ebp", "ebp"}, Esi: {"Esi", "esi"}, Edi: {"Edi", "edi"},
+	R8d: {"R8d", "r8d"}, R9d: {"R9d", "r9d"}, R10d: {"R10d", "r10d"}, R11d: {"R11d", "r11d"},
+	R12d: {"R12d", "r12d"}, R13d: {"R13d", "r13d"}, R14d: {"R14d", "r14d"}, R15d: {"R15d", "r15d"},
+
+	Ax: {"Ax", "ax"}, Cx: {"Cx", "cx"}, Dx: {"Dx", "dx"}, Bx: {"Bx", "bx"},
+	Sp: {"Sp", "sp"}, Bp: {"Bp", "bp"}, Si: {"Si", "si"}, Di: {"Di", "di"},
+	R8w: {"R8w", "r8w"}, R9w: {"R9w", "r9w"}, R10w: {"R10w", "r10w"}, R11w: {"R11w", "r11w"},
+	R12w: {"R12w", "r12w"}, R13w: {"R13w", "r13w"}, R14w: {"R14w", "r14w"}, R15w: {"R15w", "r15w"},
+
+	Al: {"Al", "al"}, Cl: {"Cl", "cl"}, Dl: {"Dl", "dl"}, Bl: {"Bl", "bl"},
+	R8b: {"R8b", "r8b"}, R9b: {"R9b", "r9b"}, R10b: {"R10b", "r10b"}, R11b: {"R11b", "r11b"},
+	R12b: {"R12b", "r12b"}, R13b: {"R13b", "r13b"}, R14b: {"R14b", "r14b"}, R15b: {"R15b", "r15b"},
+}
+
+func reg(r Register) encOperand {
+	n := regNames[r]
+	return encOperand{r, n[0], "%" + n[1], r.Bits}
+}
+
+func immString(v int64) string {
+	if v > -256 && v < 256 {
+		return fmt.Sprint(v)
+	}
+	if v < 0 {
+		return fmt.Sprintf("-%#x", uint64(-v))
+	}
+	return fmt.Sprintf("%#x", v)
+}
+
+func imm(v int64) encOperand {
+	s := immString(v)
+	return encOperand{Imm{v}, "Imm{" + s + "}", "$" + s, 0}
+}
+
+// indirect returns Offset(Base) as an operand of size bits.
+func indirect(base Register, off int32, bits byte) encOperand {
+	return encOperand{
+		Indirect{base, off, bits},
+		fmt.Sprintf("Indirect{%s, %d, %d}", regNames[base][0], off, bits),
+		fmt.Sprintf("%d(%s)", off, reg(base).att),
+		bits,
+	}
+}
+
+// sib returns Offset(Base, Index, Scale), with no base register if
+// base is Register{}. Its size is that of the instruction's other
+// operand.
+func sib(off int32, base, index Register, scale int) encOperand {
+	goBase, attBase := "Register{}", ""
+	if base.Bits != 0 {
+		goBase, attBase = regNames[base][0], reg(base).att
+	}
+	scales := map[int]Scale{1: Scale1, 2: Scale2, 4: Scale4, 8: Scale8}
+	return encOperand{
+		SIB{off, base, index, scales[scale]},
+		fmt.Sprintf("SIB{%d, %s, %s, Scale%d}", off, goBase, regNames[index][0], scale),
+		fmt.Sprintf("%d(%s,%s,%d)", off, attBase, reg(index).att, scale),
+		0,
+	}
+}
+
+// An encCase is a single instruction, as a call on the Assembler and
+// in GNU as syntax.
+type encCase struct {
+	call string
+	att  string
+	emit func(a *Assembler)
+}
+
+// An encInsn is an Instruction along with its Assembler method.
+type encInsn struct {
+	method string
+	insn   *Instruction
+}
+
+var encInsns = []encInsn{
+	{"Add", InstAdd}, {"Addb", InstAddb},
+	{"And", InstAnd}, {"Andb", InstAndb},
+	{"Cmp", InstCmp}, {"Cmpb", InstCmpb},
+	{"Or", InstOr}, {"Orb", InstOrb},
+	{"Sub", InstSub}, {"Subb", InstSubb},
+	{"Test", InstTest}, {"Testb", InstTestb},
+	{"Xor", InstXor}, {"Xorb", InstXorb},
+	{"Mov", InstMov}, {"Movb", InstMovb},
+	{"Lea", InstLea},
+}
+
+func suffix(bits byte) string {
+	switch bits {
+	case 8:
+		return "b"
+	case 16:
+		return "w"
+	case 32:
+		return "l"
+	}
+	return "q"
+}
+
+// immOK reports whether v is a valid immediate for an operation of
+// size bits, or for a mov to a 64-bit register if movReg.
+func immOK(v int64, bits byte, movReg bool) bool {
+	switch {
+	case bits == 8:
+		return v >= -1<<7 && v < 1<<8
+	case bits == 16:
+		return v >= -1<<15 && v < 1<<16
+	case bits == 32:
+		return v >= -1<<31 && v < 1<<32
+	case movReg:
+		return true
+	}
+	return v >= -1<<31 && v < 1<<31
+}
+
+// arith returns the case for the two-operand instruction in with
+// src and dst, or false if the assembler doesn't support that
+// combination.
+func arith(in encInsn, src, dst encOperand) (encCase, bool) {
+	insn := in.insn
+	bits := dst.bits
+	if bits == 0 {
+		bits = src.bits
+	}
+	if (insn.bits == 8) != (bits == 8) || (bits == 0 && !src.isImm()) {
+		return encCase{}, false
+	}
+	if src.bits != 0 && dst.bits != 0 && src.bits != dst.bits {
+		return encCase{}, false
+	}
+
+	mnemonic := insn.Mnemonic
+	if insn.bits == 8 {
+		mnemonic = strings.TrimSuffix(mnemonic, "b")
+	}
+	attDst := dst.att
+	switch {
+	case src.isImm():
+		if !insn.imm_rm.op.ok() || dst.bits == 0 {
+			return encCase{}, false
+		}
+		v := src.op.(Imm).Val
+		movReg := insn == InstMov && dst.isReg()
+		if !immOK(v, bits, movReg) {
+			return encCase{}, false
+		}
+		if movReg && bits == 64 {
+			// See arithmeticImm for how these are chosen.
+			r := dst.op.(Register)
+			switch {
+			case v >= 0 && v < 1<<32:
+				attDst = reg(Register{r.Val, 32}).att
+				bits = 32
+			case v < -1<<31 || v >= 1<<31:
+				mnemonic = "movabs"
+			}
+		}
+	case !dst.isReg():
+		if !insn.r_rm.ok() || !src.isReg() {
+			return encCase{}, false
+		}
+	case !src.isReg():
+		if !insn.rm_r.ok() {
+			return encCase{}, false
+		}
+	}
+	if insn == InstLea && (src.isReg() || bits != 64) {
+		return encCase{}, false
+	}
+
+	return encCase{
+		fmt.Sprintf("%s(%s, %s)", in.method, src.name, dst.name),
+		fmt.Sprintf("%s%s %s,%s", mnemonic, suffix(bits), src.att, attDst),
+		func(a *Assembler) { a.Arithmetic(insn, src.op, dst.op) },
+	}, true
+}
+
+// unary returns the case for one of the single-operand instructions
+// Inc, Dec, Incb, Decb, Push, Pop, Call and Jmp on o.
+func unary(method string, o encOperand) (encCase, bool) {
+	var emit func(a *Assembler, o Operand)
+	att := strings.ToLower(method)
+	bits := o.bits
+	switch method {
+	case "Inc", "Dec":
+		if bits != 16 && bits != 32 && bits != 64 {
+			return encCase{}, false
+		}
+		emit = map[string]func(*Assembler, Operand){"Inc": (*Assembler).Inc, "Dec": (*Assembler).Dec}[method]
+		att += suffix(bits)
+	case "Incb", "Decb":
+		if o.isImm() || (bits != 8 && bits != 0) {
+			return encCase{}, false
+		}
+		emit = map[string]func(*Assembler, Operand){"Incb": (*Assembler).Incb, "Decb": (*Assembler).Decb}[method]
+		att = strings.TrimSuffix(att, "b") + "b"
+	case "Push", "Pop":
+		if o.isImm() {
+			if method == "Pop" || !immOK(o.op.(Imm).Val, 64, false) {
+				return encCase{}, false
+			}
+		} else if bits != 64 && bits != 0 {
+			return encCase{}, false
+		}
+		emit = map[string]func(*Assembler, Operand){"Push": (*Assembler).Push, "Pop": (*Assembler).Pop}[method]
+		att += "q"
+	case "Call", "Jmp":
+		if o.isImm() || (bits != 64 && bits != 0) {
+			return encCase{}, false
+		}
+		emit = map[string]func(*Assembler, Operand){"Call": (*Assembler).Call, "Jmp": (*Assembler).Jmp}[method]
+		return encCase{
+			fmt.Sprintf("%s(%s)", method, o.name),
+			fmt.Sprintf("%s *%s", att, o.att),
+			func(a *Assembler) { emit(a, o.op) },
+		}, true
+	}
+	return encCase{
+		fmt.Sprintf("%s(%s)", method, o.name),
+		fmt.Sprintf("%s %s", att, o.att),
+		func(a *Assembler) { emit(a, o.op) },
+	}, true
+}
+
+var unaryMethods = []string{"Inc", "Dec", "Incb", "Decb", "Push", "Pop", "Call", "Jmp"}
+
+// encCases enumerates the cases checked against the golden file.
+func encCases() []encCase {
+	regs := map[byte][]Register{
+		8:  {Al, Cl, Bl, R8b, R15b},
+		16: {Ax, Dx, Sp, R9w, R13w},
+		32: {Eax, Edx, Esp, R9d, R13d},
+		64: {Rax, Rcx, Rsp, Rbp, R8, R13},
+	}
+	memRegs := map[byte][]Register{
+		8:  {Cl, R12b},
+		16: {Cx, R10w},
+		32: {Eax, R9d},
+		64: {Rax, R8},
+	}
+	immRegs := map[byte][]Register{
+		8:  {Al, Cl, R15b},
+		16: {Ax, Bx, R11w},
+		32: {Eax, R9d},
+		64: {Rax, Rcx, R13},
+	}
+	mems := func(bits byte) []encOperand {
+		return []encOperand{
+			indirect(Rax, 0, bits),
+			indirect(Rsp, 8, bits),
+			indirect(Rbp, -129, bits),
+			indirect(R13, 0, bits),
+			sib(0, Rax, Rcx, 1),
+			sib(-128, Register{}, R9, 8),
+		}
+	}
+	imms := []int64{0, 1, -1, 127, 128, -128, -129, 255, 0xffff, -0x8000, 0x10000,
+		0x7fffffff, -0x80000000, 0xffffffff, 0x80000000,
+		-0x80000001, 0x123456789abcdef0}
+
+	var cases []encCase
+	add := func(c encCase, ok bool) {
+		if ok {
+			cases = append(cases, c)
+		}
+	}
+
+	for _, in := range encInsns {
+		for _, bits := range []byte{8, 16, 32, 64} {
+			for _, s := range regs[bits] {
+				for _, d := range regs[bits] {
+					add(arith(in, reg(s), reg(d)))
+				}
+			}
+			for _, r := range memRegs[bits] {
+				for _, m := range mems(bits) {
+					add(arith(in, reg(r), m))
+					add(arith(in, m, reg(r)))
+				}
+			}
+			for _, v := range imms {
+				for _, r := range immRegs[bits] {
+					add(arith(in, imm(v), reg(r)))
+				}
+				add(arith(in, imm(v), indirect(Rdi, 8, bits)))
+				add(arith(in, imm(v), indirect(R12, 0, bits)))
+			}
+		}
+	}
+
+	for _, m := range unaryMethods {
+		for _, bits := range []byte{8, 16, 32, 64} {
+			for _, r := range regs[bits] {
+				add(unary(m, reg(r)))
+			}
+			add(unary(m, indirect(Rax, 0, bits)))
+			add(unary(m, indirect(R13, 8, bits)))
+		}
+		add(unary(m, sib(0, Rax, Rcx, 1)))
+		add(unary(m, sib(16, R12, R9, 4)))
+		for _, v := range []int64{1, -128, 128, -0x80000000} {
+			add(unary(m, imm(v)))
+		}
+	}
+
+	for _, v := range []uint64{0, 0xffffffffffffffff, 0x123456789abcdef0} {
+		for _, r := range []Register{Rax, R15} {
+			v, r := v, r
+			add(encCase{
+				fmt.Sprintf("MovAbs(%#x, %s)", v, regNames[r][0]),
+				fmt.Sprintf("movabsq $%#x,%s", v, reg(r).att),
+				func(a *Assembler) { a.MovAbs(v, r) },
+			}, true)
+		}
+	}
+	add(encCase{"Int3()", "int3", (*Assembler).Int3}, true)
+	add(encCase{"Ret()", "ret", (*Assembler).Ret}, true)
+	add(encCase{"Syscall()", "syscall", (*Assembler).Syscall}, true)
+
+	return cases
+}
+
+// encode returns the assembler's encoding of c, or an error if it
+// panics.
+func encode(asm *Assembler, c encCase) (code []byte, err error) {
+	defer func() {
+		if e := recover(); e != nil {
+			err = fmt.Errorf("%v", e)
+		}
+	}()
+	asm.Off = 0
+	c.emit(asm)
+	return append([]byte(nil), asm.Buf[:asm.Off]...), nil
+}
+
+// gnuAs assembles each case with GNU as, returning their encodings.
+// It reports t.Skip if as isn't installed.
+func gnuAs(t testing.TB, cases []encCase) [][]byte {
+	as, err := exec.LookPath("as")
+	if err != nil {
+		t.Skip("GNU as not found")
+	}
+	dir := t.TempDir()
+
+	var src bytes.Buffer
+	src.WriteString("\t.text\n")
+	for i, c := range cases {
+		fmt.Fprintf(&src, "c%d:\t%s\n", i, c.att)
+	}
+	fmt.Fprintf(&src, "c%d:\n", len(cases))
+	if err := os.WriteFile(filepath.Join(dir, "enc.s"), src.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	cmd := exec.Command(as, "-o", "enc.o", "enc.s")
+	cmd.Dir = dir
+	if out, err := cmd.CombinedOutput(); err != nil {
+		t.Fatalf("as: %v\n%s", err, out)
+	}
+
+	f, err := elf.Open(filepath.Join(dir, "enc.o"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	text, err := f.Section(".text").Data()
+	if err != nil {
+		t.Fatal(err)
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		t.Fatal(err)
+	}
+	offs := make([]uint64, len(cases)+1)
+	for _, s := range syms {
+		var i int
+		if _, err := fmt.Sscanf(s.Name, "c%d", &i); err == nil && i < len(offs) {
+			offs[i] = s.Value
+		}
+	}
+
+	out := make([][]byte, len(cases))
+	for i := range cases {
+		out[i] = text[offs[i]:offs[i+1]]
+	}
+	return out
+}
+
+func writeGolden(t *testing.T, cases []encCase) {
+	encs := gnuAs(t, cases)
+	var buf bytes.Buffer
+	buf.WriteString("# Encodings from GNU as; regenerate with go test -run TestGoldenEncodings -update\n")
+	for i, c := range cases {
+		fmt.Fprintf(&buf, "%s\t%x\t%s\n", c.call, encs[i], c.att)
+	}
+	if err := os.WriteFile(goldenFile, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+type golden struct {
+	code []byte
+	att  string
+}
+
+func readGolden(t *testing.T) map[string]golden {
+	f, err := os.Open(goldenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	out := make(map[string]golden)
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := s.Text()
+		if line == "" || line[0] == '#' {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 3 {
+			t.Fatalf("%s: bad line: %q", goldenFile, line)
+		}
+		code, err := hex.DecodeString(fields[1])
+		if err != nil {
+			t.Fatalf("%s: bad line: %q", goldenFile, line)
+		}
+		out[fields[0]] = golden{code, fields[2]}
+	}
+	if err := s.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestGoldenEncodings(t *testing.T) {
+	cases := encCases()
+	if *update {
+		writeGolden(t, cases)
+	}
+	want := readGolden(t)
+
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for _, c := range cases {
+		g, ok := want[c.call]
+		if !ok || g.att != c.att {
+			t.Errorf("%s: not in %s; rerun with -update", c.call, goldenFile)
+			continue
+		}
+		delete(want, c.call)
+		got, err := encode(asm, c)
+		if err != nil {
+			t.Errorf("%s: %v", c.call, err)
+		} else if !bytes.Equal(got, g.code) {
+			t.Errorf("%s = %x, as encodes %s as %x", c.call, got, c.att, g.code)
+		}
+	}
+	for call := range want {
+		t.Errorf("%s: stale entry in %s; rerun with -update", call, goldenFile)
+	}
+}
+
+// encRegister picks one of the registers of the given size.
+func encRegister(bits byte, n uint8) Register {
+	var rs []Register
+	for r := range regNames {
+		if r.Bits == bits {
+			rs = append(rs, r)
+		}
+	}
+	// Fall back to the lowest-numbered register if there's none
+	// numbered n, as for %sil.
+	best := rs[0]
+	for _, r := range rs {
+		if r.Val == n%16 {
+			return r
+		}
+		if r.Val < best.Val {
+			best = r
+		}
+	}
+	return best
+}
+
+func FuzzEncoding(f *testing.F) {
+	f.Add(uint8(0), uint8(0), uint8(0), uint8(1), int32(0), int64(1))
+	f.Add(uint8(1), uint8(1), uint8(4), uint8(13), int32(-129), int64(255))
+	f.Add(uint8(14), uint8(2), uint8(12), uint8(5), int32(8), int64(-1))
+	f.Add(uint8(15), uint8(3), uint8(9), uint8(0x84), int32(127), int64(0))
+	f.Add(uint8(16), uint8(3), uint8(3), uint8(0x45), int32(1<<20), int64(0))
+	f.Add(uint8(17), uint8(5), uint8(9), uint8(0xc4), int32(-8), int64(1<<40))
+
+	asm := newAsm(f)
+	defer gojit.Release(asm.Buf)
+
+	f.Fuzz(func(t *testing.T, which, form, r1, r2 uint8, disp int32, v int64) {
+		bits := []byte{64, 32, 16, 8}[form>>4%4]
+		var mem encOperand
+		if r2&0x80 == 0 {
+			mem = indirect(encRegister(64, r2), disp, bits)
+		} else {
+			var base Register
+			if r2&0x40 != 0 {
+				base = encRegister(64, r2)
+			}
+			index := encRegister(64, r1>>4)
+			if index == Rsp {
+				index = Rbp
+			}
+			mem = sib(disp, base, index, 1<<(r2>>4&3))
+		}
+		src, dst := reg(encRegister(bits, r1)), reg(encRegister(bits, r2))
+
+		var c encCase
+		var ok bool
+		n := int(which) % (len(encInsns) + len(unaryMethods))
+		if n < len(encInsns) {
+			switch form % 5 {
+			case 0:
+				c, ok = arith(encInsns[n], src, dst)
+			case 1:
+				c, ok = arith(encInsns[n], imm(v), dst)
+			case 2:
+				c, ok = arith(encInsns[n], imm(v), mem)
+			case 3:
+				c, ok = arith(encInsns[n], src, mem)
+			case 4:
+				c, ok = arith(encInsns[n], mem, dst)
+			}
+		} else {
+			method := unaryMethods[n-len(encInsns)]
+			switch form % 3 {
+			case 0:
+				c, ok = unary(method, dst)
+			case 1:
+				c, ok = unary(method, mem)
+			case 2:
+				c, ok = unary(method, imm(v))
+			}
+		}
+		if !ok {
+			return
+		}
+
+		got, err := encode(asm, c)
+		if err != nil {
+			t.Fatalf("%s: %v", c.call, err)
+		}
+		want := gnuAs(t, []encCase{c})[0]
+		if !bytes.Equal(got, want) {
+			t.Errorf("%s = %x, as encodes %s as %x", c.call, got, c.att, want)
+		}
+	})
+}
@@ -28,14 +28,126 @@ func (a *Assembler) Decb(o Operand) {
 	o.ModRM(a, Register{1, 0})
 }
 
-func (asm *Assembler) arithmeticImmReg(insn *Instruction, src Imm, dst Register) {
-	if insn.imm_r.ok() {
-		asm.rex(false, false, false, dst.Val > 7)
-		asm.byte(insn.imm_r.value() | (dst.Val & 7))
+// An ImmError is the panic value when an immediate can't be encoded
+// for the instruction it is used with.
+type ImmError struct {
+	Mnemonic string
+	Val      int64
+	Bits     byte
+}
+
+func (e *ImmError) Error() string {
+	return fmt.Sprintf("%s: immediate %#x can't be encoded for a %d-bit operand",
+		e.Mnemonic, e.Val, e.Bits)
+}
+
+func fitsInt8(v int64) bool   { return v == int64(int8(v)) }
+func fitsInt32(v int64) bool  { return v == int64(int32(v)) }
+func fitsUint32(v int64) bool { return v == int64(uint32(v)) }
+
+// immFits reports whether v can be encoded as an immediate for an
+// operand of the given size. 8-, 16- and 32-bit immediates may be
+// written signed or unsigned; 64-bit operations only take a
+// sign-extended imm32.
+func immFits(v int64, bits byte) bool {
+	switch bits {
+	case 8:
+		return v >= -1<<7 && v < 1<<8
+	case 16:
+		return v >= -1<<15 && v < 1<<16
+	case 32:
+		return v >= -1<<31 && v < 1<<32
+	}
+	return fitsInt32(v)
+}
+
+// immBits returns the operand size of insn with an immediate source
+// and destination dst.
+func immBits(insn *Instruction, dst Operand) byte {
+	if insn.bits == 8 {
+		return 8
+	}
+	switch d := dst.(type) {
+	case Register:
+		return d.Bits
+	case Indirect:
+		switch d.Bits {
+		case 0, 64:
+			return 64
+		case 16:
+			return 16
+		}
+	}
+	return 32
+}
+
+// arithmeticImm emits insn with an immediate source, picking the
+// shortest form that encodes src: the sign-extended imm8 form where
+// the instruction has one, the %rax form, a zero-extending mov to a
+// 32-bit register, or movabs for a mov that needs all 64 bits.
+func (asm *Assembler) arithmeticImm(insn *Instruction, src Imm, dst Operand) {
+	bits := immBits(insn, dst)
+	if dr, ok := dst.(Register); ok && insn.imm_r.ok() {
+		switch {
+		case bits == 64 && !fitsInt32(src.Val) && !fitsUint32(src.Val):
+			asm.MovAbs(uint64(src.Val), dr)
+			return
+		case bits != 64 || src.Val >= 0:
+			// A mov to a 32-bit register zero-extends.
+			if bits == 64 {
+				bits = 32
+			}
+			if !immFits(src.Val, bits) {
+				panic(&ImmError{insn.Mnemonic, src.Val, bits})
+			}
+			asm.opsize(bits)
+			asm.rex(false, false, false, dr.Val > 7)
+			asm.byte(insn.imm_r.value() | (dr.Val & 7))
+			asm.imm(src.Val, bits)
+			return
+		}
+	}
+	if !immFits(src.Val, bits) {
+		panic(&ImmError{insn.Mnemonic, src.Val, bits})
+	}
+
+	val := src.Val
+	switch bits {
+	case 16:
+		val = int64(int16(val))
+	case 32:
+		val = int64(int32(val))
+	}
+	op, imm8 := insn.imm_rm.op.value(), bits == 8
+	if !imm8 && insn.imm_rm.imm8.ok() && fitsInt8(val) {
+		op, imm8 = insn.imm_rm.imm8.value(), true
+	}
+	sub := Register{insn.imm_rm.sub, 0}
+	if dr, ok := dst.(Register); ok && dr.Val == 0 &&
+		insn.imm_rm.acc.ok() && (bits == 8 || !imm8) {
+		dr.Rex(asm, sub)
+		asm.byte(insn.imm_rm.acc.value())
 	} else {
-		asm.rex(dst.Bits == 64, false, dst.Val > 7, false)
-		asm.byte(insn.imm_rm.op.value())
-		asm.modrm(MOD_REG, insn.imm_rm.sub, dst.Val&7)
+		dst.Rex(asm, sub)
+		asm.byte(op)
+		dst.ModRM(asm, sub)
+	}
+	if imm8 {
+		bits = 8
+	}
+	asm.imm(src.Val, bits)
+}
+
+// imm emits v as an immediate for an operand of size bits, which is a
+// sign-extended imm32 for 64 bits.
+func (asm *Assembler) imm(v int64, bits byte) {
+	switch bits {
+	case 8:
+		asm.byte(byte(v))
+	case 16:
+		asm.int16(uint16(v))
+	default:
+		asm.int32(uint32(v))
 	}
 }
 
@@ -54,18 +166,7 @@ func (asm *Assembler) arithmeticRegReg(insn *Instruction, src Register, dst Regi
 func (asm *Assembler) Arithmetic(insn *Instruction, src, dst Operand) {
 	switch s := src.(type) {
 	case Imm:
-		if dr, ok := dst.(Register); ok {
-			asm.arithmeticImmReg(insn, s, dr)
-		} else {
-			dst.Rex(asm, Register{insn.imm_rm.sub, 0})
-			asm.byte(insn.imm_rm.op.value())
-			dst.ModRM(asm, Register{insn.imm_rm.sub, 0})
-		}
-		if insn.bits == 8 {
-			asm.byte(byte(s.Val))
-		} else {
-			asm.int32(uint32(s.Val))
-		}
+		asm.arithmeticImm(insn, s, dst)
 		return
 	case Register:
 		if dr, ok := dst.(Register); ok {
@@ -171,25 +272,67 @@ func (a *Assembler) Ret() {
 	a.byte(0xc3)
 }
 
+// rexIndirect emits the REX prefix, if any, for an indirect call or
+// jmp through o, or a push or pop of o. Those always have a 64-bit
+// operand, so need no REX.W.
+func (a *Assembler) rexIndirect(o Operand) {
+	switch d := o.(type) {
+	case Register:
+		a.rex(false, false, false, d.Val > 7)
+	case Indirect:
+		a.rex(false, false, false, d.Base.Val > 7)
+	case SIB:
+		a.rex(false, false, d.Index.Val > 7, d.Base.Val > 7)
+	}
+}
+
 func (a *Assembler) Call(dst Operand) {
 	if _, ok := dst.(Imm); ok {
 		panic("can't call(Imm); use CallRel instead.")
 	} else {
+		a.rexIndirect(dst)
 		a.byte(0xff)
 		dst.ModRM(a, Register{0x2, 64})
 	}
 }
 
+// Jmp assembles an indirect jmp through dst, which may be a
+// Register, or a memory operand holding the target address.
+func (a *Assembler) Jmp(dst Operand) {
+	if _, ok := dst.(Imm); ok {
+		panic("can't jmp(Imm); use JmpRel instead.")
+	}
+	a.rexIndirect(dst)
+	a.byte(0xff)
+	dst.ModRM(a, Register{0x4, 64})
+}
+
 func (a *Assembler) CallRel(dst uintptr) {
+	if a.PIC && a.external(dst) {
+		a.Call(a.externalConst(dst))
+		return
+	}
 	a.byte(0xe8)
-	a.rel32(dst)
+	a.branch32(dst)
 }
 
 func (a *Assembler) Push(src Operand) {
 	if imm, ok := src.(Imm); ok {
-		a.byte(0x68)
-		a.int32(uint32(imm.Val))
+		switch {
+		case fitsInt8(imm.Val):
+			a.byte(0x6a)
+			a.byte(byte(imm.Val))
+		case fitsInt32(imm.Val):
+			a.byte(0x68)
+			a.int32(uint32(imm.Val))
+		default:
+			panic(&ImmError{"push", imm.Val, 64})
+		}
+	} else if r, ok := src.(Register); ok {
+		a.rex(false, false, false, r.Val > 7)
+		a.byte(0x50 | (r.Val & 7))
 	} else {
+		a.rexIndirect(src)
 		a.byte(0xff)
 		src.ModRM(a, Register{0x6, 64})
 	}
@@ -203,15 +346,20 @@ func (a *Assembler) Pop(dst Operand) {
 		a.rex(false, false, false, d.Val > 7)
 		a.byte(0x58 | (d.Val & 7))
 	default:
-		dst.Rex(a, Register{0x0, 64})
+		a.rexIndirect(dst)
 		a.byte(0x8f)
 		dst.ModRM(a, Register{0x0, 64})
 	}
 }
 
 func (a *Assembler) JmpRel(dst uintptr) {
+	if a.PIC && a.external(dst) {
+		a.byte(0xff)
+		a.externalConst(dst).ModRM(a, Register{0x4, 64})
+		return
+	}
 	a.byte(0xe9)
-	a.rel32(dst)
+	a.branch32(dst)
 }
 
 func (a *Assembler) JccShort(cc byte, off int8) {
@@ -220,7 +368,18 @@ func (a *Assembler) JccShort(cc byte, off int8) {
 }
 
 func (a *Assembler) JccRel(cc byte, dst uintptr) {
+	if a.PIC && a.external(dst) {
+		// j!cc over an indirect jmp
+		a.JccShort(cc^1, 6)
+		a.JmpRel(dst)
+		return
+	}
 	a.byte(0x0f)
 	a.byte(0x80 | cc)
-	a.rel32(dst)
+	a.branch32(dst)
+}
+
+func (a *Assembler) Syscall() {
+	a.byte(0x0f)
+	a.byte(0x05)
 }
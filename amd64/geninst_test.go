@@ -1,6 +1,7 @@
 package amd64
 
 import (
+	"encoding/hex"
 	"fmt"
 	"runtime"
 	"testing"
@@ -19,7 +20,7 @@ func TestMov(t *testing.T) {
 	cases := []simple{
 		{
 			func(a *Assembler) {
-				a.Mov(Imm{U32(0xdeadbeef)}, Rax)
+				a.Mov(Imm{0xdeadbeef}, Rax)
 			},
 			[]uintptr{0, 0xdeadbeef},
 		},
@@ -38,7 +39,7 @@ func TestMov(t *testing.T) {
 		},
 		{
 			func(a *Assembler) {
-				a.Mov(Imm{U32(0xf00dface)}, R10)
+				a.Mov(Imm{0xf00dface}, R10)
 				a.Mov(R10, Rax)
 			},
 			[]uintptr{0, 0xf00dface},
@@ -87,7 +88,7 @@ func TestIncDec(t *testing.T) {
 func testSimple(name string, t *testing.T, cases []simple) {
 	buf, e := gojit.Alloc(gojit.PageSize)
 	if e != nil {
-		t.Fatalf(e.Error())
+		t.Fatal(e)
 	}
 	defer gojit.Release(buf)
 
@@ -114,7 +115,7 @@ func testSimple(name string, t *testing.T, cases []simple) {
 func TestArith(t *testing.T) {
 	cases := []struct {
 		insn     *Instruction
-		lhs, rhs int32
+		lhs, rhs int64
 		out      uintptr
 	}{
 		{InstAdd, 20, 30, 50},
@@ -129,12 +130,12 @@ func TestArith(t *testing.T) {
 
 	buf, e := gojit.Alloc(gojit.PageSize)
 	if e != nil {
-		t.Fatalf(e.Error())
+		t.Fatal(e)
 	}
 	defer gojit.Release(buf)
 
 	for _, tc := range cases {
-		asm := &Assembler{buf, 0, CgoABI}
+		asm := &Assembler{Buf: buf, ABI: CgoABI}
 		var funcs []func(uintptr) uintptr
 		if tc.insn.imm_r.ok() {
 			begin(asm)
@@ -163,7 +164,7 @@ func TestArith(t *testing.T) {
 			begin(asm)
 			asm.Mov(Imm{0}, Indirect{Rdi, 0, 0})
 			asm.Mov(Imm{tc.lhs}, Indirect{Rdi, 0, 32})
-			asm.Mov(Imm{tc.rhs}, R10)
+			asm.Mov(Imm{tc.rhs}, R10d)
 			asm.Arithmetic(tc.insn, Indirect{Rdi, 0, 64}, R10)
 			asm.Mov(R10, Rax)
 			funcs = append(funcs, finish(asm))
@@ -210,3 +211,85 @@ func TestMovEsp(t *testing.T) {
 		t.Errorf("Fatal: mov from esp: got %d != %d", got, 31337)
 	}
 }
+
+// immTests are encodings of instructions with immediate operands,
+// from GNU as.
+var immTests = []struct {
+	f      func(a *Assembler)
+	expect string
+}{
+	{func(a *Assembler) { a.Add(Imm{1}, Rax) }, "4883c001"},                                   // add $1,%rax
+	{func(a *Assembler) { a.Add(Imm{-128}, Rax) }, "4883c080"},                                // add $-128,%rax
+	{func(a *Assembler) { a.Add(Imm{127}, R10) }, "4983c27f"},                                 // add $127,%r10
+	{func(a *Assembler) { a.Add(Imm{128}, Rax) }, "480580000000"},                             // add $128,%rax
+	{func(a *Assembler) { a.Add(Imm{-129}, Rdi) }, "4881c77fffffff"},                          // add $-129,%rdi
+	{func(a *Assembler) { a.Add(Imm{-0x80000000}, Rax) }, "480500000080"},                     // add $-0x80000000,%rax
+	{func(a *Assembler) { a.Sub(Imm{16}, Rsp) }, "4883ec10"},                                  // sub $16,%rsp
+	{func(a *Assembler) { a.Cmp(Imm{-1}, Ecx) }, "83f9ff"},                                    // cmp $-1,%ecx
+	{func(a *Assembler) { a.And(Imm{0xffffffff}, Ecx) }, "83e1ff"},                            // and $0xffffffff,%ecx
+	{func(a *Assembler) { a.Add(Imm{8}, Indirect{Rdi, 8, 64}) }, "4883470808"},                // addq $8,8(%rdi)
+	{func(a *Assembler) { a.Add(Imm{1000}, Indirect{Rsp, 0, 64}) }, "48810424e8030000"},       // addq $1000,(%rsp)
+	{func(a *Assembler) { a.Add(Imm{0xffffffff}, Indirect{Rdi, 0, 32}) }, "8307ff"},           // addl $0xffffffff,(%rdi)
+	{func(a *Assembler) { a.Addb(Imm{255}, Indirect{Rax, 0, 8}) }, "8000ff"},                  // addb $255,(%rax)
+	{func(a *Assembler) { a.Addb(Imm{-1}, Indirect{Rax, 0, 8}) }, "8000ff"},                   // addb $-1,(%rax)
+	{func(a *Assembler) { a.Test(Imm{1}, Rax) }, "48a901000000"},                              // test $1,%rax
+	{func(a *Assembler) { a.Testb(Imm{0xff}, Indirect{Rax, 0, 8}) }, "f600ff"},                // testb $0xff,(%rax)
+	{func(a *Assembler) { a.Mov(Imm{0}, Rax) }, "b800000000"},                                 // mov $0,%eax
+	{func(a *Assembler) { a.Mov(Imm{0xdeadbeef}, Rax) }, "b8efbeadde"},                        // mov $0xdeadbeef,%eax
+	{func(a *Assembler) { a.Mov(Imm{0xdeadbeef}, R10) }, "41baefbeadde"},                      // mov $0xdeadbeef,%r10d
+	{func(a *Assembler) { a.Mov(Imm{-1}, Rax) }, "48c7c0ffffffff"},                            // movq $-1,%rax
+	{func(a *Assembler) { a.Mov(Imm{-0x80000000}, R9) }, "49c7c100000080"},                    // movq $-0x80000000,%r9
+	{func(a *Assembler) { a.Mov(Imm{0x100000000}, Rax) }, "48b80000000001000000"},             // movabs $0x100000000,%rax
+	{func(a *Assembler) { a.Mov(Imm{0x123456789abcdef0}, R11) }, "49bbf0debc9a78563412"},      // movabs $0x123456789abcdef0,%r11
+	{func(a *Assembler) { a.Mov(Imm{-0x80000001}, Rcx) }, "48b9ffffff7fffffffff"},             // movabs $-0x80000001,%rcx
+	{func(a *Assembler) { a.Mov(Imm{-1}, Eax) }, "b8ffffffff"},                                // movl $-1,%eax
+	{func(a *Assembler) { a.Mov(Imm{-1}, Indirect{Rdi, 0, 64}) }, "48c707ffffffff"},           // movq $-1,(%rdi)
+	{func(a *Assembler) { a.Mov(Imm{0x7fffffff}, Indirect{Rdi, 8, 64}) }, "48c74708ffffff7f"}, // movq $0x7fffffff,8(%rdi)
+	{func(a *Assembler) { a.Mov(Imm{0xffffffff}, Indirect{Rdi, 0, 32}) }, "c707ffffffff"},     // movl $0xffffffff,(%rdi)
+	{func(a *Assembler) { a.Movb(Imm{0xff}, Indirect{Rax, 0, 8}) }, "c600ff"},                 // movb $0xff,(%rax)
+	{func(a *Assembler) { a.Push(Imm{1}) }, "6a01"},                                           // push $1
+	{func(a *Assembler) { a.Push(Imm{-128}) }, "6a80"},                                        // push $-128
+	{func(a *Assembler) { a.Push(Imm{128}) }, "6880000000"},                                   // push $128
+	{func(a *Assembler) { a.Push(Imm{-0x80000000}) }, "6800000080"},                           // push $-0x80000000
+}
+
+func TestImmEncoding(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for i, tc := range immTests {
+		asm.Off = 0
+		tc.f(asm)
+		got := hex.EncodeToString(asm.Buf[:asm.Off])
+		if got != tc.expect {
+			t.Errorf("[%d] encoded as %s, expect %s", i, got, tc.expect)
+		}
+	}
+}
+
+func TestImmRange(t *testing.T) {
+	cases := []func(a *Assembler){
+		func(a *Assembler) { a.Add(Imm{0x80000000}, Rax) },
+		func(a *Assembler) { a.Add(Imm{0x100000000}, Ecx) },
+		func(a *Assembler) { a.Mov(Imm{0x80000000}, Indirect{Rdi, 0, 64}) },
+		func(a *Assembler) { a.Mov(Imm{-0x80000001}, Eax) },
+		func(a *Assembler) { a.Addb(Imm{256}, Indirect{Rax, 0, 8}) },
+		func(a *Assembler) { a.Test(Imm{1 << 40}, Rax) },
+		func(a *Assembler) { a.Push(Imm{0x80000000}) },
+	}
+
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for i, f := range cases {
+		func() {
+			defer func() {
+				if _, ok := recover().(*ImmError); !ok {
+					t.Errorf("[%d] didn't panic with an *ImmError", i)
+				}
+			}()
+			asm.Off = 0
+			f(asm)
+		}()
+	}
+}
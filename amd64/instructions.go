@@ -18,8 +18,10 @@ func (n no) ok() bool    { return false }
 func (n no) value() byte { panic("no{}.value()!") }
 
 type ImmRm struct {
-	op  maybeByte
-	sub byte
+	op   maybeByte
+	imm8 maybeByte // the sign-extended imm8 form, if any
+	acc  maybeByte // the form with %rax as the destination, if any
+	sub  byte
 }
 
 type Instruction struct {
@@ -45,11 +47,15 @@ func asByteInsn(op *Instruction) *Instruction {
 	if out.imm_rm.op.ok() {
 		out.imm_rm.op = j{out.imm_rm.op.value() & ^byte(1)}
 	}
+	out.imm_rm.imm8 = no{}
+	if out.imm_rm.acc.ok() {
+		out.imm_rm.acc = j{out.imm_rm.acc.value() & ^byte(1)}
+	}
 	if out.r_rm.ok() {
 		out.r_rm = j{out.r_rm.value() & ^byte(1)}
 	}
 	if out.rm_r.ok() {
-		out.r_rm = j{out.rm_r.value() & ^byte(1)}
+		out.rm_r = j{out.rm_r.value() & ^byte(1)}
 	}
 
 	out.bits = 8
@@ -58,22 +64,22 @@ func asByteInsn(op *Instruction) *Instruction {
 }
 
 var (
-	InstAdd   = &Instruction{"add", no{}, ImmRm{j{0x81}, 0}, j{0x01}, j{0x03}, 64}
+	InstAdd   = &Instruction{"add", no{}, ImmRm{j{0x81}, j{0x83}, j{0x05}, 0}, j{0x01}, j{0x03}, 64}
 	InstAddb  = asByteInsn(InstAdd)
-	InstAnd   = &Instruction{"and", no{}, ImmRm{j{0x81}, 4}, j{0x21}, j{0x23}, 64}
+	InstAnd   = &Instruction{"and", no{}, ImmRm{j{0x81}, j{0x83}, j{0x25}, 4}, j{0x21}, j{0x23}, 64}
 	InstAndb  = asByteInsn(InstAnd)
-	InstCmp   = &Instruction{"cmp", no{}, ImmRm{j{0x81}, 7}, j{0x39}, j{0x3B}, 64}
+	InstCmp   = &Instruction{"cmp", no{}, ImmRm{j{0x81}, j{0x83}, j{0x3D}, 7}, j{0x39}, j{0x3B}, 64}
 	InstCmpb  = asByteInsn(InstCmp)
-	InstOr    = &Instruction{"or", no{}, ImmRm{j{0x81}, 1}, j{0x09}, j{0x0B}, 64}
+	InstOr    = &Instruction{"or", no{}, ImmRm{j{0x81}, j{0x83}, j{0x0D}, 1}, j{0x09}, j{0x0B}, 64}
 	InstOrb   = asByteInsn(InstOr)
-	InstSub   = &Instruction{"sub", no{}, ImmRm{j{0x81}, 5}, j{0x29}, j{0x2B}, 64}
+	InstSub   = &Instruction{"sub", no{}, ImmRm{j{0x81}, j{0x83}, j{0x2D}, 5}, j{0x29}, j{0x2B}, 64}
 	InstSubb  = asByteInsn(InstSub)
-	InstTest  = &Instruction{"test", no{}, ImmRm{j{0xF7}, 0}, j{0x85}, no{}, 64}
+	InstTest  = &Instruction{"test", no{}, ImmRm{j{0xF7}, no{}, j{0xA9}, 0}, j{0x85}, no{}, 64}
 	InstTestb = asByteInsn(InstTest)
-	InstXor   = &Instruction{"xor", no{}, ImmRm{j{0x81}, 6}, j{0x31}, j{0x33}, 64}
+	InstXor   = &Instruction{"xor", no{}, ImmRm{j{0x81}, j{0x83}, j{0x35}, 6}, j{0x31}, j{0x33}, 64}
 	InstXorb  = asByteInsn(InstXor)
 
-	InstLea  = &Instruction{"lea", no{}, ImmRm{no{}, 0}, no{}, j{0x8D}, 64}
-	InstMov  = &Instruction{"mov", j{0xB8}, ImmRm{j{0xc7}, 0}, j{0x89}, j{0x8b}, 64}
+	InstLea  = &Instruction{"lea", no{}, ImmRm{no{}, no{}, no{}, 0}, no{}, j{0x8D}, 64}
+	InstMov  = &Instruction{"mov", j{0xB8}, ImmRm{j{0xc7}, no{}, no{}, 0}, j{0x89}, j{0x8b}, 64}
 	InstMovb = asByteInsn(InstMov)
 )
@@ -0,0 +1,106 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+func TestJumpTable(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	var table, done Label
+	cases := make([]Label, 3)
+	begin(asm)
+	asm.LeaLabel(&table, Rcx)
+	asm.Jmp(SIB{0, Rcx, Rdi, Scale8})
+	for i := range cases {
+		asm.Bind(&cases[i])
+		asm.Mov(Imm{int64(10 * (i + 1))}, Rax)
+		asm.JmpLabel(&done)
+	}
+	asm.Align(8)
+	asm.Bind(&table)
+	asm.LabelTable(&cases[0], &cases[1], &cases[2])
+	asm.Bind(&done)
+	f := finish(asm)
+
+	for i := range cases {
+		if got := f(uintptr(i)); got != uintptr(10*(i+1)) {
+			t.Errorf("f(%d) = %d", i, got)
+		}
+	}
+}
+
+func TestLabelTableForward(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	var table, target Label
+	asm.Bind(&table)
+	asm.LabelTable(&target)
+	asm.Int3()
+	asm.Bind(&target)
+
+	if got := binary.LittleEndian.Uint64(asm.Buf[table.Off():]); uintptr(got) != gojit.Addr(asm.Buf[target.Off():]) {
+		t.Errorf("table entry = %#x, expected %#x", got, gojit.Addr(asm.Buf[target.Off():]))
+	}
+}
+
+func TestJmpOperands(t *testing.T) {
+	// Each case jumps indirectly to a stub setting %rax to 42.
+	slot, e := gojit.Alloc(gojit.PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer gojit.Release(slot)
+
+	cases := []struct {
+		name string
+		emit func(asm *Assembler, target *Label)
+	}{
+		{"r11", func(asm *Assembler, target *Label) {
+			asm.LeaLabel(target, R11)
+			asm.Jmp(R11)
+		}},
+		{"indirect", func(asm *Assembler, target *Label) {
+			asm.LeaLabel(target, Rcx)
+			asm.Push(Rcx)
+			asm.Mov(Rsp, R10)
+			asm.Add(Imm{8}, Rsp)
+			asm.Jmp(Indirect{R10, 0, 64})
+		}},
+		{"sib", func(asm *Assembler, target *Label) {
+			asm.LeaLabel(target, Rcx)
+			asm.Push(Rcx)
+			asm.Mov(Imm{1}, R8)
+			asm.Mov(Rsp, Rdx)
+			asm.Add(Imm{8}, Rsp)
+			asm.Jmp(SIB{-8, Rdx, R8, Scale8})
+		}},
+		{"pcrel", func(asm *Assembler, target *Label) {
+			asm.Jmp(PCRel{gojit.Addr(slot)})
+		}},
+	}
+
+	for _, tc := range cases {
+		asm := newAsm(t)
+		buf := asm.Buf
+		var target Label
+		begin(asm)
+		asm.Xor(Rax, Rax)
+		tc.emit(asm, &target)
+		asm.Int3()
+		asm.Bind(&target)
+		binary.LittleEndian.PutUint64(slot, uint64(gojit.Addr(asm.Buf[target.Off():])))
+		asm.Mov(Imm{42}, Rax)
+		f := finish(asm)
+
+		if got := f(0); got != 42 {
+			t.Errorf("%s: f() = %d", tc.name, got)
+		}
+		gojit.Release(buf)
+	}
+}
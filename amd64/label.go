@@ -0,0 +1,169 @@
+package amd64
+
+import (
+	"encoding/binary"
+
+	"github.com/nelhage/gojit"
+)
+
+// A Label marks an offset in an Assembler's buffer. Code may refer to
+// a Label before it is bound; such references are filled in by Bind.
+// The zero Label is unbound and ready to use.
+type Label struct {
+	off   int
+	bound bool
+	refs  []labelRef
+}
+
+type labelRef struct {
+	off int
+	abs bool
+}
+
+// Off returns the offset at which l was bound.
+func (l *Label) Off() int {
+	if !l.bound {
+		panic("Label.Off: unbound label")
+	}
+	return l.off
+}
+
+type relocType int
+
+const (
+	// relPC32 is a 32-bit displacement from the end of the
+	// field.
+	relPC32 relocType = iota
+	// relAbs64 is a 64-bit absolute address.
+	relAbs64
+)
+
+// A reloc records a reference from the code to an address that
+// depends on where the code or its target is loaded: either a rel32
+// to outside of Buf, or the absolute address of a Label.
+type reloc struct {
+	off    int
+	typ    relocType
+	addr   uintptr
+	label  *Label
+	branch bool
+}
+
+func (r reloc) size() int {
+	if r.typ == relAbs64 {
+		return 8
+	}
+	return 4
+}
+
+// Bind binds l to the current offset.
+func (a *Assembler) Bind(l *Label) {
+	if l.bound {
+		panic("Bind: label bound twice")
+	}
+	l.off, l.bound = a.Off, true
+	for _, r := range l.refs {
+		if r.abs {
+			binary.LittleEndian.PutUint64(a.Buf[r.off:], uint64(gojit.Addr(a.Buf[l.off:])))
+		} else {
+			binary.LittleEndian.PutUint32(a.Buf[r.off:], uint32(int32(l.off-(r.off+4))))
+		}
+	}
+	a.unbound -= len(l.refs)
+	l.refs = nil
+}
+
+func (a *Assembler) label32(l *Label) {
+	if l.bound {
+		a.int32(uint32(int32(l.off - (a.Off + 4))))
+		return
+	}
+	l.refs = append(l.refs, labelRef{a.Off, false})
+	a.unbound++
+	a.int32(0)
+}
+
+// JmpLabel assembles a jmp to l.
+func (a *Assembler) JmpLabel(l *Label) {
+	a.byte(0xe9)
+	a.label32(l)
+}
+
+// JccLabel assembles a conditional jump to l.
+func (a *Assembler) JccLabel(cc byte, l *Label) {
+	a.byte(0x0f)
+	a.byte(0x80 | cc)
+	a.label32(l)
+}
+
+// CallLabel assembles a call to l.
+func (a *Assembler) CallLabel(l *Label) {
+	a.byte(0xe8)
+	a.label32(l)
+}
+
+// LeaLabel loads the address of l into dst, using a %rip-relative
+// lea.
+func (a *Assembler) LeaLabel(l *Label, dst Register) {
+	a.rex(true, dst.Val > 7, false, false)
+	a.byte(InstLea.rm_r.value())
+	a.modrm(MOD_INDIR, dst.Val&7, REG_DISP32)
+	a.label32(l)
+}
+
+// MovAbsLabel loads the absolute address of l into dst. Unlike
+// LeaLabel, the resulting code depends on where it is loaded, and
+// WriteObject emits a relocation for it.
+func (a *Assembler) MovAbsLabel(l *Label, dst Register) {
+	if a.PIC {
+		panic("MovAbsLabel: not position-independent")
+	}
+	a.rex(true, false, false, dst.Val > 7)
+	a.byte(InstMov.imm_r.value() | (dst.Val & 7))
+	a.label64(l)
+}
+
+func (a *Assembler) label64(l *Label) {
+	a.relocs = append(a.relocs, reloc{off: a.Off, typ: relAbs64, label: l})
+	if l.bound {
+		a.int64(uint64(gojit.Addr(a.Buf[l.off:])))
+		return
+	}
+	l.refs = append(l.refs, labelRef{a.Off, true})
+	a.unbound++
+	a.int64(0)
+}
+
+// LabelTable embeds a table of the absolute addresses of ls, as
+// 64-bit values, for use with an indirect Jmp or Call. Labels that
+// are not yet bound are filled in when they are. For example, to
+// dispatch on %rax:
+//
+//    asm.LeaLabel(&table, Rcx)
+//    asm.Jmp(SIB{0, Rcx, Rax, Scale8})
+//    ...
+//    asm.Align(8)
+//    asm.Bind(&table)
+//    asm.LabelTable(&case0, &case1, &case2)
+//
+// Like MovAbsLabel, LabelTable panics in PIC mode.
+func (a *Assembler) LabelTable(ls ...*Label) {
+	if a.PIC {
+		panic("LabelTable: not position-independent")
+	}
+	start := a.Off
+	for _, l := range ls {
+		a.label64(l)
+	}
+	a.span(spanData, start)
+}
+
+// Extern names the external symbol at addr. WriteObject writes
+// references to addr assembled by CallRel, JmpRel, JccRel and PCRel
+// as relocations against name.
+func (a *Assembler) Extern(name string, addr uintptr) {
+	if a.externs == nil {
+		a.externs = make(map[uintptr]string)
+	}
+	a.externs[addr] = name
+}
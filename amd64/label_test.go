@@ -0,0 +1,68 @@
+package amd64
+
+import (
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+func TestLabels(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	// sum(x) = x + (x-1) + ... + 1
+	begin(asm)
+	var top, done Label
+	asm.Xor(Rax, Rax)
+	asm.Bind(&top)
+	asm.Test(Rdi, Rdi)
+	asm.JccLabel(CC_Z, &done)
+	asm.Add(Rdi, Rax)
+	asm.Dec(Rdi)
+	asm.JmpLabel(&top)
+	asm.Bind(&done)
+	sum := finish(asm)
+
+	if got := sum(10); got != 55 {
+		t.Errorf("sum(10) = %d, expected 55", got)
+	}
+	if got := sum(0); got != 0 {
+		t.Errorf("sum(0) = %d, expected 0", got)
+	}
+}
+
+func TestLabelAddress(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	begin(asm)
+	var data, out Label
+	asm.LeaLabel(&data, Rcx)
+	asm.MovAbsLabel(&data, Rdx)
+	asm.Mov(Indirect{Rcx, 0, 64}, Rax)
+	asm.Add(Indirect{Rdx, 0, 64}, Rax)
+	asm.JmpLabel(&out)
+	asm.Bind(&data)
+	asm.int64(21)
+	asm.Bind(&out)
+	f := finish(asm)
+
+	if got := f(0); got != 42 {
+		t.Errorf("f() = %d, expected 42", got)
+	}
+}
+
+func TestUnboundLabel(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	var l Label
+	asm.JmpLabel(&l)
+	defer func() {
+		if recover() == nil {
+			t.Error("BuildTo with an unbound label did not panic")
+		}
+	}()
+	var f func()
+	asm.BuildTo(&f)
+}
@@ -0,0 +1,135 @@
+package amd64
+
+import (
+	"debug/elf"
+	"fmt"
+	"io"
+
+	"github.com/nelhage/gojit/elfgen"
+)
+
+// WriteObject writes the code assembled so far to w as an ELF64
+// relocatable object file, which can be linked into a C or Go
+// program with the system linker. The code is placed in .text, and
+// each function started with Func becomes a global function symbol.
+//
+// References assembled by CallRel, JmpRel, JccRel or PCRel to
+// addresses outside Buf are written as R_X86_64_PLT32 or
+// R_X86_64_PC32 relocations against the names given to those
+// addresses with Extern, and MovAbsLabel as an R_X86_64_64
+// relocation against .text. In PIC mode, the constant pool slots
+// that hold such addresses are written as R_X86_64_64 relocations
+// against their names instead. Other absolute addresses, such as
+// those embedded by MovAbs or CallFunc, are written as-is, and are
+// meaningless outside of this process.
+func (a *Assembler) WriteObject(w io.Writer) error {
+	a.flushPool()
+	if a.unbound > 0 {
+		return fmt.Errorf("WriteObject: reference to unbound label")
+	}
+
+	var f elfgen.File
+	f.Type = elf.ET_REL
+	code := append([]byte(nil), a.Buf[:a.Off]...)
+	text := f.AddSection(&elfgen.Section{
+		Name:  ".text",
+		Type:  elf.SHT_PROGBITS,
+		Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+		Align: 16,
+		Data:  code,
+	})
+	f.AddSection(&elfgen.Section{
+		Name:  ".note.GNU-stack",
+		Type:  elf.SHT_PROGBITS,
+		Align: 1,
+	})
+	textSym := f.AddSymbol(&elfgen.Symbol{
+		Section: text,
+		Type:    elf.STT_SECTION,
+		Bind:    elf.STB_LOCAL,
+	})
+	for _, s := range a.Symbols() {
+		f.AddSymbol(&elfgen.Symbol{
+			Name:    s.Name,
+			Section: text,
+			Value:   uint64(s.Off),
+			Size:    uint64(s.Len),
+			Type:    elf.STT_FUNC,
+			Bind:    elf.STB_GLOBAL,
+		})
+	}
+
+	// Code that rewinds Off and assembles over itself can leave
+	// stale relocs behind; the last one at each offset wins.
+	last := make(map[int]int)
+	for i, r := range a.relocs {
+		last[r.off] = i
+	}
+	externs := make(map[string]*elfgen.Symbol)
+	extern := func(r reloc) (*elfgen.Symbol, error) {
+		name, ok := a.externs[r.addr]
+		if !ok {
+			return nil, fmt.Errorf("WriteObject: no Extern for reference to %#x at +%d", r.addr, r.off)
+		}
+		sym, ok := externs[name]
+		if !ok {
+			sym = f.AddSymbol(&elfgen.Symbol{
+				Name: name,
+				Type: elf.STT_NOTYPE,
+				Bind: elf.STB_GLOBAL,
+			})
+			externs[name] = sym
+		}
+		return sym, nil
+	}
+	for i, r := range a.relocs {
+		if last[r.off] != i || r.off+r.size() > a.Off {
+			continue
+		}
+		switch r.typ {
+		case relAbs64:
+			for i := 0; i < 8; i++ {
+				code[r.off+i] = 0
+			}
+			if r.label != nil {
+				text.Relocs = append(text.Relocs, elfgen.Reloc{
+					Off:    uint64(r.off),
+					Sym:    textSym,
+					Type:   elf.R_X86_64_64,
+					Addend: int64(r.label.Off()),
+				})
+				continue
+			}
+			sym, e := extern(r)
+			if e != nil {
+				return e
+			}
+			text.Relocs = append(text.Relocs, elfgen.Reloc{
+				Off:  uint64(r.off),
+				Sym:  sym,
+				Type: elf.R_X86_64_64,
+			})
+		case relPC32:
+			sym, e := extern(r)
+			if e != nil {
+				return e
+			}
+			typ := elf.R_X86_64_PC32
+			if r.branch {
+				typ = elf.R_X86_64_PLT32
+			}
+			for i := 0; i < 4; i++ {
+				code[r.off+i] = 0
+			}
+			text.Relocs = append(text.Relocs, elfgen.Reloc{
+				Off:    uint64(r.off),
+				Sym:    sym,
+				Type:   typ,
+				Addend: -4,
+			})
+		}
+	}
+
+	_, err := w.Write(f.Bytes())
+	return err
+}
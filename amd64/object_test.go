@@ -0,0 +1,125 @@
+package amd64
+
+import (
+	"bytes"
+	"debug/elf"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+const objectMain = `#include <stdio.h>
+
+long gojit_obj_test(long);
+
+long gojit_helper(long x) {
+	return 2 * x;
+}
+
+int main(void) {
+	printf("%ld\n", gojit_obj_test(21));
+	return 0;
+}
+`
+
+func TestWriteObject(t *testing.T) {
+	testWriteObject(t, false)
+}
+
+func TestWriteObjectPIC(t *testing.T) {
+	testWriteObject(t, true)
+}
+
+func testWriteObject(t *testing.T, pic bool) {
+	asm := newAsm(t)
+	asm.PIC = pic
+	defer gojit.Release(asm.Buf)
+
+	// gojit_obj_test(x) = gojit_helper(x) + 100
+	helper := gojit.Addr(asm.Buf) + uintptr(len(asm.Buf)) + 64
+	asm.Extern("gojit_helper", helper)
+	var data, done Label
+	asm.Func("gojit_obj_test")
+	asm.Sub(Imm{8}, Rsp)
+	asm.CallRel(helper)
+	asm.Add(Imm{8}, Rsp)
+	if pic {
+		asm.LeaLabel(&data, Rcx)
+	} else {
+		asm.MovAbsLabel(&data, Rcx)
+	}
+	asm.Add(Indirect{Rcx, 0, 64}, Rax)
+	asm.JmpLabel(&done)
+	asm.Bind(&data)
+	asm.int64(100)
+	asm.Bind(&done)
+	asm.Ret()
+
+	var obj bytes.Buffer
+	if e := asm.WriteObject(&obj); e != nil {
+		t.Fatalf("WriteObject: %s", e.Error())
+	}
+
+	f, e := elf.NewFile(bytes.NewReader(obj.Bytes()))
+	if e != nil {
+		t.Fatalf("elf.NewFile: %s", e.Error())
+	}
+	syms, e := f.Symbols()
+	if e != nil {
+		t.Fatalf("Symbols: %s", e.Error())
+	}
+	found := map[string]elf.Symbol{}
+	for _, s := range syms {
+		found[s.Name] = s
+	}
+	if s, ok := found["gojit_obj_test"]; !ok || elf.ST_TYPE(s.Info) != elf.STT_FUNC || s.Size != uint64(asm.Symbols()[0].Len) {
+		t.Errorf("gojit_obj_test = %+v", s)
+	}
+	if s, ok := found["gojit_helper"]; !ok || s.Section != elf.SHN_UNDEF {
+		t.Errorf("gojit_helper = %+v", s)
+	}
+
+	cc, e := exec.LookPath("cc")
+	if e != nil {
+		t.Skip("no C compiler to link with")
+	}
+	dir, e := ioutil.TempDir("", "gojit")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	if e := ioutil.WriteFile(filepath.Join(dir, "obj.o"), obj.Bytes(), 0644); e != nil {
+		t.Fatal(e)
+	}
+	if e := ioutil.WriteFile(filepath.Join(dir, "main.c"), []byte(objectMain), 0644); e != nil {
+		t.Fatal(e)
+	}
+	// MovAbsLabel's absolute relocation isn't position-independent.
+	prog := filepath.Join(dir, "prog")
+	if out, e := exec.Command(cc, "-no-pie", "-o", prog,
+		filepath.Join(dir, "main.c"), filepath.Join(dir, "obj.o")).CombinedOutput(); e != nil {
+		t.Fatalf("linking: %s\n%s", e.Error(), out)
+	}
+	out, e := exec.Command(prog).Output()
+	if e != nil {
+		t.Fatalf("running: %s", e.Error())
+	}
+	if string(out) != "142\n" {
+		t.Errorf("got %q, expected %q", out, "142\n")
+	}
+}
+
+func TestWriteObjectUnnamedExtern(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	asm.CallRel(gojit.Addr(asm.Buf) + uintptr(len(asm.Buf)) + 64)
+	asm.Ret()
+	if e := asm.WriteObject(ioutil.Discard); e == nil {
+		t.Error("WriteObject succeeded with an unnamed external call")
+	}
+}
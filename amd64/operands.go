@@ -9,12 +9,17 @@ type Operand interface {
 	ModRM(asm *Assembler, reg Register)
 }
 
+// Imm is an immediate operand. The assembler picks the shortest
+// encoding of Val the instruction allows, and panics with an
+// *ImmError if there is none.
 type Imm struct {
-	Val int32
+	Val int64
 }
 
-func U32(u uint32) int32 {
-	return int32(u)
+// U32 returns the value of the 32-bit immediate u as the processor
+// sign-extends it for a 64-bit operation.
+func U32(u uint32) int64 {
+	return int64(int32(u))
 }
 
 func (i Imm) isOperand() {}
@@ -75,35 +80,59 @@ var (
 	R15  = Register{15, 64}
 )
 
+// The 16-bit registers. Instructions on them, or on 16-bit Indirect
+// operands, take an operand-size prefix.
+var (
+	Ax   = Register{0, 16}
+	Cx   = Register{1, 16}
+	Dx   = Register{2, 16}
+	Bx   = Register{3, 16}
+	Sp   = Register{4, 16}
+	Bp   = Register{5, 16}
+	Si   = Register{6, 16}
+	Di   = Register{7, 16}
+	R8w  = Register{8, 16}
+	R9w  = Register{9, 16}
+	R10w = Register{10, 16}
+	R11w = Register{11, 16}
+	R12w = Register{12, 16}
+	R13w = Register{13, 16}
+	R14w = Register{14, 16}
+	R15w = Register{15, 16}
+)
+
+// The 8-bit registers, for use with the byte instructions. %spl,
+// %bpl, %sil and %dil need a REX prefix even with no other REX bits
+// set, which the assembler doesn't emit, and so aren't provided.
+var (
+	Al   = Register{0, 8}
+	Cl   = Register{1, 8}
+	Dl   = Register{2, 8}
+	Bl   = Register{3, 8}
+	R8b  = Register{8, 8}
+	R9b  = Register{9, 8}
+	R10b = Register{10, 8}
+	R11b = Register{11, 8}
+	R12b = Register{12, 8}
+	R13b = Register{13, 8}
+	R14b = Register{14, 8}
+	R15b = Register{15, 8}
+)
+
+// Indirect is the memory operand Offset(Base), of size Bits.
 type Indirect struct {
 	Base   Register
 	Offset int32
 	Bits   byte
 }
 
-func (i Indirect) short() bool {
-	return int32(int8(i.Offset)) == i.Offset
-}
-
 func (i Indirect) isOperand() {}
 func (i Indirect) Rex(asm *Assembler, reg Register) {
 	asm.rexBits(reg.Bits, i.Bits, reg.Val > 7, false, i.Base.Val > 7)
 }
 
 func (i Indirect) ModRM(asm *Assembler, reg Register) {
-	if i.Base.Val == REG_SIB {
-		SIB{i.Offset, Esp, Esp, Scale1}.ModRM(asm, reg)
-		return
-	}
-	if i.Offset == 0 {
-		asm.modrm(MOD_INDIR, reg.Val&7, i.Base.Val&7)
-	} else if i.short() {
-		asm.modrm(MOD_INDIR_DISP8, reg.Val&7, i.Base.Val&7)
-		asm.byte(byte(i.Offset))
-	} else {
-		asm.modrm(MOD_INDIR_DISP32, reg.Val&7, i.Base.Val&7)
-		asm.int32(uint32(i.Offset))
-	}
+	asm.memModRM(reg, i.Base, true, Rsp, SCALE_1, i.Offset)
 }
 
 type PCRel struct {
@@ -112,6 +141,7 @@ type PCRel struct {
 
 func (i PCRel) isOperand() {}
 func (i PCRel) Rex(asm *Assembler, reg Register) {
+	asm.opsize(reg.Bits)
 	asm.rex(reg.Bits == 64, reg.Val > 7, false, false)
 }
 func (i PCRel) ModRM(asm *Assembler, reg Register) {
@@ -130,24 +160,79 @@ var (
 	Scale8 = Scale{SCALE_8}
 )
 
+// SIB is the memory operand Offset(Base, Index, Scale). A Base with
+// Bits of 0, such as Register{}, means no base register, giving
+// Offset(, Index, Scale). An Index of %rsp means no index register.
 type SIB struct {
 	Offset      int32
 	Base, Index Register
 	Scale       Scale
 }
 
+func (s SIB) hasBase() bool {
+	return s.Base.Bits != 0
+}
+
 func (s SIB) isOperand() {}
 func (s SIB) Rex(asm *Assembler, reg Register) {
-	asm.rex(reg.Bits == 64, reg.Val > 7, s.Index.Val > 7, s.Base.Val > 7)
+	asm.opsize(reg.Bits)
+	asm.rex(reg.Bits == 64, reg.Val > 7, s.Index.Val > 7, s.hasBase() && s.Base.Val > 7)
 }
 
 func (s SIB) ModRM(asm *Assembler, reg Register) {
-	if s.Offset != 0 {
-		asm.modrm(MOD_INDIR_DISP32, reg.Val&7, REG_SIB)
-		asm.sib(s.Scale.scale, s.Index.Val&7, s.Base.Val&7)
-		asm.int32(uint32(s.Offset))
-	} else {
+	asm.memModRM(reg, s.Base, s.hasBase(), s.Index, s.Scale.scale, s.Offset)
+}
+
+// memModRM emits the ModRM byte, and SIB byte and displacement if
+// needed, for the memory operand disp(base, index, scale), with reg
+// in the ModRM reg field. An index of %rsp means none. It uses the
+// shortest displacement that can express disp, and works around the
+// encodings that the hardware reserves:
+//
+//   - rm=100 means a SIB byte follows, so %rsp and %r12 as a base
+//     need one even without an index.
+//   - mod=00 rm=101 means %rip-relative, so %rbp and %r13 as a base
+//     need a displacement even if it is zero.
+//   - mod=00 with SIB base=101 means no base and a disp32, which is
+//     also how an operand with no base is encoded; an operand with
+//     neither base nor index needs a SIB byte too, since rm=101
+//     would make it %rip-relative.
+func (asm *Assembler) memModRM(reg, base Register, hasBase bool, index Register, scale byte, disp int32) {
+	hasIndex := index.Val != REG_SIB
+	if !hasBase {
 		asm.modrm(MOD_INDIR, reg.Val&7, REG_SIB)
-		asm.sib(s.Scale.scale, s.Index.Val&7, s.Base.Val&7)
+		if !hasIndex {
+			scale = SCALE_1
+		}
+		asm.sib(scale, index.Val&7, REG_DISP32)
+		asm.int32(uint32(disp))
+		return
+	}
+
+	var mod byte
+	switch {
+	case disp == 0 && base.Val&7 != REG_DISP32:
+		mod = MOD_INDIR
+	case int32(int8(disp)) == disp:
+		mod = MOD_INDIR_DISP8
+	default:
+		mod = MOD_INDIR_DISP32
+	}
+
+	if hasIndex || base.Val&7 == REG_SIB {
+		if !hasIndex {
+			scale = SCALE_1
+		}
+		asm.modrm(mod, reg.Val&7, REG_SIB)
+		asm.sib(scale, index.Val&7, base.Val&7)
+	} else {
+		asm.modrm(mod, reg.Val&7, base.Val&7)
+	}
+
+	switch mod {
+	case MOD_INDIR_DISP8:
+		asm.byte(byte(disp))
+	case MOD_INDIR_DISP32:
+		asm.int32(uint32(disp))
 	}
 }
@@ -0,0 +1,222 @@
+package amd64
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+// memOperandTests are encodings of mov mem, reg, from GNU as.
+var memOperandTests = []struct {
+	mem    Operand
+	reg    Register
+	expect string
+}{
+	{Indirect{Rax, 0, 64}, Rax, "488b00"},                           // mov 0(%rax),%rax
+	{Indirect{Rax, 8, 64}, Rax, "488b4008"},                         // mov 8(%rax),%rax
+	{Indirect{Rax, -128, 64}, Rax, "488b4080"},                      // mov -128(%rax),%rax
+	{Indirect{Rax, 127, 64}, Rax, "488b407f"},                       // mov 127(%rax),%rax
+	{Indirect{Rax, 128, 64}, Rax, "488b8080000000"},                 // mov 128(%rax),%rax
+	{Indirect{Rax, -129, 64}, Rax, "488b807fffffff"},                // mov -129(%rax),%rax
+	{Indirect{Rax, 305419896, 64}, Rax, "488b8078563412"},           // mov 305419896(%rax),%rax
+	{Indirect{Rsp, 0, 64}, Rax, "488b0424"},                         // mov 0(%rsp),%rax
+	{Indirect{Rsp, 8, 64}, Rax, "488b442408"},                       // mov 8(%rsp),%rax
+	{Indirect{Rsp, -128, 64}, Rax, "488b442480"},                    // mov -128(%rsp),%rax
+	{Indirect{Rsp, 127, 64}, Rax, "488b44247f"},                     // mov 127(%rsp),%rax
+	{Indirect{Rsp, 128, 64}, Rax, "488b842480000000"},               // mov 128(%rsp),%rax
+	{Indirect{Rsp, -129, 64}, Rax, "488b84247fffffff"},              // mov -129(%rsp),%rax
+	{Indirect{Rsp, 305419896, 64}, Rax, "488b842478563412"},         // mov 305419896(%rsp),%rax
+	{Indirect{Rbp, 0, 64}, Rax, "488b4500"},                         // mov 0(%rbp),%rax
+	{Indirect{Rbp, 8, 64}, Rax, "488b4508"},                         // mov 8(%rbp),%rax
+	{Indirect{Rbp, -128, 64}, Rax, "488b4580"},                      // mov -128(%rbp),%rax
+	{Indirect{Rbp, 127, 64}, Rax, "488b457f"},                       // mov 127(%rbp),%rax
+	{Indirect{Rbp, 128, 64}, Rax, "488b8580000000"},                 // mov 128(%rbp),%rax
+	{Indirect{Rbp, -129, 64}, Rax, "488b857fffffff"},                // mov -129(%rbp),%rax
+	{Indirect{Rbp, 305419896, 64}, Rax, "488b8578563412"},           // mov 305419896(%rbp),%rax
+	{Indirect{R12, 0, 64}, Rax, "498b0424"},                         // mov 0(%r12),%rax
+	{Indirect{R12, 8, 64}, Rax, "498b442408"},                       // mov 8(%r12),%rax
+	{Indirect{R12, -128, 64}, Rax, "498b442480"},                    // mov -128(%r12),%rax
+	{Indirect{R12, 127, 64}, Rax, "498b44247f"},                     // mov 127(%r12),%rax
+	{Indirect{R12, 128, 64}, Rax, "498b842480000000"},               // mov 128(%r12),%rax
+	{Indirect{R12, -129, 64}, Rax, "498b84247fffffff"},              // mov -129(%r12),%rax
+	{Indirect{R12, 305419896, 64}, Rax, "498b842478563412"},         // mov 305419896(%r12),%rax
+	{Indirect{R13, 0, 64}, Rax, "498b4500"},                         // mov 0(%r13),%rax
+	{Indirect{R13, 8, 64}, Rax, "498b4508"},                         // mov 8(%r13),%rax
+	{Indirect{R13, -128, 64}, Rax, "498b4580"},                      // mov -128(%r13),%rax
+	{Indirect{R13, 127, 64}, Rax, "498b457f"},                       // mov 127(%r13),%rax
+	{Indirect{R13, 128, 64}, Rax, "498b8580000000"},                 // mov 128(%r13),%rax
+	{Indirect{R13, -129, 64}, Rax, "498b857fffffff"},                // mov -129(%r13),%rax
+	{Indirect{R13, 305419896, 64}, Rax, "498b8578563412"},           // mov 305419896(%r13),%rax
+	{Indirect{R15, 0, 64}, Rax, "498b07"},                           // mov 0(%r15),%rax
+	{Indirect{R15, 8, 64}, Rax, "498b4708"},                         // mov 8(%r15),%rax
+	{Indirect{R15, -128, 64}, Rax, "498b4780"},                      // mov -128(%r15),%rax
+	{Indirect{R15, 127, 64}, Rax, "498b477f"},                       // mov 127(%r15),%rax
+	{Indirect{R15, 128, 64}, Rax, "498b8780000000"},                 // mov 128(%r15),%rax
+	{Indirect{R15, -129, 64}, Rax, "498b877fffffff"},                // mov -129(%r15),%rax
+	{Indirect{R15, 305419896, 64}, Rax, "498b8778563412"},           // mov 305419896(%r15),%rax
+	{Indirect{Rax, 0, 64}, R9, "4c8b08"},                            // mov 0(%rax),%r9
+	{Indirect{Rax, 8, 64}, R9, "4c8b4808"},                          // mov 8(%rax),%r9
+	{Indirect{Rax, -128, 64}, R9, "4c8b4880"},                       // mov -128(%rax),%r9
+	{Indirect{Rax, 127, 64}, R9, "4c8b487f"},                        // mov 127(%rax),%r9
+	{Indirect{Rax, 128, 64}, R9, "4c8b8880000000"},                  // mov 128(%rax),%r9
+	{Indirect{Rax, -129, 64}, R9, "4c8b887fffffff"},                 // mov -129(%rax),%r9
+	{Indirect{Rax, 305419896, 64}, R9, "4c8b8878563412"},            // mov 305419896(%rax),%r9
+	{Indirect{Rsp, 0, 64}, R9, "4c8b0c24"},                          // mov 0(%rsp),%r9
+	{Indirect{Rsp, 8, 64}, R9, "4c8b4c2408"},                        // mov 8(%rsp),%r9
+	{Indirect{Rsp, -128, 64}, R9, "4c8b4c2480"},                     // mov -128(%rsp),%r9
+	{Indirect{Rsp, 127, 64}, R9, "4c8b4c247f"},                      // mov 127(%rsp),%r9
+	{Indirect{Rsp, 128, 64}, R9, "4c8b8c2480000000"},                // mov 128(%rsp),%r9
+	{Indirect{Rsp, -129, 64}, R9, "4c8b8c247fffffff"},               // mov -129(%rsp),%r9
+	{Indirect{Rsp, 305419896, 64}, R9, "4c8b8c2478563412"},          // mov 305419896(%rsp),%r9
+	{Indirect{Rbp, 0, 64}, R9, "4c8b4d00"},                          // mov 0(%rbp),%r9
+	{Indirect{Rbp, 8, 64}, R9, "4c8b4d08"},                          // mov 8(%rbp),%r9
+	{Indirect{Rbp, -128, 64}, R9, "4c8b4d80"},                       // mov -128(%rbp),%r9
+	{Indirect{Rbp, 127, 64}, R9, "4c8b4d7f"},                        // mov 127(%rbp),%r9
+	{Indirect{Rbp, 128, 64}, R9, "4c8b8d80000000"},                  // mov 128(%rbp),%r9
+	{Indirect{Rbp, -129, 64}, R9, "4c8b8d7fffffff"},                 // mov -129(%rbp),%r9
+	{Indirect{Rbp, 305419896, 64}, R9, "4c8b8d78563412"},            // mov 305419896(%rbp),%r9
+	{Indirect{R12, 0, 64}, R9, "4d8b0c24"},                          // mov 0(%r12),%r9
+	{Indirect{R12, 8, 64}, R9, "4d8b4c2408"},                        // mov 8(%r12),%r9
+	{Indirect{R12, -128, 64}, R9, "4d8b4c2480"},                     // mov -128(%r12),%r9
+	{Indirect{R12, 127, 64}, R9, "4d8b4c247f"},                      // mov 127(%r12),%r9
+	{Indirect{R12, 128, 64}, R9, "4d8b8c2480000000"},                // mov 128(%r12),%r9
+	{Indirect{R12, -129, 64}, R9, "4d8b8c247fffffff"},               // mov -129(%r12),%r9
+	{Indirect{R12, 305419896, 64}, R9, "4d8b8c2478563412"},          // mov 305419896(%r12),%r9
+	{Indirect{R13, 0, 64}, R9, "4d8b4d00"},                          // mov 0(%r13),%r9
+	{Indirect{R13, 8, 64}, R9, "4d8b4d08"},                          // mov 8(%r13),%r9
+	{Indirect{R13, -128, 64}, R9, "4d8b4d80"},                       // mov -128(%r13),%r9
+	{Indirect{R13, 127, 64}, R9, "4d8b4d7f"},                        // mov 127(%r13),%r9
+	{Indirect{R13, 128, 64}, R9, "4d8b8d80000000"},                  // mov 128(%r13),%r9
+	{Indirect{R13, -129, 64}, R9, "4d8b8d7fffffff"},                 // mov -129(%r13),%r9
+	{Indirect{R13, 305419896, 64}, R9, "4d8b8d78563412"},            // mov 305419896(%r13),%r9
+	{Indirect{R15, 0, 64}, R9, "4d8b0f"},                            // mov 0(%r15),%r9
+	{Indirect{R15, 8, 64}, R9, "4d8b4f08"},                          // mov 8(%r15),%r9
+	{Indirect{R15, -128, 64}, R9, "4d8b4f80"},                       // mov -128(%r15),%r9
+	{Indirect{R15, 127, 64}, R9, "4d8b4f7f"},                        // mov 127(%r15),%r9
+	{Indirect{R15, 128, 64}, R9, "4d8b8f80000000"},                  // mov 128(%r15),%r9
+	{Indirect{R15, -129, 64}, R9, "4d8b8f7fffffff"},                 // mov -129(%r15),%r9
+	{Indirect{R15, 305419896, 64}, R9, "4d8b8f78563412"},            // mov 305419896(%r15),%r9
+	{SIB{0, Rax, Rcx, Scale1}, Rdx, "488b1408"},                     // mov 0(%rax,%rcx,1),%rdx
+	{SIB{-8, Rax, Rcx, Scale1}, Rdx, "488b5408f8"},                  // mov -8(%rax,%rcx,1),%rdx
+	{SIB{4096, Rax, Rcx, Scale1}, Rdx, "488b940800100000"},          // mov 4096(%rax,%rcx,1),%rdx
+	{SIB{0, Rax, Rcx, Scale8}, Rdx, "488b14c8"},                     // mov 0(%rax,%rcx,8),%rdx
+	{SIB{-8, Rax, Rcx, Scale8}, Rdx, "488b54c8f8"},                  // mov -8(%rax,%rcx,8),%rdx
+	{SIB{4096, Rax, Rcx, Scale8}, Rdx, "488b94c800100000"},          // mov 4096(%rax,%rcx,8),%rdx
+	{SIB{0, Rbp, Rcx, Scale1}, Rdx, "488b540d00"},                   // mov 0(%rbp,%rcx,1),%rdx
+	{SIB{-8, Rbp, Rcx, Scale1}, Rdx, "488b540df8"},                  // mov -8(%rbp,%rcx,1),%rdx
+	{SIB{4096, Rbp, Rcx, Scale1}, Rdx, "488b940d00100000"},          // mov 4096(%rbp,%rcx,1),%rdx
+	{SIB{0, Rbp, Rcx, Scale8}, Rdx, "488b54cd00"},                   // mov 0(%rbp,%rcx,8),%rdx
+	{SIB{-8, Rbp, Rcx, Scale8}, Rdx, "488b54cdf8"},                  // mov -8(%rbp,%rcx,8),%rdx
+	{SIB{4096, Rbp, Rcx, Scale8}, Rdx, "488b94cd00100000"},          // mov 4096(%rbp,%rcx,8),%rdx
+	{SIB{0, R13, R12, Scale1}, Rdx, "4b8b542500"},                   // mov 0(%r13,%r12,1),%rdx
+	{SIB{-8, R13, R12, Scale1}, Rdx, "4b8b5425f8"},                  // mov -8(%r13,%r12,1),%rdx
+	{SIB{4096, R13, R12, Scale1}, Rdx, "4b8b942500100000"},          // mov 4096(%r13,%r12,1),%rdx
+	{SIB{0, R13, R12, Scale8}, Rdx, "4b8b54e500"},                   // mov 0(%r13,%r12,8),%rdx
+	{SIB{-8, R13, R12, Scale8}, Rdx, "4b8b54e5f8"},                  // mov -8(%r13,%r12,8),%rdx
+	{SIB{4096, R13, R12, Scale8}, Rdx, "4b8b94e500100000"},          // mov 4096(%r13,%r12,8),%rdx
+	{SIB{0, Rsp, R15, Scale1}, Rdx, "4a8b143c"},                     // mov 0(%rsp,%r15,1),%rdx
+	{SIB{-8, Rsp, R15, Scale1}, Rdx, "4a8b543cf8"},                  // mov -8(%rsp,%r15,1),%rdx
+	{SIB{4096, Rsp, R15, Scale1}, Rdx, "4a8b943c00100000"},          // mov 4096(%rsp,%r15,1),%rdx
+	{SIB{0, Rsp, R15, Scale8}, Rdx, "4a8b14fc"},                     // mov 0(%rsp,%r15,8),%rdx
+	{SIB{-8, Rsp, R15, Scale8}, Rdx, "4a8b54fcf8"},                  // mov -8(%rsp,%r15,8),%rdx
+	{SIB{4096, Rsp, R15, Scale8}, Rdx, "4a8b94fc00100000"},          // mov 4096(%rsp,%r15,8),%rdx
+	{SIB{0, R12, Rax, Scale1}, Rdx, "498b1404"},                     // mov 0(%r12,%rax,1),%rdx
+	{SIB{-8, R12, Rax, Scale1}, Rdx, "498b5404f8"},                  // mov -8(%r12,%rax,1),%rdx
+	{SIB{4096, R12, Rax, Scale1}, Rdx, "498b940400100000"},          // mov 4096(%r12,%rax,1),%rdx
+	{SIB{0, R12, Rax, Scale8}, Rdx, "498b14c4"},                     // mov 0(%r12,%rax,8),%rdx
+	{SIB{-8, R12, Rax, Scale8}, Rdx, "498b54c4f8"},                  // mov -8(%r12,%rax,8),%rdx
+	{SIB{4096, R12, Rax, Scale8}, Rdx, "498b94c400100000"},          // mov 4096(%r12,%rax,8),%rdx
+	{SIB{0, Register{}, Rcx, Scale8}, Rdx, "488b14cd00000000"},      // mov 0(,%rcx,8),%rdx
+	{SIB{256, Register{}, Rcx, Scale8}, Rdx, "488b14cd00010000"},    // mov 256(,%rcx,8),%rdx
+	{SIB{-4, Register{}, Rcx, Scale8}, Rdx, "488b14cdfcffffff"},     // mov -4(,%rcx,8),%rdx
+	{SIB{0, Register{}, R12, Scale4}, Rdx, "4a8b14a500000000"},      // mov 0(,%r12,4),%rdx
+	{SIB{256, Register{}, R12, Scale4}, Rdx, "4a8b14a500010000"},    // mov 256(,%r12,4),%rdx
+	{SIB{-4, Register{}, R12, Scale4}, Rdx, "4a8b14a5fcffffff"},     // mov -4(,%r12,4),%rdx
+	{SIB{0, Register{}, Rax, Scale1}, Rdx, "488b140500000000"},      // mov 0(,%rax,1),%rdx
+	{SIB{256, Register{}, Rax, Scale1}, Rdx, "488b140500010000"},    // mov 256(,%rax,1),%rdx
+	{SIB{-4, Register{}, Rax, Scale1}, Rdx, "488b1405fcffffff"},     // mov -4(,%rax,1),%rdx
+	{SIB{16, Rax, Rsp, Scale1}, Rdx, "488b5010"},                    // mov 16(%rax),%rdx
+	{SIB{16, Rbp, Rsp, Scale1}, Rdx, "488b5510"},                    // mov 16(%rbp),%rdx
+	{SIB{16, R12, Rsp, Scale1}, Rdx, "498b542410"},                  // mov 16(%r12),%rdx
+	{SIB{0x1000, Register{}, Rsp, Scale1}, Rdx, "488b142500100000"}, // mov 0x1000,%rdx
+	{SIB{0, Rax, Rcx, Scale1}, R10, "4c8b1408"},                     // mov 0(%rax,%rcx,1),%r10
+	{SIB{-8, Rax, Rcx, Scale1}, R10, "4c8b5408f8"},                  // mov -8(%rax,%rcx,1),%r10
+	{SIB{4096, Rax, Rcx, Scale1}, R10, "4c8b940800100000"},          // mov 4096(%rax,%rcx,1),%r10
+	{SIB{0, Rax, Rcx, Scale8}, R10, "4c8b14c8"},                     // mov 0(%rax,%rcx,8),%r10
+	{SIB{-8, Rax, Rcx, Scale8}, R10, "4c8b54c8f8"},                  // mov -8(%rax,%rcx,8),%r10
+	{SIB{4096, Rax, Rcx, Scale8}, R10, "4c8b94c800100000"},          // mov 4096(%rax,%rcx,8),%r10
+	{SIB{0, Rbp, Rcx, Scale1}, R10, "4c8b540d00"},                   // mov 0(%rbp,%rcx,1),%r10
+	{SIB{-8, Rbp, Rcx, Scale1}, R10, "4c8b540df8"},                  // mov -8(%rbp,%rcx,1),%r10
+	{SIB{4096, Rbp, Rcx, Scale1}, R10, "4c8b940d00100000"},          // mov 4096(%rbp,%rcx,1),%r10
+	{SIB{0, Rbp, Rcx, Scale8}, R10, "4c8b54cd00"},                   // mov 0(%rbp,%rcx,8),%r10
+	{SIB{-8, Rbp, Rcx, Scale8}, R10, "4c8b54cdf8"},                  // mov -8(%rbp,%rcx,8),%r10
+	{SIB{4096, Rbp, Rcx, Scale8}, R10, "4c8b94cd00100000"},          // mov 4096(%rbp,%rcx,8),%r10
+	{SIB{0, R13, R12, Scale1}, R10, "4f8b542500"},                   // mov 0(%r13,%r12,1),%r10
+	{SIB{-8, R13, R12, Scale1}, R10, "4f8b5425f8"},                  // mov -8(%r13,%r12,1),%r10
+	{SIB{4096, R13, R12, Scale1}, R10, "4f8b942500100000"},          // mov 4096(%r13,%r12,1),%r10
+	{SIB{0, R13, R12, Scale8}, R10, "4f8b54e500"},                   // mov 0(%r13,%r12,8),%r10
+	{SIB{-8, R13, R12, Scale8}, R10, "4f8b54e5f8"},                  // mov -8(%r13,%r12,8),%r10
+	{SIB{4096, R13, R12, Scale8}, R10, "4f8b94e500100000"},          // mov 4096(%r13,%r12,8),%r10
+	{SIB{0, Rsp, R15, Scale1}, R10, "4e8b143c"},                     // mov 0(%rsp,%r15,1),%r10
+	{SIB{-8, Rsp, R15, Scale1}, R10, "4e8b543cf8"},                  // mov -8(%rsp,%r15,1),%r10
+	{SIB{4096, Rsp, R15, Scale1}, R10, "4e8b943c00100000"},          // mov 4096(%rsp,%r15,1),%r10
+	{SIB{0, Rsp, R15, Scale8}, R10, "4e8b14fc"},                     // mov 0(%rsp,%r15,8),%r10
+	{SIB{-8, Rsp, R15, Scale8}, R10, "4e8b54fcf8"},                  // mov -8(%rsp,%r15,8),%r10
+	{SIB{4096, Rsp, R15, Scale8}, R10, "4e8b94fc00100000"},          // mov 4096(%rsp,%r15,8),%r10
+	{SIB{0, R12, Rax, Scale1}, R10, "4d8b1404"},                     // mov 0(%r12,%rax,1),%r10
+	{SIB{-8, R12, Rax, Scale1}, R10, "4d8b5404f8"},                  // mov -8(%r12,%rax,1),%r10
+	{SIB{4096, R12, Rax, Scale1}, R10, "4d8b940400100000"},          // mov 4096(%r12,%rax,1),%r10
+	{SIB{0, R12, Rax, Scale8}, R10, "4d8b14c4"},                     // mov 0(%r12,%rax,8),%r10
+	{SIB{-8, R12, Rax, Scale8}, R10, "4d8b54c4f8"},                  // mov -8(%r12,%rax,8),%r10
+	{SIB{4096, R12, Rax, Scale8}, R10, "4d8b94c400100000"},          // mov 4096(%r12,%rax,8),%r10
+	{SIB{0, Register{}, Rcx, Scale8}, R10, "4c8b14cd00000000"},      // mov 0(,%rcx,8),%r10
+	{SIB{256, Register{}, Rcx, Scale8}, R10, "4c8b14cd00010000"},    // mov 256(,%rcx,8),%r10
+	{SIB{-4, Register{}, Rcx, Scale8}, R10, "4c8b14cdfcffffff"},     // mov -4(,%rcx,8),%r10
+	{SIB{0, Register{}, R12, Scale4}, R10, "4e8b14a500000000"},      // mov 0(,%r12,4),%r10
+	{SIB{256, Register{}, R12, Scale4}, R10, "4e8b14a500010000"},    // mov 256(,%r12,4),%r10
+	{SIB{-4, Register{}, R12, Scale4}, R10, "4e8b14a5fcffffff"},     // mov -4(,%r12,4),%r10
+	{SIB{0, Register{}, Rax, Scale1}, R10, "4c8b140500000000"},      // mov 0(,%rax,1),%r10
+	{SIB{256, Register{}, Rax, Scale1}, R10, "4c8b140500010000"},    // mov 256(,%rax,1),%r10
+	{SIB{-4, Register{}, Rax, Scale1}, R10, "4c8b1405fcffffff"},     // mov -4(,%rax,1),%r10
+	{SIB{16, Rax, Rsp, Scale1}, R10, "4c8b5010"},                    // mov 16(%rax),%r10
+	{SIB{16, Rbp, Rsp, Scale1}, R10, "4c8b5510"},                    // mov 16(%rbp),%r10
+	{SIB{16, R12, Rsp, Scale1}, R10, "4d8b542410"},                  // mov 16(%r12),%r10
+	{SIB{0x1000, Register{}, Rsp, Scale1}, R10, "4c8b142500100000"}, // mov 0x1000,%r10
+}
+
+func TestMemOperands(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	for _, tc := range memOperandTests {
+		asm.Off = 0
+		asm.Mov(tc.mem, tc.reg)
+		if got := hex.EncodeToString(asm.Buf[:asm.Off]); got != tc.expect {
+			t.Errorf("Mov(%#v, %#v): got %s, expected %s", tc.mem, tc.reg, got, tc.expect)
+		}
+	}
+}
+
+func TestRIPRelative(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	// mov 0x100(%rip), %r9, relative to the end of the instruction
+	asm.Mov(PCRel{gojit.Addr(asm.Buf) + 0x100 + 7}, R9)
+	if got := hex.EncodeToString(asm.Buf[:3]); got != "4c8b0d" {
+		t.Errorf("PCRel: got %s, expected 4c8b0d", got)
+	}
+	if disp := binary.LittleEndian.Uint32(asm.Buf[3:]); disp != 0x100 {
+		t.Errorf("PCRel: displacement %#x, expected 0x100", disp)
+	}
+
+	var l Label
+	asm.Off = 0
+	asm.Mov(LabelRel{&l}, Rax)
+	asm.Bind(&l)
+	if got := hex.EncodeToString(asm.Buf[:asm.Off]); got != "488b0500000000" {
+		t.Errorf("LabelRel: got %s, expected 488b0500000000", got)
+	}
+}
@@ -0,0 +1,61 @@
+package amd64
+
+import (
+	"fmt"
+
+	"github.com/nelhage/gojit"
+)
+
+// alignField pads with nops so that an n-byte field which follows
+// prefix bytes of opcode lands on an n-byte boundary in memory.
+func (a *Assembler) alignField(prefix, n int) {
+	a.Nop(int(-(a.addr(a.Off) + uintptr(prefix)) & uintptr(n-1)))
+}
+
+// PatchableCallRel assembles a call to dst whose target can later be
+// changed with PatchRel32, and binds l to its rel32 field, which it
+// aligns so that the change is atomic. The call is direct even in
+// PIC mode.
+func (a *Assembler) PatchableCallRel(l *Label, dst uintptr) {
+	a.alignField(1, 4)
+	a.byte(0xe8)
+	a.Bind(l)
+	a.branch32(dst)
+}
+
+// PatchableJmpRel is like PatchableCallRel, for a jmp.
+func (a *Assembler) PatchableJmpRel(l *Label, dst uintptr) {
+	a.alignField(1, 4)
+	a.byte(0xe9)
+	a.Bind(l)
+	a.branch32(dst)
+}
+
+// PatchableMovAbs assembles a MovAbs of v to dst, and binds l to its
+// 64-bit immediate, which it aligns so that it can be changed
+// atomically with PatchImm64.
+func (a *Assembler) PatchableMovAbs(l *Label, v uint64, dst Register) {
+	a.alignField(2, 8)
+	a.rex(true, false, false, dst.Val > 7)
+	a.byte(InstMov.imm_r.value() | (dst.Val & 7))
+	a.Bind(l)
+	a.int64(v)
+}
+
+// PatchRel32 atomically retargets the call or jmp assembled by
+// PatchableCallRel or PatchableJmpRel at l to dst, which is safe to
+// do while other goroutines run the code. See gojit.PatchUint32.
+func (a *Assembler) PatchRel32(l *Label, dst uintptr) error {
+	off := l.Off()
+	disp := dst - a.addr(off+4)
+	if uintptr(int32(disp)) != disp {
+		return fmt.Errorf("PatchRel32: target %#x out of range", dst)
+	}
+	return gojit.PatchUint32(a.Buf, off, uint32(disp))
+}
+
+// PatchImm64 atomically replaces the immediate of the MovAbs
+// assembled by PatchableMovAbs at l with v. See gojit.PatchUint64.
+func (a *Assembler) PatchImm64(l *Label, v uint64) error {
+	return gojit.PatchUint64(a.Buf, l.Off(), v)
+}
@@ -0,0 +1,140 @@
+package amd64
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+// constFunc assembles a function returning v into its own buffer.
+func constFunc(t *testing.T, v int64) *Assembler {
+	asm := newAsm(t)
+	asm.Mov(Imm{v}, Rax)
+	asm.Ret()
+	return asm
+}
+
+// patchable assembles f() = callee(), with the call patchable at
+// site.
+func patchable(t *testing.T, site *Label, callee []byte) (*Assembler, func() uintptr) {
+	asm := newAsm(t)
+	asm.Push(Rdi)
+	asm.PatchableCallRel(site, gojit.Addr(callee))
+	asm.Pop(Rdi)
+	asm.Mov(Rax, Indirect{Rdi, 0, 64})
+	asm.Ret()
+
+	var f func() uintptr
+	asm.BuildTo(&f)
+	if (gojit.Addr(asm.Buf)+uintptr(site.Off()))%4 != 0 {
+		t.Fatalf("patch site at +%d not aligned", site.Off())
+	}
+	return asm, f
+}
+
+func TestPatchRel32(t *testing.T) {
+	one, two := constFunc(t, 1), constFunc(t, 2)
+	defer gojit.Release(one.Buf)
+	defer gojit.Release(two.Buf)
+
+	var site Label
+	asm, f := patchable(t, &site, one.Buf)
+	defer gojit.Release(asm.Buf)
+	if got := f(); got != 1 {
+		t.Fatalf("f() = %d before patching", got)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			if got := f(); got != 1 && got != 2 {
+				t.Errorf("f() = %d while patching", got)
+				return
+			}
+		}
+	}()
+	for i := 0; i < 1000; i++ {
+		target := one
+		if i%2 == 0 {
+			target = two
+		}
+		if e := asm.PatchRel32(&site, gojit.Addr(target.Buf)); e != nil {
+			t.Fatalf("PatchRel32: %s", e.Error())
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := f(); got != 1 {
+		t.Errorf("f() = %d after patching back", got)
+	}
+}
+
+func TestPatchImm64(t *testing.T) {
+	asm := newAsm(t)
+	defer gojit.Release(asm.Buf)
+
+	var site Label
+	asm.Push(Rdi)
+	asm.PatchableMovAbs(&site, 1, Rax)
+	asm.Pop(Rdi)
+	asm.Mov(Rax, Indirect{Rdi, 0, 64})
+	asm.Ret()
+	var f func() uint64
+	asm.BuildTo(&f)
+
+	if (gojit.Addr(asm.Buf)+uintptr(site.Off()))%8 != 0 {
+		t.Fatalf("patch site at +%d not aligned", site.Off())
+	}
+	if got := f(); got != 1 {
+		t.Fatalf("f() = %d before patching", got)
+	}
+	if e := asm.PatchImm64(&site, 1<<50); e != nil {
+		t.Fatalf("PatchImm64: %s", e.Error())
+	}
+	if got := f(); got != 1<<50 {
+		t.Errorf("f() = %d after patching", got)
+	}
+}
+
+func TestPatchSealed(t *testing.T) {
+	one, two := constFunc(t, 1), constFunc(t, 2)
+	defer gojit.Release(one.Buf)
+	defer gojit.Release(two.Buf)
+
+	var site Label
+	asm, f := patchable(t, &site, one.Buf)
+	defer gojit.Release(asm.Buf)
+	if e := gojit.Seal(asm.Buf); e != nil {
+		t.Fatalf("Seal: %s", e.Error())
+	}
+	if e := asm.PatchRel32(&site, gojit.Addr(two.Buf)); e != nil {
+		t.Fatalf("PatchRel32: %s", e.Error())
+	}
+	if got := f(); got != 2 {
+		t.Errorf("f() = %d after patching", got)
+	}
+}
+
+func TestPatchMisaligned(t *testing.T) {
+	buf, e := gojit.Alloc(gojit.PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer gojit.Release(buf)
+	if gojit.PatchUint32(buf, 2, 0) == nil {
+		t.Error("misaligned PatchUint32 succeeded")
+	}
+	if gojit.PatchUint64(buf, 4, 0) == nil {
+		t.Error("misaligned PatchUint64 succeeded")
+	}
+}
@@ -0,0 +1,95 @@
+package amd64
+
+import "github.com/nelhage/gojit"
+
+// LabelRel is a %rip-relative memory operand addressing a Label.
+type LabelRel struct {
+	Label *Label
+}
+
+func (l LabelRel) isOperand() {}
+func (l LabelRel) Rex(asm *Assembler, reg Register) {
+	asm.rex(reg.Bits == 64, reg.Val > 7, false, false)
+}
+func (l LabelRel) ModRM(asm *Assembler, reg Register) {
+	asm.modrm(MOD_INDIR, reg.Val&7, REG_DISP32)
+	asm.label32(l.Label)
+}
+
+type poolEntry struct {
+	label Label
+	val   uint64
+	// imp is set for slots holding process-specific addresses,
+	// which Artifact records as imports, and WriteObject
+	// relocates if they are external symbols.
+	imp *gojit.Import
+}
+
+// Const returns a %rip-relative operand addressing a 64-bit slot
+// holding v in the current function's constant pool. The pool is
+// emitted after the function's code, by the next call to Func or by
+// BuildTo, so the operand may only be used in the current function.
+func (a *Assembler) Const(v uint64) Operand {
+	return a.constant(v, nil)
+}
+
+func (a *Assembler) constant(v uint64, imp *gojit.Import) Operand {
+	for _, e := range a.pool {
+		if e.val == v && (e.imp == nil) == (imp == nil) &&
+			(imp == nil || e.imp.Kind == imp.Kind) {
+			return LabelRel{&e.label}
+		}
+	}
+	e := &poolEntry{val: v, imp: imp}
+	a.pool = append(a.pool, e)
+	return LabelRel{&e.label}
+}
+
+// externalConst returns a pool operand holding the address of the
+// external symbol at addr.
+func (a *Assembler) externalConst(addr uintptr) Operand {
+	return a.constant(uint64(addr), &gojit.Import{Kind: gojit.ImportSymbol})
+}
+
+// loadAddr loads the address addr, described by imp, into dst, from
+// the constant pool if a.PIC is set.
+func (a *Assembler) loadAddr(addr uintptr, imp gojit.Import, dst Register) {
+	if a.PIC {
+		a.Mov(a.constant(uint64(addr), &imp), dst)
+	} else {
+		a.MovAbs(uint64(addr), dst)
+	}
+}
+
+// external reports whether addr lies outside Buf, so that a rel32
+// reference to it would not survive moving the code.
+func (a *Assembler) external(addr uintptr) bool {
+	base := a.addr(0)
+	return addr < base || addr >= base+uintptr(len(a.Buf))
+}
+
+func (a *Assembler) flushPool() {
+	if len(a.pool) == 0 {
+		return
+	}
+	start := a.Off
+	for a.addr(a.Off)%8 != 0 {
+		a.Int3()
+	}
+	a.span(spanPadding, start)
+	start = a.Off
+	defer a.span(spanData, start)
+	for _, e := range a.pool {
+		a.Bind(&e.label)
+		if e.imp != nil {
+			imp := *e.imp
+			imp.Off = a.Off
+			a.imports = append(a.imports, imp)
+			if imp.Kind == gojit.ImportSymbol {
+				a.relocs = append(a.relocs, reloc{off: a.Off, typ: relAbs64, addr: uintptr(e.val)})
+			}
+		}
+		a.int64(e.val)
+	}
+	a.pool = nil
+}
@@ -0,0 +1,88 @@
+package amd64
+
+import (
+	"testing"
+
+	"github.com/nelhage/gojit"
+)
+
+func TestPIC(t *testing.T) {
+	for _, abi := range abis {
+		// double(x) = 2*x, in a buffer of its own
+		helper := newAsmABI(t, abi)
+		defer gojit.Release(helper.Buf)
+		helper.Mov(Rdi, Rax)
+		helper.Add(Rdi, Rax)
+		helper.Ret()
+
+		asm := newAsmABI(t, abi)
+		asm.PIC = true
+		defer gojit.Release(asm.Buf)
+
+		// f(x) = double(x) + 1<<40, calling a Go func on the way
+		called := 0
+		asm.Push(Rdi)
+		asm.CallFunc(func() { called++ })
+		asm.Pop(Rdi)
+		asm.Push(Rdi)
+		asm.Mov(Indirect{Rdi, 0, 64}, Rdi)
+		asm.CallRel(gojit.Addr(helper.Buf))
+		asm.Pop(Rdi)
+		asm.Mov(asm.Const(1<<40), Rcx)
+		asm.Add(Rcx, Rax)
+		asm.Mov(Rax, Indirect{Rdi, 8, 64})
+		asm.Ret()
+
+		var f func(uintptr) uintptr
+		asm.BuildTo(&f)
+		if got := f(21); got != 42+1<<40 || called != 1 {
+			t.Errorf("[abi=%d] f(21) = %d, called %d times", abi, got, called)
+		}
+
+		moved, e := gojit.Alloc(gojit.PageSize)
+		if e != nil {
+			t.Fatalf("Alloc: %s", e.Error())
+		}
+		defer gojit.Release(moved)
+		copy(moved, asm.Buf[:asm.Off])
+		for i := 0; i < asm.Off; i++ {
+			asm.Buf[i] = 0xcc
+		}
+
+		var g func(uintptr) uintptr
+		if abi == GoABI {
+			gojit.BuildTo(moved, &g)
+		} else {
+			gojit.BuildToCgo(moved, &g)
+		}
+		if got := g(4); got != 8+1<<40 || called != 2 {
+			t.Errorf("[abi=%d] moved f(4) = %d, called %d times", abi, got, called)
+		}
+	}
+}
+
+func TestPICJcc(t *testing.T) {
+	// seven() stores 7 to the caller's result slot, at 8(%rsi)
+	helper := newAsm(t)
+	defer gojit.Release(helper.Buf)
+	helper.Mov(Imm{7}, Indirect{Rsi, 8, 64})
+	helper.Ret()
+
+	asm := newAsm(t)
+	asm.PIC = true
+	defer gojit.Release(asm.Buf)
+
+	// f(x) = x == 0 ? seven() : 0, by way of a tail jump
+	begin(asm)
+	asm.Xor(Rax, Rax)
+	asm.Test(Rdi, Rdi)
+	asm.JccRel(CC_Z, gojit.Addr(helper.Buf))
+	f := finish(asm)
+
+	if got := f(5); got != 0 {
+		t.Errorf("f(5) = %d, expected 0", got)
+	}
+	if got := f(0); got != 7 {
+		t.Errorf("f(0) = %d, expected 7", got)
+	}
+}
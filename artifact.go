@@ -0,0 +1,270 @@
+package gojit
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"runtime"
+)
+
+// An Artifact is a finished, position-independent function in a form
+// that can be saved, for example to an on-disk cache, and loaded into
+// another process with Load. amd64.Assembler.Artifact produces them.
+type Artifact struct {
+	// Key identifies what the code was compiled from, such as a
+	// hash of a program's source and compiler options. Load
+	// rejects an Artifact whose Key is not the one expected.
+	Key string
+	// Cgo is set if the code is to be run with BuildToCgo, rather
+	// than BuildTo.
+	Cgo     bool
+	Code    []byte
+	Imports []Import
+}
+
+// An ImportKind says what an Import refers to.
+type ImportKind int
+
+const (
+	// ImportCallback is the handle (see RegisterCallback) of
+	// the Index'th callback passed to Load.
+	ImportCallback ImportKind = iota
+	// ImportGoCallback is the address GoCallbackAddr returns.
+	ImportGoCallback
+	// ImportCgoCallback is the address CgoCallbackAddr returns.
+	ImportCgoCallback
+	// ImportSymbol is the address of the symbol Name, as passed
+	// to Load.
+	ImportSymbol
+)
+
+// An Import is a 64-bit slot in an Artifact's code which holds a
+// process-specific address, and is filled in by Load.
+type Import struct {
+	Off  int
+	Kind ImportKind
+	// Index is the index of the callback for ImportCallback.
+	Index int
+	// Name is the symbol name for ImportSymbol, or the type of
+	// the callback for ImportCallback.
+	Name string
+}
+
+// Imports supplies the values of an Artifact's imports to Load.
+type Imports struct {
+	Callbacks []interface{}
+	Symbols   map[string]uintptr
+}
+
+// ErrStale is returned by Load for an Artifact written by a
+// different version of gojit, built with a different Go toolchain or
+// for a different GOARCH, or with a different Key.
+var ErrStale = errors.New("gojit: stale artifact")
+
+var artifactMagic = []byte("gojit-artifact\x00")
+
+// artifactVersion must be incremented whenever the encoding, or the
+// way code is generated or linked, changes incompatibly.
+const artifactVersion = 2
+
+// artifactBuild identifies the Go toolchain and architecture, since
+// the code calls into the runtime and follows its ABI.
+var artifactBuild = runtime.Version() + " " + runtime.GOARCH
+
+// MarshalBinary encodes a. The encoding starts with a version number
+// and a SHA-256 hash of its contents, which Load checks. The hashed
+// contents start with the Go version and GOARCH.
+func (a *Artifact) MarshalBinary() ([]byte, error) {
+	var body bytes.Buffer
+	putString(&body, artifactBuild)
+	putString(&body, a.Key)
+	if a.Cgo {
+		body.WriteByte(1)
+	} else {
+		body.WriteByte(0)
+	}
+	putString(&body, string(a.Code))
+	putUvarint(&body, uint64(len(a.Imports)))
+	for _, imp := range a.Imports {
+		if imp.Off < 0 || imp.Off+8 > len(a.Code) {
+			return nil, fmt.Errorf("gojit: import at %d outside of code", imp.Off)
+		}
+		putUvarint(&body, uint64(imp.Off))
+		putUvarint(&body, uint64(imp.Kind))
+		putUvarint(&body, uint64(imp.Index))
+		putString(&body, imp.Name)
+	}
+
+	var out bytes.Buffer
+	out.Write(artifactMagic)
+	binary.Write(&out, binary.LittleEndian, uint32(artifactVersion))
+	sum := sha256.Sum256(body.Bytes())
+	out.Write(sum[:])
+	out.Write(body.Bytes())
+	return out.Bytes(), nil
+}
+
+// UnmarshalArtifact decodes an Artifact encoded by MarshalBinary,
+// checking its version, content hash, Go version and GOARCH, and that
+// its Key is key.
+func UnmarshalArtifact(data []byte, key string) (*Artifact, error) {
+	if !bytes.HasPrefix(data, artifactMagic) {
+		return nil, errors.New("gojit: not an artifact")
+	}
+	data = data[len(artifactMagic):]
+	if len(data) < 4+sha256.Size {
+		return nil, errors.New("gojit: truncated artifact")
+	}
+	if binary.LittleEndian.Uint32(data) != artifactVersion {
+		return nil, ErrStale
+	}
+	data = data[4:]
+	sum, body := data[:sha256.Size], data[sha256.Size:]
+	if got := sha256.Sum256(body); !bytes.Equal(sum, got[:]) {
+		return nil, errors.New("gojit: corrupt artifact")
+	}
+
+	r := &reader{b: body}
+	if r.string() != artifactBuild {
+		return nil, ErrStale
+	}
+	a := &Artifact{Key: r.string()}
+	if a.Key != key {
+		return nil, ErrStale
+	}
+	a.Cgo = r.byte() != 0
+	a.Code = []byte(r.string())
+	n := r.uvarint()
+	for i := uint64(0); i < n && r.err == nil; i++ {
+		imp := Import{
+			Off:   int(r.uvarint()),
+			Kind:  ImportKind(r.uvarint()),
+			Index: int(r.uvarint()),
+			Name:  r.string(),
+		}
+		if imp.Off < 0 || imp.Off+8 > len(a.Code) {
+			return nil, fmt.Errorf("gojit: import at %d outside of code", imp.Off)
+		}
+		a.Imports = append(a.Imports, imp)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	return a, nil
+}
+
+// Load decodes an Artifact with UnmarshalArtifact, copies its code
+// into fresh executable memory, fills in its imports from imp, and
+// builds it into out as BuildTo or BuildToCgo would. Callbacks must
+// have the same types as those the code was compiled with. The
+// returned buffer holds the code, and should be passed to Release
+// when it is no longer needed.
+func Load(data []byte, key string, imp Imports, out interface{}) ([]byte, error) {
+	a, err := UnmarshalArtifact(data, key)
+	if err != nil {
+		return nil, err
+	}
+	size := (len(a.Code) + PageSize - 1) &^ (PageSize - 1)
+	if size == 0 {
+		size = PageSize
+	}
+	b, err := Alloc(size)
+	if err != nil {
+		return nil, err
+	}
+	copy(b, a.Code)
+
+	for _, i := range a.Imports {
+		var v uintptr
+		switch i.Kind {
+		case ImportCallback:
+			if i.Index >= len(imp.Callbacks) {
+				err = fmt.Errorf("gojit: missing callback %d", i.Index)
+				break
+			}
+			f := imp.Callbacks[i.Index]
+			if t := reflect.TypeOf(f); t == nil || t.String() != i.Name {
+				err = fmt.Errorf("gojit: callback %d has type %T, expected %s", i.Index, f, i.Name)
+				break
+			}
+			v = RegisterCallback(b, f)
+		case ImportGoCallback:
+			v = GoCallbackAddr()
+		case ImportCgoCallback:
+			v = CgoCallbackAddr()
+		case ImportSymbol:
+			var ok bool
+			if v, ok = imp.Symbols[i.Name]; !ok {
+				err = fmt.Errorf("gojit: undefined symbol %s", i.Name)
+			}
+		default:
+			err = fmt.Errorf("gojit: bad import kind %d", i.Kind)
+		}
+		if err != nil {
+			Release(b)
+			return nil, err
+		}
+		binary.LittleEndian.PutUint64(b[i.Off:], uint64(v))
+	}
+
+	if a.Cgo {
+		BuildToCgo(b, out)
+	} else {
+		BuildTo(b, out)
+	}
+	return b, nil
+}
+
+func putUvarint(w *bytes.Buffer, v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	w.Write(buf[:binary.PutUvarint(buf[:], v)])
+}
+
+func putString(w *bytes.Buffer, s string) {
+	putUvarint(w, uint64(len(s)))
+	w.WriteString(s)
+}
+
+type reader struct {
+	b   []byte
+	err error
+}
+
+var errTruncated = errors.New("gojit: truncated artifact")
+
+func (r *reader) uvarint() uint64 {
+	if r.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(r.b)
+	if n <= 0 {
+		r.err = errTruncated
+		return 0
+	}
+	r.b = r.b[n:]
+	return v
+}
+
+func (r *reader) byte() byte {
+	if r.err != nil || len(r.b) == 0 {
+		r.err = errTruncated
+		return 0
+	}
+	c := r.b[0]
+	r.b = r.b[1:]
+	return c
+}
+
+func (r *reader) string() string {
+	n := r.uvarint()
+	if r.err != nil || n > uint64(len(r.b)) {
+		r.err = errTruncated
+		return ""
+	}
+	s := string(r.b[:n])
+	r.b = r.b[n:]
+	return s
+}
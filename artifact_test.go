@@ -0,0 +1,55 @@
+package gojit
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestArtifactEncoding(t *testing.T) {
+	a := &Artifact{
+		Key:  "key",
+		Cgo:  true,
+		Code: []byte{0xc3, 0, 0, 0, 0, 0, 0, 0, 0},
+		Imports: []Import{
+			{Off: 1, Kind: ImportSymbol, Name: "sym"},
+		},
+	}
+	data, e := a.MarshalBinary()
+	if e != nil {
+		t.Fatalf("MarshalBinary: %s", e.Error())
+	}
+	got, e := UnmarshalArtifact(data, "key")
+	if e != nil {
+		t.Fatalf("UnmarshalArtifact: %s", e.Error())
+	}
+	if !reflect.DeepEqual(got, a) {
+		t.Errorf("round trip: got %+v, expected %+v", got, a)
+	}
+
+	old := append([]byte(nil), data...)
+	old[len(artifactMagic)]++
+	if _, e := UnmarshalArtifact(old, "key"); e != ErrStale {
+		t.Errorf("other version: %v, expected ErrStale", e)
+	}
+	if _, e := UnmarshalArtifact(data, "other"); e != ErrStale {
+		t.Errorf("other key: %v, expected ErrStale", e)
+	}
+	build := artifactBuild
+	artifactBuild = "go0.0 pdp11"
+	other, e := a.MarshalBinary()
+	artifactBuild = build
+	if e != nil {
+		t.Fatalf("MarshalBinary: %s", e.Error())
+	}
+	if _, e := UnmarshalArtifact(other, "key"); e != ErrStale {
+		t.Errorf("other toolchain: %v, expected ErrStale", e)
+	}
+	if _, e := UnmarshalArtifact(data[:len(data)-3], "key"); e == nil {
+		t.Error("truncated artifact accepted")
+	}
+
+	a.Imports[0].Off = 4
+	if _, e := a.MarshalBinary(); e == nil {
+		t.Error("import past the end of the code accepted")
+	}
+}
@@ -0,0 +1,148 @@
+package bf
+
+import (
+	"debug/elf"
+	"errors"
+	"io"
+
+	"github.com/nelhage/gojit"
+	"github.com/nelhage/gojit/amd64"
+	"github.com/nelhage/gojit/elfgen"
+)
+
+// Addresses at which WriteExecutable loads code and the tape.
+const (
+	aotText = 0x401000
+	aotTape = 0x10000000
+)
+
+// Linux system call numbers.
+const (
+	sysRead  = 0
+	sysWrite = 1
+	sysExit  = 60
+)
+
+// emitSyscall emits a system call of the given number on the cell at
+// %rax, which it preserves, with its result in %rcx.
+func emitSyscall(asm *amd64.Assembler, nr, fd int64) {
+	asm.Push(amd64.Rax)
+	asm.Mov(amd64.Rax, amd64.Rsi)
+	asm.Mov(amd64.Imm{fd}, amd64.Rdi)
+	asm.Mov(amd64.Imm{1}, amd64.Rdx)
+	asm.Mov(amd64.Imm{nr}, amd64.Rax)
+	asm.Syscall()
+	asm.Mov(amd64.Rax, amd64.Rcx)
+	asm.Pop(amd64.Rax)
+}
+
+func emitDotSyscall(asm *amd64.Assembler, cc *compiled) {
+	emitSyscall(asm, sysWrite, 1)
+	asm.Test(amd64.Rcx, amd64.Rcx)
+	asm.JccLabel(amd64.CC_LE, cc.stop)
+}
+
+func emitCommaSyscall(asm *amd64.Assembler, cc *compiled) {
+	emitSyscall(asm, sysRead, 0)
+	asm.Test(amd64.Rcx, amd64.Rcx)
+	asm.JccLabel(amd64.CC_S, cc.stop)
+	jcc(asm, amd64.CC_G, func(asm *amd64.Assembler) {
+		emitEOF(asm, cc)
+	})
+	if cw := cc.cells; cw.bytes > 1 {
+		// The read set only the low byte of the cell.
+		jcc(asm, amd64.CC_LE, func(asm *amd64.Assembler) {
+			asm.Xor(amd64.Ecx, amd64.Ecx)
+			asm.Movb(amd64.Indirect{amd64.Rax, 0, 8}, amd64.Cl)
+			asm.Arithmetic(cw.mov, cw.cx, cw.at(0))
+		})
+	}
+}
+
+// WriteExecutable compiles a brainfuck program ahead of time to a
+// static Linux amd64 ELF executable, which it writes to w. The
+// executable runs the program on a zeroed tape of tapeSize bytes,
+// using read(2) on standard input and write(2) on standard output to
+// implement `,' and `.', and exits with status 0 when the program
+// finishes, or 1 if a read or write fails.
+//
+// As with Compile, there is no bounds-checking on the tape; running
+// off the end of it kills the process with SIGSEGV. On EOF, `,'
+// clears the current cell.
+func WriteExecutable(w io.Writer, prog []byte, tapeSize int) error {
+	return WriteExecutableOptions(w, prog, tapeSize, Options{})
+}
+
+// WriteExecutableOptions is like WriteExecutable, but takes Options.
+// Only CellBits and EOF are supported; it is an error for opts to ask
+// for bounds checks, a tape other than TapeFixed, MaxSteps or a
+// Context.
+func WriteExecutableOptions(w io.Writer, prog []byte, tapeSize int, opts Options) error {
+	switch {
+	case opts.BoundsCheck:
+		return errors.New("bf: executables can't check bounds")
+	case opts.Tape != TapeFixed:
+		return errors.New("bf: executables must have a fixed tape")
+	case opts.MaxSteps > 0 || opts.Context != nil:
+		return errors.New("bf: executables can't limit steps")
+	}
+	cw, e := opts.cellWidth()
+	if e != nil {
+		return e
+	}
+	opcodes, e := optimize(prog, opts)
+	if e != nil {
+		return e
+	}
+
+	buf, e := gojit.Alloc(gojit.PageSize * 4)
+	if e != nil {
+		return e
+	}
+	defer gojit.Release(buf)
+
+	cc := &compiled{buf: buf, cells: cw, eof: opts.EOF, stop: new(amd64.Label)}
+	asm := &amd64.Assembler{Buf: buf}
+	asm.MovAbs(aotTape, amd64.Rax)
+	emitProgram(asm, cc, opcodes, emitDotSyscall, emitCommaSyscall)
+	asm.Mov(amd64.Imm{sysExit}, amd64.Rax)
+	asm.Xor(amd64.Rdi, amd64.Rdi)
+	asm.Syscall()
+	asm.Bind(cc.stop)
+	asm.Mov(amd64.Imm{sysExit}, amd64.Rax)
+	asm.Mov(amd64.Imm{1}, amd64.Rdi)
+	asm.Syscall()
+
+	var f elfgen.File
+	f.Type = elf.ET_EXEC
+	f.Entry = aotText
+	text := f.AddSection(&elfgen.Section{
+		Name:  ".text",
+		Type:  elf.SHT_PROGBITS,
+		Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+		Addr:  aotText,
+		Align: 16,
+		Data:  append([]byte(nil), buf[:asm.Off]...),
+	})
+	tape := f.AddSection(&elfgen.Section{
+		Name:  ".bss",
+		Type:  elf.SHT_NOBITS,
+		Flags: elf.SHF_ALLOC | elf.SHF_WRITE,
+		Addr:  aotTape,
+		Align: 16,
+		Size:  uint64(tapeSize),
+	})
+	f.AddProg(&elfgen.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_X, Sections: []*elfgen.Section{text}})
+	f.AddProg(&elfgen.Prog{Type: elf.PT_LOAD, Flags: elf.PF_R | elf.PF_W, Sections: []*elfgen.Section{tape}})
+	f.AddSymbol(&elfgen.Symbol{
+		Name:    "_start",
+		Section: text,
+		Value:   aotText,
+		Size:    uint64(asm.Off),
+		Type:    elf.STT_FUNC,
+		Bind:    elf.STB_GLOBAL,
+	})
+
+	_, e = w.Write(f.Bytes())
+	return e
+}
@@ -0,0 +1,113 @@
+package bf
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestWriteExecutable(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("executables are for Linux")
+	}
+	dir, e := ioutil.TempDir("", "gobf")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		prog   string
+		rd, wr []byte
+	}{
+		{"++++.>++.>.", nil, []byte{4, 2, 0}},
+		{",[.,]", []byte("echo"), []byte("echo")},
+		{"+,.", nil, []byte{0}},
+		{helloWorld, nil, []byte("Hello World!\n")},
+		{dbfi, []byte(helloWorld + "!"), []byte("Hello World!\n")},
+	}
+	for i, tc := range cases {
+		var exe bytes.Buffer
+		if e := WriteExecutable(&exe, []byte(tc.prog), 4096); e != nil {
+			t.Errorf("WriteExecutable(%s): %s", tc.prog, e.Error())
+			continue
+		}
+		path := filepath.Join(dir, "prog")
+		if e := ioutil.WriteFile(path, exe.Bytes(), 0755); e != nil {
+			t.Fatal(e)
+		}
+		cmd := exec.Command(path)
+		cmd.Stdin = bytes.NewReader(tc.rd)
+		out, e := cmd.Output()
+		if e != nil {
+			t.Errorf("case %d: running: %s", i, e.Error())
+			continue
+		}
+		if !bytes.Equal(out, tc.wr) {
+			t.Errorf("WriteExecutable(%s): got %q, expected %q", tc.prog, out, tc.wr)
+		}
+		os.Remove(path)
+	}
+}
+
+func TestWriteExecutableOptions(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("executables are for Linux")
+	}
+	dir, e := ioutil.TempDir("", "gobf")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+
+	cases := []struct {
+		prog   string
+		opts   Options
+		rd, wr []byte
+	}{
+		{strings.Repeat("+", 256) + "[>+<[-]]>.", Options{CellBits: 16}, nil, []byte{1}},
+		{strings.Repeat("+", 256) + ",[>+<[-]]>.", Options{CellBits: 16}, []byte{0}, []byte{0}},
+		{",+[>+<[-]]>.", Options{CellBits: 16, EOF: EOFMinusOne}, nil, []byte{0}},
+		{strings.Repeat("+", 256) + ",[>+<[-]]>.", Options{CellBits: 32, EOF: EOFUnchanged}, nil, []byte{1}},
+		{"+,.", Options{EOF: EOFMinusOne}, nil, []byte{0xff}},
+		{"+,.", Options{EOF: EOFUnchanged}, nil, []byte{1}},
+	}
+	for i, tc := range cases {
+		var exe bytes.Buffer
+		if e := WriteExecutableOptions(&exe, []byte(tc.prog), 4096, tc.opts); e != nil {
+			t.Errorf("WriteExecutableOptions(%s): %s", tc.prog, e.Error())
+			continue
+		}
+		path := filepath.Join(dir, "prog")
+		if e := ioutil.WriteFile(path, exe.Bytes(), 0755); e != nil {
+			t.Fatal(e)
+		}
+		cmd := exec.Command(path)
+		cmd.Stdin = bytes.NewReader(tc.rd)
+		out, e := cmd.Output()
+		if e != nil {
+			t.Errorf("case %d: running: %s", i, e.Error())
+			continue
+		}
+		if !bytes.Equal(out, tc.wr) {
+			t.Errorf("case %d: got %v, expected %v", i, out, tc.wr)
+		}
+		os.Remove(path)
+	}
+
+	for _, opts := range []Options{
+		{BoundsCheck: true},
+		{Tape: TapeCircular},
+		{MaxSteps: 10},
+		{CellBits: 12},
+	} {
+		if e := WriteExecutableOptions(ioutil.Discard, []byte("+"), 4096, opts); e == nil {
+			t.Errorf("WriteExecutableOptions(%+v): expected an error", opts)
+		}
+	}
+}
@@ -3,27 +3,261 @@
 package bf
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
+	"runtime"
+	"sort"
+	"unsafe"
 
 	"github.com/nelhage/gojit"
 	"github.com/nelhage/gojit/amd64"
 )
 
 type compiled struct {
-	buf   []byte
-	code  func([]byte)
-	r     func([]byte) (int, error)
-	w     func([]byte) (int, error)
-	stack []int
+	buf     []byte
+	code    func([]byte)
+	checked func([]byte) (int, uintptr, bool)
+	r       func([]byte) (int, error)
+	w       func([]byte) (int, error)
+
+	// fail, if non-nil, is where code compiled with bounds
+	// checks goes when it would go off the tape. wrap and grow
+	// are the routines for circular and growable tapes, and tick
+	// the one that starts the next slice of steps.
+	fail, wrap, grow, tick *amd64.Label
+
+	// tape is the growable tape while the code runs, and max the
+	// most cells it may grow to.
+	tape []byte
+	max  int
+
+	cells *cellWidth
+	eof   EOF
+
+	// stop is where the code goes to stop early when I/O fails,
+	// with the error in err.
+	stop  *amd64.Label
+	err   error
+	io    *ioBuf
+	steps *budget
+
+	// pcs maps the code to the source, as the offset in buf at
+	// which the code for each opcode starts and the opcode's pos,
+	// or -1 after the last; lines finds a pos's line. If file is
+	// set, emitProgram also records the lines with asm.Line.
+	pcs   []pcPos
+	lines lineTable
+	file  string
+}
+
+type pcPos struct {
+	off, pos int
+}
+
+// pos returns the position in the source of the code at off in c.buf,
+// or the zero Pos if it isn't the code of an opcode.
+func (c *compiled) pos(off int) Pos {
+	i := sort.Search(len(c.pcs), func(i int) bool { return c.pcs[i].off > off }) - 1
+	if i < 0 || c.pcs[i].pos < 0 {
+		return Pos{}
+	}
+	return c.lines.pos(c.pcs[i].pos)
+}
+
+// pcPos returns the position in the source of the code that made a
+// call returning to pc.
+func (c *compiled) pcPos(pc uintptr) Pos {
+	return c.pos(int(pc-gojit.Addr(c.buf)) - 1)
+}
+
+// ioBufSize is the size of the buffers compiled code does I/O through.
+const ioBufSize = 4096
+
+// An ioBuf holds the output of `.' until it is flushed, and the input
+// read ahead for `,'. Compiled code uses it in place, calling back
+// into Go only to flush out when it is full and to refill in when it
+// is empty.
+type ioBuf struct {
+	out      [ioBufSize]byte
+	in       [ioBufSize]byte
+	nout     int // the bytes in out
+	pos, end int // the unread input is in[pos:end]
+}
+
+var (
+	ioOut  = int32(unsafe.Offsetof(ioBuf{}.out))
+	ioIn   = int32(unsafe.Offsetof(ioBuf{}.in))
+	ioNout = int32(unsafe.Offsetof(ioBuf{}.nout))
+	ioPos  = int32(unsafe.Offsetof(ioBuf{}.pos))
+	ioEnd  = int32(unsafe.Offsetof(ioBuf{}.end))
+)
+
+// A cellWidth has the instructions for working on cells of one size.
+type cellWidth struct {
+	bytes               int
+	bits                byte
+	mask                int64
+	add, sub, test, mov *amd64.Instruction
+	cx                  amd64.Register // %rcx, of the size of a cell
+}
+
+var cellWidths = map[int]*cellWidth{
+	8:  {1, 8, 0xff, amd64.InstAddb, amd64.InstSubb, amd64.InstTestb, amd64.InstMovb, amd64.Cl},
+	16: {2, 16, 0xffff, amd64.InstAdd, amd64.InstSub, amd64.InstTest, amd64.InstMov, amd64.Cx},
+	32: {4, 32, 0xffffffff, amd64.InstAdd, amd64.InstSub, amd64.InstTest, amd64.InstMov, amd64.Ecx},
+}
+
+// at returns the cell off cells from the head.
+func (c *cellWidth) at(off int) amd64.Indirect {
+	return amd64.Indirect{amd64.Rax, int32(off * c.bytes), c.bits}
+}
+
+// floorDiv returns a/b rounded down, for b > 0.
+func floorDiv(a, b int) int {
+	if a < 0 {
+		return -((-a + b - 1) / b)
+	}
+	return a / b
 }
 
-func (c *compiled) run(b []byte) {
-	c.code(b)
+func (c *compiled) run(b []byte) error {
+	c.err = nil
+	if c.steps != nil {
+		c.steps.reset()
+	}
+	e := c.exec(b)
+	if !c.flush() && e == nil {
+		return c.err
+	}
+	return e
+}
+
+func (c *compiled) exec(b []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			f, ok := r.(*gojit.Fault)
+			if !ok {
+				panic(r)
+			}
+			c.tape = nil
+			err = &RuntimeError{c.pos(f.Off), f}
+		}
+	}()
+	if c.checked == nil {
+		c.code(b)
+		return c.err
+	}
+	w := c.cells.bytes
+	if c.wrap != nil && len(b) < w {
+		return &RangeError{0, 0, Pos{}}
+	}
+	c.tape = b
+	off, pc, ok := c.checked(b)
+	n := len(c.tape) / w
+	c.tape = nil
+	if !ok {
+		return &RangeError{floorDiv(off, w), n, c.pcPos(pc)}
+	}
+	return c.err
+}
+
+// A handle holds on to a compiled program for the function that runs
+// it, so that the program's code can be released once the function is
+// no longer reachable. The program itself can't be finalized, since
+// the callbacks registered for its code keep it reachable until then.
+type handle struct {
+	cc *compiled
+}
+
+func (h *handle) run(b []byte) error {
+	e := h.cc.run(b)
+	// Keep the code around until it returns.
+	runtime.KeepAlive(h)
+	return e
 }
 
-// %rax is the tape pointer
+// function returns the function that runs c, which releases c's code
+// when it is garbage collected.
+func (c *compiled) function() func([]byte) error {
+	h := &handle{c}
+	runtime.SetFinalizer(h, func(h *handle) {
+		gojit.Release(h.cc.buf)
+	})
+	return h.run
+}
+
+// growTape grows c.tape to hold the byte at need, returning its new
+// base and length in bytes, or the old ones and false if it can't.
+func (c *compiled) growTape(need int) (uintptr, int, bool) {
+	w := c.cells.bytes
+	if n, ok := grownLen(len(c.tape)/w, need/w, c.max); ok {
+		t := make([]byte, n*w)
+		copy(t, c.tape)
+		c.tape = t
+		return gojit.Addr(t), len(t), true
+	}
+	return gojit.Addr(c.tape), len(c.tape), false
+}
+
+// grownLen returns the length a tape of n cells grows to to hold cell
+// need, or false if that would take more than max cells. The tape
+// doubles until it is long enough, so that, whether it grows for each
+// cell in turn or just for the last, it ends up the same length.
+func grownLen(n, need, max int) (int, bool) {
+	if max > 0 && need >= max {
+		return 0, false
+	}
+	if n == 0 {
+		n = 1
+	}
+	for n <= need {
+		n *= 2
+	}
+	if max > 0 && n > max {
+		n = max
+	}
+	return n, true
+}
+
+// A RangeError is the error from a program run with a checked tape
+// that goes off the end of it.
+type RangeError struct {
+	Cell int // the cell it went to, which may be negative
+	Len  int // the length of the tape
+	Pos  Pos // the instruction that went there, if known
+}
+
+func (e *RangeError) Error() string {
+	msg := fmt.Sprintf("bf: cell %d is off the %d-cell tape", e.Cell, e.Len)
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, msg)
+	}
+	return msg
+}
+
+// A RuntimeError is an error that stopped a program at the
+// instruction at Pos: ErrStepLimit, the Err of Options.Context, or a
+// *gojit.Fault.
+type RuntimeError struct {
+	Pos Pos
+	Err error
+}
+
+func (e *RuntimeError) Error() string {
+	if e.Pos.IsValid() {
+		return fmt.Sprintf("%s: %s", e.Pos, e.Err)
+	}
+	return e.Err.Error()
+}
+
+func (e *RuntimeError) Unwrap() error {
+	return e.Err
+}
+
+// %rax is the tape pointer. With bounds checks, %r8 and %r9 hold the
+// start and end of the tape, rounded down to whole cells, and the
+// frame pointer is saved at 0(%rsp) between opcodes.
 
 func jcc(a *amd64.Assembler, cc byte, over func(*amd64.Assembler)) {
 	start := a.Off
@@ -39,211 +273,771 @@ func jcc(a *amd64.Assembler, cc byte, over func(*amd64.Assembler)) {
 	a.Off = end
 }
 
-var knownOpcodes = []byte("+-[]<>,.")
-var repeatOpcodes = []byte("+-<>")
+// flush writes out the output buffered by `.', returning false if
+// the write fails.
+func (c *compiled) flush() bool {
+	n := c.io.nout
+	if n == 0 {
+		return true
+	}
+	c.io.nout = 0
+	if _, e := c.w(c.io.out[:n]); e != nil {
+		c.err = e
+		return false
+	}
+	return true
+}
 
-type opcode struct {
-	op     byte
-	repeat int
+// fill flushes the output, and then refills the input buffer for `,',
+// returning how many bytes it read, -1 at EOF, or -2 if the read or
+// the flush fails.
+func (c *compiled) fill() int {
+	if !c.flush() {
+		return -2
+	}
+	n, e := c.r(c.io.in[:])
+	c.io.pos, c.io.end = 0, n
+	switch {
+	case n > 0:
+		return n
+	case e != nil && e != io.EOF:
+		c.err = e
+		return -2
+	}
+	return -1
 }
 
-func optimize(prog []byte) ([]opcode, error) {
-	out := make([]opcode, 0, len(prog)/4)
-	nesting := 0
-	for _, b := range prog {
-		if bytes.IndexByte(knownOpcodes, b) == -1 {
-			continue
-		}
+// emitIOCall emits a call to f, a flush or fill, leaving its result
+// in %rcx and reloading the tape's bounds, which it clobbers.
+func emitIOCall(asm *amd64.Assembler, cc *compiled, f interface{}) {
+	asm.Push(amd64.Rax)
+	asm.Sub(amd64.Imm{16}, amd64.Rsp)
+	asm.CallFunc(f)
+	asm.Mov(amd64.Indirect{amd64.Rsp, 0, 64}, amd64.Rcx)
+	asm.Add(amd64.Imm{16}, amd64.Rsp)
+	asm.Pop(amd64.Rax)
+	if cc.fail != nil {
+		emitLoadBounds(asm, cc)
+	}
+}
 
-		if b == '[' {
-			nesting++
-		} else if b == ']' {
-			nesting--
-			if nesting < 0 {
-				return nil, fmt.Errorf("mismatched ]")
-			}
-		}
+// emitDot emits `.', which appends the cell to cc.io.out, flushing
+// it first if it is full. %rsi points at cc.io and %rdx is the count.
+func emitDot(asm *amd64.Assembler, cc *compiled) {
+	var put amd64.Label
+	asm.MovAbs(uint64(uintptr(unsafe.Pointer(cc.io))), amd64.Rsi)
+	asm.Mov(amd64.Indirect{amd64.Rsi, ioNout, 64}, amd64.Rdx)
+	asm.Cmp(amd64.Imm{ioBufSize}, amd64.Rdx)
+	asm.JccLabel(amd64.CC_B, &put)
+	emitIOCall(asm, cc, cc.flush)
+	asm.Testb(amd64.Cl, amd64.Cl)
+	asm.JccLabel(amd64.CC_Z, cc.stop)
+	asm.MovAbs(uint64(uintptr(unsafe.Pointer(cc.io))), amd64.Rsi)
+	asm.Xor(amd64.Edx, amd64.Edx)
+	asm.Bind(&put)
+	asm.Movb(amd64.Indirect{amd64.Rax, 0, 8}, amd64.Cl)
+	asm.Movb(amd64.Cl, amd64.SIB{ioOut, amd64.Rsi, amd64.Rdx, amd64.Scale1})
+	asm.Inc(amd64.Rdx)
+	asm.Mov(amd64.Rdx, amd64.Indirect{amd64.Rsi, ioNout, 64})
+}
 
-		if bytes.IndexByte(repeatOpcodes, b) != -1 &&
-			len(out) > 0 && out[len(out)-1].op == b {
-			out[len(out)-1].repeat += 1
-		} else {
-			out = append(out, opcode{b, 1})
-		}
+// emitComma emits `,', which takes the next byte of cc.io.in,
+// refilling it first if it is empty. %rsi points at cc.io and %rdx
+// is the position.
+func emitComma(asm *amd64.Assembler, cc *compiled) {
+	var get, eof, done amd64.Label
+	cw := cc.cells
+	asm.MovAbs(uint64(uintptr(unsafe.Pointer(cc.io))), amd64.Rsi)
+	asm.Mov(amd64.Indirect{amd64.Rsi, ioPos, 64}, amd64.Rdx)
+	asm.Cmp(amd64.Indirect{amd64.Rsi, ioEnd, 64}, amd64.Rdx)
+	asm.JccLabel(amd64.CC_B, &get)
+	emitIOCall(asm, cc, cc.fill)
+	asm.Test(amd64.Rcx, amd64.Rcx)
+	asm.JccLabel(amd64.CC_S, &eof)
+	asm.MovAbs(uint64(uintptr(unsafe.Pointer(cc.io))), amd64.Rsi)
+	asm.Xor(amd64.Edx, amd64.Edx)
+	asm.Bind(&get)
+	if cw.bytes > 1 {
+		asm.Xor(amd64.Ecx, amd64.Ecx)
 	}
+	asm.Movb(amd64.SIB{ioIn, amd64.Rsi, amd64.Rdx, amd64.Scale1}, amd64.Cl)
+	asm.Inc(amd64.Rdx)
+	asm.Mov(amd64.Rdx, amd64.Indirect{amd64.Rsi, ioPos, 64})
+	asm.Arithmetic(cw.mov, cw.cx, cw.at(0))
+	asm.JmpLabel(&done)
+	asm.Bind(&eof)
+	asm.Cmp(amd64.Imm{-1}, amd64.Rcx)
+	asm.JccLabel(amd64.CC_NZ, cc.stop)
+	emitEOF(asm, cc)
+	asm.Bind(&done)
+}
 
-	if nesting != 0 {
-		return nil, fmt.Errorf("extra [")
+// emitEOF emits code to set the cell at %rax as cc.eof says to at the
+// end of the input.
+func emitEOF(asm *amd64.Assembler, cc *compiled) {
+	cw := cc.cells
+	switch cc.eof {
+	case EOFZero:
+		asm.Arithmetic(cw.mov, amd64.Imm{0}, cw.at(0))
+	case EOFMinusOne:
+		asm.Arithmetic(cw.mov, amd64.Imm{cw.mask}, cw.at(0))
 	}
+}
 
-	return out, nil
+// emitLoadBounds loads the tape's bounds into %r8 and %r9 from the
+// frame saved at 0(%rsp), leaving the frame pointer in %rdi.
+func emitLoadBounds(asm *amd64.Assembler, cc *compiled) {
+	asm.Mov(amd64.Indirect{amd64.Rsp, 0, 64}, amd64.Rdi)
+	asm.Mov(amd64.Indirect{amd64.Rdi, 0, 64}, amd64.R8)
+	asm.Mov(amd64.Indirect{amd64.Rdi, 8, 64}, amd64.R9)
+	if w := cc.cells.bytes; w > 1 {
+		asm.And(amd64.Imm{int64(-w)}, amd64.R9)
+	}
+	asm.Add(amd64.R8, amd64.R9)
 }
 
-func emitDot(asm *amd64.Assembler, cc *compiled) {
+// emitCheck emits a check that the cells lo through hi from %rax are
+// on the tape, calling cc.fail with the address of a byte that isn't
+// in %rcx if not, so that it knows where the check was. On a growable
+// tape, it grows the tape to hold hi instead.
+//
+// The code checking hi is mapped to hiPos, the pos of the opcode that
+// uses hi, unless that is -1.
+func emitCheck(asm *amd64.Assembler, cc *compiled, lo, hi, hiPos int) {
+	var retry, low, ok amd64.Label
+	w := cc.cells.bytes
+	asm.Bind(&retry)
+	asm.Lea(amd64.Indirect{amd64.Rax, int32(lo * w), 64}, amd64.Rcx)
+	asm.Cmp(amd64.R8, amd64.Rcx)
+	asm.JccLabel(amd64.CC_AE, &low)
+	asm.CallLabel(cc.fail)
+	asm.Bind(&low)
+	if hiPos >= 0 {
+		cc.pcs = append(cc.pcs, pcPos{asm.Off, hiPos})
+	}
+	if last := hi*w + w - 1; last != lo*w {
+		asm.Lea(amd64.Indirect{amd64.Rax, int32(last), 64}, amd64.Rcx)
+	}
+	asm.Cmp(amd64.R9, amd64.Rcx)
+	asm.JccLabel(amd64.CC_B, &ok)
+	if cc.grow == nil {
+		asm.CallLabel(cc.fail)
+		asm.Bind(&ok)
+		return
+	}
+	asm.CallLabel(cc.grow)
+	asm.JmpLabel(&retry)
+	asm.Bind(&ok)
+}
+
+// emitGrow emits the routine at cc.grow, which calls cc.growTape to
+// hold the cell at %rcx, and then moves %rax, %r8, %r9 and the tape
+// in the frame over to the new tape. If the tape can't grow, it goes
+// on to cc.fail, as if the check had called that instead.
+func emitGrow(asm *amd64.Assembler, cc *compiled) {
+	var failed amd64.Label
+	asm.Bind(cc.grow)
+	asm.Sub(amd64.R8, amd64.Rax)
+	asm.Sub(amd64.R8, amd64.Rcx)
 	asm.Push(amd64.Rax)
-	asm.Sub(amd64.Imm{48}, amd64.Rsp)
-	asm.Mov(amd64.Imm{1}, amd64.Indirect{amd64.Rsp, 16, 64})
-	asm.Mov(amd64.Imm{1}, amd64.Indirect{amd64.Rsp, 8, 64})
-	asm.Mov(amd64.Rax, amd64.Indirect{amd64.Rsp, 0, 64})
-	asm.CallFunc(cc.w)
-	asm.Add(amd64.Imm{48}, amd64.Rsp)
+	asm.Push(amd64.Rcx)
+	asm.Sub(amd64.Imm{32}, amd64.Rsp)
+	asm.Mov(amd64.Rcx, amd64.Indirect{amd64.Rsp, 0, 64})
+	asm.CallFunc(cc.growTape)
+	asm.Mov(amd64.Indirect{amd64.Rsp, 8, 64}, amd64.R8)
+	asm.Mov(amd64.Indirect{amd64.Rsp, 16, 64}, amd64.R9)
+	asm.Movb(amd64.Indirect{amd64.Rsp, 24, 8}, amd64.Dl)
+	asm.Add(amd64.Imm{32}, amd64.Rsp)
+	asm.Pop(amd64.Rcx)
 	asm.Pop(amd64.Rax)
+	asm.Add(amd64.R8, amd64.Rax)
+	asm.Add(amd64.R8, amd64.Rcx)
+	asm.Testb(amd64.Dl, amd64.Dl)
+	asm.JccLabel(amd64.CC_Z, &failed)
+
+	asm.Mov(amd64.Indirect{amd64.Rsp, 8, 64}, amd64.Rdi)
+	asm.Mov(amd64.R8, amd64.Indirect{amd64.Rdi, 0, 64})
+	asm.Mov(amd64.R9, amd64.Indirect{amd64.Rdi, 8, 64})
+	asm.Mov(amd64.R9, amd64.Indirect{amd64.Rdi, 16, 64})
+	asm.Add(amd64.R8, amd64.R9)
+	asm.Ret()
+
+	asm.Bind(&failed)
+	asm.Add(amd64.R8, amd64.R9)
+	asm.JmpLabel(cc.fail)
 }
 
-func emitComma(asm *amd64.Assembler, cc *compiled) {
+// tickBudget starts the next slice of c.steps for the call to cc.tick
+// returning to pc, returning false if the program may take no more
+// steps.
+func (c *compiled) tickBudget(pc uintptr) bool {
+	if e := c.steps.tick(); e != nil {
+		c.err = &RuntimeError{c.pcPos(pc), e}
+		return false
+	}
+	return true
+}
+
+// emitStep emits code to take a step from cc.steps, if the program
+// has a budget, calling cc.tick when the slice runs out.
+func emitStep(asm *amd64.Assembler, cc *compiled) {
+	if cc.steps == nil {
+		return
+	}
+	var ok amd64.Label
+	asm.MovAbs(uint64(uintptr(unsafe.Pointer(&cc.steps.n))), amd64.Rcx)
+	asm.Sub(amd64.Imm{1}, amd64.Indirect{amd64.Rcx, 0, 64})
+	asm.JccLabel(amd64.CC_AE, &ok)
+	asm.CallLabel(cc.tick)
+	if cc.fail != nil {
+		emitLoadBounds(asm, cc)
+	}
+	asm.Bind(&ok)
+}
+
+// emitTick emits the routine at cc.tick, which calls cc.tickBudget,
+// going to cc.stop if the program may take no more steps.
+func emitTick(asm *amd64.Assembler, cc *compiled) {
+	var failed amd64.Label
+	asm.Bind(cc.tick)
 	asm.Push(amd64.Rax)
-	asm.Sub(amd64.Imm{48}, amd64.Rsp)
-	asm.Mov(amd64.Imm{1}, amd64.Indirect{amd64.Rsp, 16, 64})
-	asm.Mov(amd64.Imm{1}, amd64.Indirect{amd64.Rsp, 8, 64})
-	asm.Mov(amd64.Rax, amd64.Indirect{amd64.Rsp, 0, 64})
-	asm.CallFunc(cc.r)
-	asm.Add(amd64.Imm{48}, amd64.Rsp)
+	asm.Sub(amd64.Imm{24}, amd64.Rsp)
+	asm.Mov(amd64.Indirect{amd64.Rsp, 32, 64}, amd64.Rcx)
+	asm.Mov(amd64.Rcx, amd64.Indirect{amd64.Rsp, 0, 64})
+	asm.CallFunc(cc.tickBudget)
+	asm.Movb(amd64.Indirect{amd64.Rsp, 8, 8}, amd64.Cl)
+	asm.Add(amd64.Imm{24}, amd64.Rsp)
 	asm.Pop(amd64.Rax)
-	asm.Test(amd64.Imm{-1}, amd64.Indirect{amd64.Rsp, -24, 64})
-	jcc(asm, amd64.CC_Z, func(asm *amd64.Assembler) {
-		asm.Movb(amd64.Imm{0}, amd64.Indirect{amd64.Rax, 0, 8})
-	})
-}
+	asm.Testb(amd64.Cl, amd64.Cl)
+	asm.JccLabel(amd64.CC_Z, &failed)
+	asm.Ret()
 
-func emitLbrac(asm *amd64.Assembler, cc *compiled) {
-	cc.stack = append(cc.stack, asm.Off)
-	asm.Testb(amd64.Imm{0xff}, amd64.Indirect{amd64.Rax, 0, 8})
-	asm.JccRel(amd64.CC_Z, gojit.Addr(asm.Buf[asm.Off:]))
+	asm.Bind(&failed)
+	asm.Add(amd64.Imm{8}, amd64.Rsp)
+	asm.JmpLabel(cc.stop)
 }
 
-func emitRbrac(asm *amd64.Assembler, cc *compiled) {
-	header := cc.stack[len(cc.stack)-1]
-	cc.stack = cc.stack[:len(cc.stack)-1]
-	asm.JmpRel(gojit.Addr(asm.Buf[header:]))
-	end := asm.Off
+// emitWrapHead emits code to call cc.wrap if %rax is off the tape.
+func emitWrapHead(asm *amd64.Assembler, cc *compiled) {
+	var wrap, ok amd64.Label
+	asm.Cmp(amd64.R8, amd64.Rax)
+	asm.JccLabel(amd64.CC_B, &wrap)
+	asm.Cmp(amd64.R9, amd64.Rax)
+	asm.JccLabel(amd64.CC_B, &ok)
+	asm.Bind(&wrap)
+	asm.CallLabel(cc.wrap)
+	asm.Bind(&ok)
+}
 
-	asm.Off = header
-	asm.Testb(amd64.Imm{0xff}, amd64.Indirect{amd64.Rax, 0, 8})
-	asm.JccRel(amd64.CC_Z, gojit.Addr(asm.Buf[end:]))
-	asm.Off = end
+// emitWrap emits the routine at cc.wrap, which moves %rax by the
+// length of a circular tape until it is on the tape.
+func emitWrap(asm *amd64.Assembler, cc *compiled) {
+	var low, high, done amd64.Label
+	asm.Bind(cc.wrap)
+	asm.Mov(amd64.R9, amd64.Rcx)
+	asm.Sub(amd64.R8, amd64.Rcx)
+	asm.Bind(&low)
+	asm.Cmp(amd64.R8, amd64.Rax)
+	asm.JccLabel(amd64.CC_AE, &high)
+	asm.Add(amd64.Rcx, amd64.Rax)
+	asm.JmpLabel(&low)
+	asm.Bind(&high)
+	asm.Cmp(amd64.R9, amd64.Rax)
+	asm.JccLabel(amd64.CC_B, &done)
+	asm.Sub(amd64.Rcx, amd64.Rax)
+	asm.JmpLabel(&high)
+	asm.Bind(&done)
+	asm.Ret()
 }
 
 var abi amd64.ABI
 
+// A Tape is a policy for a program going off the end of its tape.
+type Tape int
+
+const (
+	// TapeFixed is just the tape the program is given. Going off
+	// it is an error if Options.BoundsCheck is set.
+	TapeFixed Tape = iota
+	// TapeCircular wraps each end of the tape around to the
+	// other. The tape must not be empty.
+	TapeCircular
+	// TapeGrowable grows the tape to the right as needed, into a
+	// copy of the tape the program is given, to at most
+	// Options.MaxTape cells if that is set. Going off the left end
+	// is an error. Compiled code checks the cells a few opcodes
+	// use at once (see Options.BoundsCheck), so it may grow the
+	// tape before the interpreter would, or go off the left end
+	// before growing it, and a *RangeError's Len may differ.
+	TapeGrowable
+)
+
+// An EOF is what `,' does to the cell at the end of the input.
+type EOF int
+
+const (
+	EOFZero      EOF = iota // set it to 0
+	EOFMinusOne             // set it to -1
+	EOFUnchanged            // leave it as it is
+)
+
+// Options controls how CompileOptions and InterpretOptions run a
+// program.
+type Options struct {
+	// Name identifies the program to profilers: the compiled
+	// code is registered with gojit.Register as "bf:<Name>", and,
+	// if Name is set, with a line table naming Name as the file.
+	Name string
+
+	// CellBits is the size of a cell: 8, 16 or 32 bits, or 0 for
+	// 8. Wider cells are little-endian in the []byte tape, which
+	// holds as many as fit in it. `.' writes the low byte of a
+	// cell, and `,' sets a cell to the byte it reads.
+	CellBits int
+
+	// EOF is what `,' does at the end of the input.
+	EOF EOF
+
+	// BoundsCheck makes the compiled code check that the cells
+	// it uses are on the tape. If one isn't, the program stops,
+	// and the function returns a *RangeError. Checks are merged,
+	// and hoisted out of loops that leave the head where they
+	// found it, so a program may fail a few opcodes before the one
+	// that goes off the tape, but only if it would get there.
+	BoundsCheck bool
+
+	// Tape is the policy for going off the end of the tape. Only
+	// TapeFixed can go unchecked.
+	Tape Tape
+
+	// MaxTape, if not zero, is the most cells a TapeGrowable tape
+	// grows to.
+	MaxTape int
+
+	// MaxSteps, if not zero, is the most steps the program may
+	// take, where a step is a loop going back to its start. That
+	// includes loops such as `[>]' that are a single opcode, but
+	// not the ones turned into straight-line code. If the program
+	// would take more, it stops, and the function returns
+	// ErrStepLimit.
+	MaxSteps int
+
+	// Context, if not nil, stops the program when it is done, and
+	// the function returns its Err. It is checked on the first
+	// step, and then every 65536.
+	Context context.Context
+}
+
+// cellWidth returns the cellWidth for o.CellBits.
+func (o Options) cellWidth() (*cellWidth, error) {
+	bits := o.CellBits
+	if bits == 0 {
+		bits = 8
+	}
+	if cw, ok := cellWidths[bits]; ok {
+		return cw, nil
+	}
+	return nil, fmt.Errorf("bf: can't have %d-bit cells", o.CellBits)
+}
+
 // Compile compiles a brainfuck program (represented as a byte slice)
 // into a Go function. The function accepts as an argument the tape to
 // operate on. The provided Reader and Writer are used to implement
 // `,' and `.', respectively.
 //
-// The compiled code does no bounds-checking on the tape. On EOF or
-// other read error, `,' clears the current cell.
-func Compile(prog []byte, r io.Reader, w io.Writer) (func([]byte), error) {
+// The compiled code does no bounds-checking on the tape (but see
+// Options.BoundsCheck); if running off the end of it faults, the
+// program stops, and the function returns a *RuntimeError with the
+// *gojit.Fault. On EOF, `,' clears the current
+// cell; see Options.EOF. If a read (other than at EOF) or a write
+// fails, the program stops, and the function returns the error.
+//
+// Output is buffered, and written when the buffer fills, before
+// reading more input, and when the program returns. Input is read
+// ahead, as much as one Read gives; what the program doesn't read is
+// kept for the next time the function is called.
+//
+// A program with a `[' or `]' that doesn't match is a *SyntaxError.
+//
+// The function may not be called concurrently. The compiled code is
+// released once the function is garbage collected.
+func Compile(prog []byte, r io.Reader, w io.Writer) (func([]byte) error, error) {
+	return CompileOptions(prog, r, w, Options{})
+}
+
+// CompileOptions is like Compile, but takes Options. The function it
+// returns also reports a program going off the end of its tape with
+// a *RangeError, if opts asks for checks.
+func CompileOptions(prog []byte, r io.Reader, w io.Writer, opts Options) (func([]byte) error, error) {
+	cw, e := opts.cellWidth()
+	if e != nil {
+		return nil, e
+	}
+	opcodes, e := optimize(prog, opts)
+	if e != nil {
+		return nil, e
+	}
 	buf, e := gojit.Alloc(gojit.PageSize * 4)
 	if e != nil {
 		return nil, e
 	}
+	if e = gojit.Guard(buf); e != nil {
+		gojit.Release(buf)
+		return nil, e
+	}
 
-	cc := &compiled{buf: buf, r: r.Read, w: w.Write}
+	cc := &compiled{buf: buf, r: r.Read, w: w.Write, cells: cw, eof: opts.EOF}
+	cc.stop = new(amd64.Label)
+	cc.io = new(ioBuf)
+	cc.lines, cc.file = newLineTable(prog), opts.Name
+	if cc.steps = newBudget(opts); cc.steps != nil {
+		cc.tick = new(amd64.Label)
+	}
 
 	asm := &amd64.Assembler{Buf: buf, ABI: abi}
-	asm.Mov(amd64.Indirect{amd64.Rdi, 0, 64}, amd64.Rax)
+	if opts.Name != "" {
+		asm.Func("bf:" + opts.Name)
+	} else {
+		asm.Func("bf")
+	}
 
-	opcodes, e := optimize(prog)
-	if e != nil {
-		return nil, e
+	if opts.Tape == TapeFixed && !opts.BoundsCheck {
+		asm.Mov(amd64.Indirect{amd64.Rdi, 0, 64}, amd64.Rax)
+		emitProgram(asm, cc, opcodes, emitDot, emitComma)
+		asm.Bind(cc.stop)
+		asm.Ret()
+		if cc.tick != nil {
+			emitTick(asm, cc)
+		}
+		asm.BuildTo(&cc.code)
+		return cc.function(), nil
 	}
 
-	for _, op := range opcodes {
+	switch opts.Tape {
+	case TapeCircular:
+		cc.wrap = new(amd64.Label)
+	case TapeGrowable:
+		cc.grow = new(amd64.Label)
+		cc.max = opts.MaxTape
+		fallthrough
+	default:
+		opcodes = addChecks(opcodes)
+		link(opcodes)
+	}
+	cc.fail = new(amd64.Label)
+	asm.Push(amd64.Rdi)
+	emitLoadBounds(asm, cc)
+	asm.Mov(amd64.R8, amd64.Rax)
+	emitProgram(asm, cc, opcodes, emitDot, emitComma)
+	asm.Bind(cc.stop)
+	asm.Pop(amd64.Rdi)
+	asm.Movb(amd64.Imm{1}, amd64.Indirect{amd64.Rdi, 40, 8})
+	asm.Ret()
+
+	asm.Bind(cc.fail)
+	asm.Pop(amd64.Rdx)
+	asm.Sub(amd64.R8, amd64.Rcx)
+	asm.Pop(amd64.Rdi)
+	asm.Mov(amd64.Rcx, amd64.Indirect{amd64.Rdi, 24, 64})
+	asm.Mov(amd64.Rdx, amd64.Indirect{amd64.Rdi, 32, 64})
+	asm.Ret()
+
+	if cc.wrap != nil {
+		emitWrap(asm, cc)
+	}
+	if cc.grow != nil {
+		emitGrow(asm, cc)
+	}
+	if cc.tick != nil {
+		emitTick(asm, cc)
+	}
+	asm.BuildTo(&cc.checked)
+	return cc.function(), nil
+}
+
+// emitProgram emits the code for opcodes, with the tape pointer in
+// %rax, using dot and comma to emit `.' and `,'.
+func emitProgram(asm *amd64.Assembler, cc *compiled, opcodes []opcode,
+	dot, comma func(*amd64.Assembler, *compiled)) {
+	// after[i] is bound after the code for opcodes[i], for the
+	// jumps of loops.
+	after := make([]amd64.Label, len(opcodes))
+	line := 0
+	for i, op := range opcodes {
+		cc.pcs = append(cc.pcs, pcPos{asm.Off, op.pos})
+		if cc.file != "" {
+			if l := cc.lines.pos(op.pos).Line; l != line {
+				asm.Line(cc.file, l)
+				line = l
+			}
+		}
+		cw := cc.cells
+		cell := cw.at(op.off)
 		switch op.op {
-		case '+':
-			asm.Addb(amd64.Imm{int32(op.repeat)},
-				amd64.Indirect{amd64.Rax, 0, 8})
-		case '-':
-			asm.Subb(amd64.Imm{int32(op.repeat)},
-				amd64.Indirect{amd64.Rax, 0, 8})
-		case '<':
-			asm.Sub(amd64.Imm{int32(op.repeat)}, amd64.Rax)
-		case '>':
-			asm.Add(amd64.Imm{int32(op.repeat)}, amd64.Rax)
-		case '.':
-			emitDot(asm, cc)
-		case ',':
-			emitComma(asm, cc)
-		case '[':
-			emitLbrac(asm, cc)
-		case ']':
-			emitRbrac(asm, cc)
+		case opAdd:
+			if op.arg > 0 {
+				asm.Arithmetic(cw.add, amd64.Imm{int64(op.arg) & cw.mask}, cell)
+			} else {
+				asm.Arithmetic(cw.sub, amd64.Imm{int64(-op.arg) & cw.mask}, cell)
+			}
+		case opMove:
+			if d := op.arg * cw.bytes; d > 0 {
+				asm.Add(amd64.Imm{int64(d)}, amd64.Rax)
+			} else {
+				asm.Sub(amd64.Imm{int64(-d)}, amd64.Rax)
+			}
+			if cc.wrap != nil {
+				emitWrapHead(asm, cc)
+			}
+		case opOut:
+			dot(asm, cc)
+		case opIn:
+			comma(asm, cc)
+		case opLoop:
+			asm.Arithmetic(cw.test, amd64.Imm{cw.mask}, cell)
+			asm.JccLabel(amd64.CC_Z, &after[op.jump])
+		case opEnd:
+			asm.Arithmetic(cw.test, amd64.Imm{cw.mask}, cell)
+			if cc.steps == nil {
+				asm.JccLabel(amd64.CC_NZ, &after[op.jump])
+				break
+			}
+			var done amd64.Label
+			asm.JccLabel(amd64.CC_Z, &done)
+			emitStep(asm, cc)
+			asm.JmpLabel(&after[op.jump])
+			asm.Bind(&done)
+		case opCheck:
+			emitCheck(asm, cc, op.off, op.dst, op.dstPos)
+		case opClear:
+			asm.Arithmetic(cw.mov, amd64.Imm{0}, cell)
+		case opMul:
+			emitMul(asm, cw, op.arg, cell, cw.at(op.dst))
+		case opScan:
+			emitScan(asm, cc, op.arg)
 		}
+		asm.Bind(&after[i])
 	}
+	cc.pcs = append(cc.pcs, pcPos{asm.Off, -1})
+}
 
-	asm.Ret()
+// emitMul emits dst += k * src, with shifts and adds, or subtracts
+// if that takes fewer.
+func emitMul(asm *amd64.Assembler, cw *cellWidth, k int, src, dst amd64.Operand) {
+	asm.Arithmetic(cw.mov, src, cw.cx)
+	op, m := cw.add, int64(k)&cw.mask
+	if m > cw.mask/2 {
+		op, m = cw.sub, int64(-k)&cw.mask
+	}
+	for {
+		if m&1 != 0 {
+			asm.Arithmetic(op, cw.cx, dst)
+		}
+		if m >>= 1; m == 0 {
+			break
+		}
+		asm.Arithmetic(cw.add, cw.cx, cw.cx)
+	}
+}
 
-	asm.BuildTo(&cc.code)
-	return cc.run, nil
+// emitScan emits a loop moving %rax by stride until it points at a
+// zero cell, checking or wrapping each cell it moves to if cc has a
+// checked or circular tape.
+func emitScan(asm *amd64.Assembler, cc *compiled, stride int) {
+	var loop, test amd64.Label
+	asm.JmpLabel(&test)
+	asm.Bind(&loop)
+	emitStep(asm, cc)
+	if d := stride * cc.cells.bytes; d > 0 {
+		asm.Add(amd64.Imm{int64(d)}, amd64.Rax)
+	} else {
+		asm.Sub(amd64.Imm{int64(-d)}, amd64.Rax)
+	}
+	if cc.wrap != nil {
+		emitWrapHead(asm, cc)
+	} else if cc.fail != nil {
+		emitCheck(asm, cc, 0, 0, -1)
+	}
+	asm.Bind(&test)
+	asm.Arithmetic(cc.cells.test, amd64.Imm{cc.cells.mask}, cc.cells.at(0))
+	asm.JccLabel(amd64.CC_NZ, &loop)
 }
 
 type interpreted struct {
-	src    []byte
-	ops    []opcode
-	braces []int
-	r      io.Reader
-	w      io.Writer
+	src   []byte
+	lines lineTable
+	ops   []opcode
+	r     io.Reader
+	w     io.Writer
+	opts  Options
+	bits  int
 }
 
-func (i *interpreted) run(mem []byte) {
+// A cell is the type of the interpreter's cells.
+type cell interface {
+	uint8 | uint16 | uint32
+}
+
+// cellsOf returns the cells held little-endian in b.
+func cellsOf[T cell](b []byte) []T {
+	var c T
+	n := len(b) / int(unsafe.Sizeof(c))
+	if n == 0 {
+		return nil
+	}
+	return unsafe.Slice((*T)(unsafe.Pointer(&b[0])), n)
+}
+
+// A tape is the interpreter's tape, with the policy for cells off the
+// end of it.
+type tape[T cell] struct {
+	mem  []T
+	opts Options
+}
+
+// at returns the index in t.mem of cell n.
+func (t *tape[T]) at(n int) int {
+	if uint(n) < uint(len(t.mem)) {
+		return n
+	}
+	return t.off(n)
+}
+
+func (t *tape[T]) off(n int) int {
+	switch t.opts.Tape {
+	case TapeFixed:
+		if !t.opts.BoundsCheck {
+			// Let indexing t.mem panic.
+			return n
+		}
+	case TapeCircular:
+		if n %= len(t.mem); n < 0 {
+			n += len(t.mem)
+		}
+		return n
+	case TapeGrowable:
+		if n < 0 {
+			break
+		}
+		if l, ok := grownLen(len(t.mem), n, t.opts.MaxTape); ok {
+			mem := make([]T, l)
+			copy(mem, t.mem)
+			t.mem = mem
+			return n
+		}
+	}
+	panic(&RangeError{n, len(t.mem), Pos{}})
+}
+
+func (i *interpreted) run(mem []byte) error {
+	switch i.bits {
+	case 16:
+		return interpret(i, cellsOf[uint16](mem))
+	case 32:
+		return interpret(i, cellsOf[uint32](mem))
+	}
+	return interpret(i, mem)
+}
+
+func interpret[T cell](i *interpreted, mem []T) (err error) {
+	if i.opts.Tape == TapeCircular && len(mem) == 0 {
+		return &RangeError{0, 0, Pos{}}
+	}
 	pc := 0
+	defer func() {
+		if e := recover(); e != nil {
+			re, ok := e.(*RangeError)
+			if !ok {
+				panic(e)
+			}
+			re.Pos = i.lines.pos(i.ops[pc].pos)
+			err = re
+		}
+	}()
+
+	t := &tape[T]{mem, i.opts}
+	steps := newBudget(i.opts)
+	var buf [1]byte
 	head := 0
-	// fmt.Printf("interpret(%s)...\n", i.src)
-	// fmt.Printf("  ops = %v\n", i.ops)
 	for pc < len(i.ops) {
 		op := i.ops[pc]
-		// fmt.Printf("pc=%d head=%d op=%c repeat=%d\n", pc, head, op.op, op.repeat)
 		switch op.op {
-		case '+':
-			mem[head] += byte(op.repeat)
-		case '-':
-			mem[head] -= byte(op.repeat)
-		case '<':
-			head -= op.repeat
-		case '>':
-			head += op.repeat
-		case '.':
-			i.w.Write(mem[head : head+1])
-		case ',':
-			if n, _ := i.r.Read(mem[head : head+1]); n == 0 {
-				mem[head] = 0
+		case opAdd:
+			t.mem[t.at(head+op.off)] += T(op.arg)
+		case opMove:
+			head += op.arg
+		case opOut:
+			buf[0] = byte(t.mem[t.at(head+op.off)])
+			if _, e := i.w.Write(buf[:]); e != nil {
+				return e
+			}
+		case opIn:
+			h := t.at(head + op.off)
+			n, e := i.r.Read(buf[:])
+			if n != 0 {
+				t.mem[h] = T(buf[0])
+				break
+			}
+			if e != nil && e != io.EOF {
+				return e
 			}
-		case '[':
-			if mem[head] == 0 {
-				pc = i.braces[pc]
+			switch i.opts.EOF {
+			case EOFZero:
+				t.mem[h] = 0
+			case EOFMinusOne:
+				t.mem[h] = ^T(0)
+			}
+		case opLoop:
+			if t.mem[t.at(head)] == 0 {
+				pc = op.jump
+			}
+		case opEnd:
+			if t.mem[t.at(head)] != 0 {
+				if steps != nil {
+					if e := steps.step(); e != nil {
+						return &RuntimeError{i.lines.pos(op.pos), e}
+					}
+				}
+				pc = op.jump
+			}
+		case opClear:
+			t.mem[t.at(head+op.off)] = 0
+		case opMul:
+			src := t.mem[t.at(head+op.off)]
+			t.mem[t.at(head+op.dst)] += T(op.arg) * src
+		case opScan:
+			for t.mem[t.at(head)] != 0 {
+				if steps != nil {
+					if e := steps.step(); e != nil {
+						return &RuntimeError{i.lines.pos(op.pos), e}
+					}
+				}
+				head += op.arg
 			}
-		case ']':
-			pc = i.braces[pc] - 1
 		}
 		pc++
 	}
+	return nil
 }
 
-func Interpret(prog []byte, r io.Reader, w io.Writer) (func([]byte), error) {
-	opcodes, e := optimize(prog)
+// Interpret is like Compile, but returns a function that interprets
+// the program.
+func Interpret(prog []byte, r io.Reader, w io.Writer) (func([]byte) error, error) {
+	return InterpretOptions(prog, r, w, Options{})
+}
+
+// InterpretOptions is like CompileOptions, but returns a function
+// that interprets the program.
+func InterpretOptions(prog []byte, r io.Reader, w io.Writer, opts Options) (func([]byte) error, error) {
+	cw, e := opts.cellWidth()
 	if e != nil {
 		return nil, e
 	}
-
-	i := &interpreted{prog, opcodes, make([]int, len(opcodes)), r, w}
-
-	var stack []int
-	for j, o := range opcodes {
-		if o.op == '[' {
-			stack = append(stack, j)
-		} else if o.op == ']' {
-			if len(stack) == 0 {
-				panic("stack mismatch")
-			}
-			start := stack[len(stack)-1]
-			stack = stack[:len(stack)-1]
-			if opcodes[start].op != '[' {
-				panic("stack misalignment!")
-			}
-			i.braces[j] = start
-			i.braces[start] = j
-		}
+	opcodes, e := optimize(prog, opts)
+	if e != nil {
+		return nil, e
 	}
 
+	i := &interpreted{prog, newLineTable(prog), opcodes, r, w, opts, int(cw.bits)}
 	return i.run, nil
 }
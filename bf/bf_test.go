@@ -2,11 +2,17 @@ package bf
 
 import (
 	"bytes"
+	"context"
+	"errors"
+	"github.com/nelhage/gojit"
 	"github.com/nelhage/gojit/amd64"
 	"io"
 	"reflect"
 	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
+	"time"
 )
 
 var helloWorld = "++++++++[>++++[>++>+++>+++>+<<<<-]>+>+>->>+[<]<-]>>.>---.+++++++..+++.>>.<-.<.+++.------.--------.>>+.>++."
@@ -24,12 +30,610 @@ func TestCompile(t *testing.T) {
 	testImplementation(t, Compile)
 }
 
+func TestCompileGoABI(t *testing.T) {
+	use_goabi()
+	defer reset_abi()
+	testImplementation(t, Compile)
+}
+
+type prepareOptions func([]byte, io.Reader, io.Writer, Options) (func([]byte) error, error)
+
+// withOptions adapts prepare, with opts, for testImplementation.
+func withOptions(prepare prepareOptions, opts Options) func([]byte, io.Reader, io.Writer) (func([]byte) error, error) {
+	return func(prog []byte, r io.Reader, w io.Writer) (func([]byte) error, error) {
+		return prepare(prog, r, w, opts)
+	}
+}
+
+// forEachEngine runs test, as a subtest, with each way to run a
+// program: compiled code under each ABI, and the interpreter.
+func forEachEngine(t *testing.T, test func(t *testing.T, prepare prepareOptions)) {
+	t.Run("Compile", func(t *testing.T) {
+		forEachABI(t, func(t *testing.T) {
+			test(t, CompileOptions)
+		})
+	})
+	t.Run("Interpret", func(t *testing.T) {
+		test(t, InterpretOptions)
+	})
+}
+
+// forEachABI runs test, as a subtest, with code compiled under each
+// ABI.
+func forEachABI(t *testing.T, test func(t *testing.T)) {
+	t.Run("CgoABI", test)
+	t.Run("GoABI", func(t *testing.T) {
+		use_goabi()
+		defer reset_abi()
+		test(t)
+	})
+}
+
+func TestCompileChecked(t *testing.T) {
+	forEachABI(t, func(t *testing.T) {
+		testImplementation(t, withOptions(CompileOptions, Options{BoundsCheck: true}))
+	})
+}
+
+func TestImplementationTapes(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, opts := range []Options{
+			{BoundsCheck: true},
+			{Tape: TapeCircular},
+			{Tape: TapeGrowable},
+		} {
+			testImplementation(t, withOptions(prepare, opts))
+		}
+	})
+}
+
+func TestBoundsCheck(t *testing.T) {
+	cases := []struct {
+		prog string
+		mem  []byte
+		cell int
+	}{
+		{"<+", nil, -1},
+		{">>>>+", nil, 4},
+		{">>>>.", nil, 4},
+		{"+[>+]", nil, 4},
+		{"+[<]", nil, -1},
+		{"+[>]", []byte{1, 1, 1, 1}, 4},
+		{">>>+[<<]", []byte{1, 1, 1, 1}, -1},
+		{"+[->>>>>+<<<<<]", nil, 5},
+		{">>+[-<<<+>>>]", nil, -1},
+		{"++[->[->>>+<<<]<]", nil, 4},
+		{"+[>[-]<[-]]<+", nil, -1},
+	}
+
+	for _, tc := range cases {
+		f, e := CompileOptions([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{},
+			Options{BoundsCheck: true})
+		if e != nil {
+			t.Errorf("Compile(%s): %s", tc.prog, e.Error())
+			continue
+		}
+		// The tape is the middle of mem, between guard cells
+		// that must not change.
+		mem := make([]byte, 12)
+		for i := range mem {
+			mem[i] = 0xaa
+		}
+		tape := mem[4:8]
+		copy(tape, make([]byte, 4))
+		copy(tape, tc.mem)
+		e = f(tape)
+		re, ok := e.(*RangeError)
+		if !ok {
+			t.Errorf("Compile(%s): got %v, expect a RangeError", tc.prog, e)
+			continue
+		}
+		if re.Cell != tc.cell || re.Len != 4 {
+			t.Errorf("Compile(%s): got cell %d of %d, expect %d of 4",
+				tc.prog, re.Cell, re.Len, tc.cell)
+		}
+		for i, b := range append(mem[:4:4], mem[8:]...) {
+			if b != 0xaa {
+				t.Errorf("Compile(%s): wrote guard cell %d", tc.prog, i)
+			}
+		}
+	}
+}
+
+// TestHoistedChecks checks that compiled code stops with the error
+// the interpreter does when a loop's check is hoisted out of it.
+func TestHoistedChecks(t *testing.T) {
+	cases := []struct {
+		prog string
+		opts Options
+		err  error
+	}{
+		// The inner loops never run.
+		{"+[>[<<<.>>>[-]]<-]", Options{BoundsCheck: true}, nil},
+		{">+[>[<<<<<.>>>>>[-]]<-]", Options{BoundsCheck: true}, nil},
+		{"+[>[<<<.>>>[-]]<-]", Options{Tape: TapeGrowable, MaxTape: 8}, nil},
+		// The inner loop never ends.
+		{"+[>+[]<<.>]", Options{BoundsCheck: true, MaxSteps: 100}, ErrStepLimit},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, tc := range cases {
+			f, e := prepare([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{}, tc.opts)
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			if e := f(make([]byte, 8)); !errors.Is(e, tc.err) {
+				t.Errorf("%s, %v: got %v, expect %v", tc.prog, tc.opts, e, tc.err)
+			}
+		}
+	})
+}
+
+func TestTapes(t *testing.T) {
+	cases := []struct {
+		prog string
+		opts Options
+		mem  []byte // the tape, for TapeCircular
+		out  []byte // the output, for TapeGrowable
+		cell int    // the cell of the RangeError, if out and mem are nil
+	}{
+		{"<+", Options{Tape: TapeCircular}, []byte{0, 0, 0, 1}, nil, 0},
+		{">>>>+", Options{Tape: TapeCircular}, []byte{1, 0, 0, 0}, nil, 0},
+		{"<<<<<+>>>>>>>>>+", Options{Tape: TapeCircular}, []byte{1, 0, 0, 1}, nil, 0},
+		{"+[<]+", Options{Tape: TapeCircular}, []byte{1, 0, 0, 1}, nil, 0},
+		{"+>+<[>>>]+", Options{Tape: TapeCircular}, []byte{1, 1, 0, 1}, nil, 0},
+		{"++[->>>>>+<<<<<]", Options{Tape: TapeCircular}, []byte{0, 2, 0, 0}, nil, 0},
+		{">>>>>>>>+++.", Options{Tape: TapeGrowable}, nil, []byte{3}, 0},
+		{"++++++++++[[->+<]>-]+.", Options{Tape: TapeGrowable}, nil, []byte{1}, 0},
+		{"+[->>>>>>+<<<<<<]>>>>>>.", Options{Tape: TapeGrowable}, nil, []byte{1}, 0},
+		{"+++.>>>>>>>>>>.<<<<<<<<<<.", Options{Tape: TapeGrowable}, nil, []byte{3, 0, 3}, 0},
+		{"<+", Options{Tape: TapeGrowable}, nil, nil, -1},
+		{">>>>>>>>+", Options{Tape: TapeGrowable, MaxTape: 8}, nil, nil, 8},
+		{"+[>+]", Options{Tape: TapeGrowable, MaxTape: 100}, nil, nil, 100},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, tc := range cases {
+			var out bytes.Buffer
+			f, e := prepare([]byte(tc.prog), &bytes.Buffer{}, &out, tc.opts)
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			mem := make([]byte, 4)
+			e = f(mem)
+			if tc.mem == nil && tc.out == nil {
+				if re, ok := e.(*RangeError); !ok || re.Cell != tc.cell {
+					t.Errorf("%s: got %v, expect a RangeError at %d",
+						tc.prog, e, tc.cell)
+				}
+				continue
+			}
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			if tc.mem != nil && !bytes.Equal(mem, tc.mem) {
+				t.Errorf("%s: %v != %v (expected)", tc.prog, mem, tc.mem)
+			}
+			if tc.out != nil && !bytes.Equal(out.Bytes(), tc.out) {
+				t.Errorf("%s: output %v != %v (expected)",
+					tc.prog, out.Bytes(), tc.out)
+			}
+		}
+	})
+}
+
+// TestGrowLength checks how long a growable tape is when a program
+// goes off its left end.
+func TestGrowLength(t *testing.T) {
+	cases := []struct {
+		prog                  string
+		cell                  int
+		compiled, interpreted int // the Len of the RangeError
+	}{
+		{">>>>>+>>>>+.<<<<<<<<<<<<<<<+", -6, 16, 16},
+		{"+[>>>>>>>>>+<<<<<<<<<-]>>>+.<<<<<<<<<<+", -7, 16, 16},
+		// Compiled code checks cells 9 and -6 at once.
+		{">>>>>+.>>>>+<<<<<<<<<<<<<<<+", -6, 8, 16},
+	}
+
+	test := func(t *testing.T, prepare prepareOptions, interpreted bool) {
+		for _, tc := range cases {
+			f, e := prepare([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{}, Options{Tape: TapeGrowable})
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			n := tc.compiled
+			if interpreted {
+				n = tc.interpreted
+			}
+			if re, ok := f(make([]byte, 4)).(*RangeError); !ok || re.Cell != tc.cell || re.Len != n {
+				t.Errorf("%s: got %v, expect cell %d of %d", tc.prog, re, tc.cell, n)
+			}
+		}
+	}
+	t.Run("Compile", func(t *testing.T) {
+		forEachABI(t, func(t *testing.T) {
+			test(t, CompileOptions, false)
+		})
+	})
+	t.Run("Interpret", func(t *testing.T) {
+		test(t, InterpretOptions, true)
+	})
+}
+
+func TestCellBits(t *testing.T) {
+	cases := []struct {
+		prog  string
+		opts  Options
+		cells map[int][]uint32 // the tape by cell size, or nil
+		out   []byte
+		// If cells and out are nil, the RangeError is at cell, or
+		// at the end of the tape if end is set.
+		cell int
+		end  bool
+	}{
+		{"-", Options{}, map[int][]uint32{8: {0xff}, 16: {0xffff}, 32: {0xffffffff}}, nil, 0, false},
+		{"++++++++++++++++[>++++++++++++++++<-]>+", Options{},
+			map[int][]uint32{8: {0, 1}, 16: {0, 257}, 32: {0, 257}}, nil, 0, false},
+		{"++++++++++++++++[>++++++++++++++++<-]>[>+<-]", Options{},
+			map[int][]uint32{8: {0, 0, 0}, 16: {0, 0, 256}, 32: {0, 0, 256}}, nil, 0, false},
+		{"-[>+<-]", Options{}, map[int][]uint32{8: {0, 0xff}, 16: {0, 0xffff}, 32: {0, 0xffffffff}}, nil, 0, false},
+		{"+[>+++<+]", Options{},
+			map[int][]uint32{8: {0, 0xfd}, 16: {0, 0xfffd}, 32: {0, 0xfffffffd}}, nil, 0, false},
+		{"+>+>+<<[>]+", Options{}, map[int][]uint32{8: {1, 1, 1, 1}, 16: {1, 1, 1, 1}, 32: {1, 1, 1, 1}}, nil, 0, false},
+		{"-,>,", Options{}, map[int][]uint32{8: {7, 0}, 16: {7, 0}, 32: {7, 0}}, nil, 0, false},
+		{"++++++++++++++++[>++++++++++++++++<-]>+.", Options{}, nil, []byte{1}, 0, false},
+		{helloWorld, Options{}, nil, []byte("Hello World!\n"), 0, false},
+		{">>>>>>>>>>>>+++.", Options{Tape: TapeGrowable}, nil, []byte{3}, 0, false},
+		{"+" + strings.Repeat("<", 64) + ".<.", Options{Tape: TapeCircular}, nil, []byte{1, 0}, 0, false},
+		{"<+", Options{BoundsCheck: true}, nil, nil, -1, false},
+		{"+[>+]", Options{BoundsCheck: true}, nil, nil, 0, true},
+		{"+[>+]", Options{Tape: TapeGrowable, MaxTape: 100}, nil, nil, 100, false},
+		{"+[->+" + strings.Repeat(">", 69) + "+" + strings.Repeat("<", 70) + "]",
+			Options{BoundsCheck: true}, nil, nil, 70, false},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, bits := range []int{8, 16, 32} {
+			for _, tc := range cases {
+				opts := tc.opts
+				opts.CellBits = bits
+				var out bytes.Buffer
+				f, e := prepare([]byte(tc.prog), bytes.NewBufferString("\x07"), &out, opts)
+				if e != nil {
+					t.Errorf("%s, %d: %s", tc.prog, bits, e.Error())
+					continue
+				}
+				mem := make([]byte, 64)
+				e = f(mem)
+				if tc.cells == nil && tc.out == nil {
+					cell := tc.cell
+					if tc.end {
+						cell = len(mem) / (bits / 8)
+					}
+					if re, ok := e.(*RangeError); !ok || re.Cell != cell {
+						t.Errorf("%s, %d: got %v, expect a RangeError at %d",
+							tc.prog, bits, e, cell)
+					}
+					continue
+				}
+				if e != nil {
+					t.Errorf("%s, %d: %s", tc.prog, bits, e.Error())
+					continue
+				}
+				if want := tc.cells[bits]; want != nil {
+					got := make([]uint32, len(want))
+					for j := range got {
+						for k := 0; k < bits/8; k++ {
+							got[j] |= uint32(mem[j*bits/8+k]) << (8 * k)
+						}
+					}
+					if !reflect.DeepEqual(got, want) {
+						t.Errorf("%s, %d: %#x != %#x (expected)",
+							tc.prog, bits, got, want)
+					}
+				}
+				if tc.out != nil && !bytes.Equal(out.Bytes(), tc.out) {
+					t.Errorf("%s, %d: output %v != %v (expected)",
+						tc.prog, bits, out.Bytes(), tc.out)
+				}
+			}
+		}
+
+		for _, bits := range []int{1, 24, 64} {
+			var buf bytes.Buffer
+			if _, e := prepare([]byte("+"), &buf, &buf, Options{CellBits: bits}); e == nil {
+				t.Errorf("%d-bit cells: no error", bits)
+			}
+		}
+	})
+}
+
+func TestEOF(t *testing.T) {
+	cases := []struct {
+		eof  EOF
+		bits int
+		mem  []byte
+	}{
+		{EOFZero, 8, []byte{7, 0, 0}},
+		{EOFMinusOne, 8, []byte{7, 0xff, 0xff}},
+		{EOFUnchanged, 8, []byte{7, 5, 0xfb}},
+		{EOFZero, 16, []byte{7, 0, 0, 0, 0, 0}},
+		{EOFMinusOne, 16, []byte{7, 0, 0xff, 0xff, 0xff, 0xff}},
+		{EOFUnchanged, 32, []byte{7, 0, 0, 0, 5, 0, 0, 0, 0xfb, 0xff, 0xff, 0xff}},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, tc := range cases {
+			opts := Options{EOF: tc.eof, CellBits: tc.bits}
+			f, e := prepare([]byte("-,>+++++,>-----,"), bytes.NewBufferString("\x07"), &bytes.Buffer{}, opts)
+			if e != nil {
+				t.Errorf("%v: %s", opts, e.Error())
+				continue
+			}
+			mem := make([]byte, 16)
+			if e := f(mem); e != nil {
+				t.Errorf("%v: %s", opts, e.Error())
+				continue
+			}
+			if !bytes.Equal(mem[:len(tc.mem)], tc.mem) {
+				t.Errorf("%v: %v != %v (expected)", opts, mem, tc.mem)
+			}
+		}
+	})
+}
+
+// failWriter fails every write after the first n bytes.
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(b []byte) (int, error) {
+	if w.n <= 0 {
+		return 0, errFail
+	}
+	w.n--
+	return 1, nil
+}
+
+var errFail = errors.New("fail")
+
+func TestIOErrors(t *testing.T) {
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		cases := []struct {
+			prog string
+			r    io.Reader
+			w    io.Writer
+			opts Options
+			err  error
+		}{
+			{"+[.]", &bytes.Buffer{}, &failWriter{3}, Options{}, errFail},
+			{"+[.>]", &bytes.Buffer{}, &failWriter{0}, Options{Tape: TapeGrowable}, errFail},
+			{"+[,]", iotest.ErrReader(errFail), &bytes.Buffer{}, Options{}, errFail},
+			{"+[,+]", iotest.TimeoutReader(bytes.NewBufferString("ab")), &bytes.Buffer{}, Options{BoundsCheck: true}, iotest.ErrTimeout},
+			{"+[.,+]", iotest.ErrReader(errFail), &bytes.Buffer{}, Options{CellBits: 16, Tape: TapeCircular}, errFail},
+		}
+		for _, tc := range cases {
+			f, e := prepare([]byte(tc.prog), tc.r, tc.w, tc.opts)
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			if e := f(make([]byte, 16)); e != tc.err {
+				t.Errorf("%s: got %v, expect %v", tc.prog, e, tc.err)
+			}
+		}
+	})
+}
+
+// promptReader reads, one byte at a time, the number of bytes written
+// to w so far.
+type promptReader struct {
+	w *bytes.Buffer
+}
+
+func (r *promptReader) Read(b []byte) (int, error) {
+	b[0] = byte(r.w.Len())
+	return 1, nil
+}
+
+func TestBufferedIO(t *testing.T) {
+	in := make([]byte, 3*ioBufSize+17)
+	for i := range in {
+		in[i] = byte(i%255 + 1)
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		cases := []struct {
+			prog string
+			r    func(w *bytes.Buffer) io.Reader
+			opts Options
+			runs int
+			out  string
+		}{
+			{",[.,]", func(*bytes.Buffer) io.Reader { return bytes.NewReader(in) }, Options{}, 1, string(in)},
+			{",[.,]", func(*bytes.Buffer) io.Reader { return iotest.HalfReader(bytes.NewReader(in)) }, Options{CellBits: 32}, 1, string(in)},
+			{",[.,]", func(*bytes.Buffer) io.Reader { return iotest.OneByteReader(bytes.NewReader(in)) }, Options{BoundsCheck: true}, 1, string(in)},
+			{",[.,]", func(*bytes.Buffer) io.Reader { return bytes.NewReader(in) }, Options{Tape: TapeGrowable}, 1, string(in)},
+			// The input a run doesn't read is there for the next.
+			{",.", func(*bytes.Buffer) io.Reader { return bytes.NewBufferString("ab") }, Options{}, 2, "ab"},
+			// Output is written before reading.
+			{"+.,.,.", func(w *bytes.Buffer) io.Reader { return &promptReader{w} }, Options{}, 1, "\x01\x01\x02"},
+		}
+		for _, tc := range cases {
+			var out bytes.Buffer
+			f, e := prepare([]byte(tc.prog), tc.r(&out), &out, tc.opts)
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			for i := 0; i < tc.runs; i++ {
+				if e := f(make([]byte, 16)); e != nil {
+					t.Errorf("%s, %v: %s", tc.prog, tc.opts, e.Error())
+				}
+			}
+			if out.String() != tc.out {
+				t.Errorf("%s, %v: wrote %d bytes %.16q, expect %d bytes %.16q",
+					tc.prog, tc.opts, out.Len(), out.String(), len(tc.out), tc.out)
+			}
+		}
+	})
+}
+
+func TestSteps(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	timeout, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+
+	// twice takes 2*65534 steps in the inner loop and 1 in the
+	// outer.
+	twice := "++[>-[-.]<-]"
+	cases := []struct {
+		prog string
+		opts Options
+		err  error
+	}{
+		{"+[]", Options{MaxSteps: 1000}, ErrStepLimit},
+		{"+[]", Options{MaxSteps: 1000, BoundsCheck: true}, ErrStepLimit},
+		{"+[]", Options{MaxSteps: 1000, Tape: TapeGrowable, CellBits: 32}, ErrStepLimit},
+		{"+[>+]", Options{MaxSteps: 1000, Tape: TapeCircular}, ErrStepLimit},
+		{"+++++[-.]", Options{MaxSteps: 4}, nil},
+		{"+++++[-.]", Options{MaxSteps: 3}, ErrStepLimit},
+		{"+>+>+>+<<<[>]", Options{MaxSteps: 4, BoundsCheck: true}, nil},
+		{"+>+>+>+<<<[>]", Options{MaxSteps: 3}, ErrStepLimit},
+		{twice, Options{CellBits: 16, MaxSteps: 131069}, nil},
+		{twice, Options{CellBits: 16, MaxSteps: 131068}, ErrStepLimit},
+		{twice, Options{CellBits: 16, MaxSteps: 131069, Context: context.Background()}, nil},
+		{twice, Options{CellBits: 16, MaxSteps: 131068, Context: context.Background()}, ErrStepLimit},
+		{"+[]", Options{Context: cancelled}, context.Canceled},
+		{"+[]", Options{Context: timeout, Tape: TapeGrowable}, context.DeadlineExceeded},
+		{"+", Options{Context: cancelled}, nil},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, tc := range cases {
+			f, e := prepare([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{}, tc.opts)
+			if e != nil {
+				t.Errorf("%s: %s", tc.prog, e.Error())
+				continue
+			}
+			// Run each twice, to see that the budget starts
+			// over.
+			for i := 0; i < 2; i++ {
+				if e := f(make([]byte, 16)); !errors.Is(e, tc.err) {
+					t.Errorf("%s, %v: got %v, expect %v",
+						tc.prog, tc.opts, e, tc.err)
+				}
+			}
+		}
+	})
+}
+
+func TestSyntaxErrors(t *testing.T) {
+	cases := []struct {
+		prog string
+		pos  Pos
+		msg  string
+	}{
+		{"+\n+]", Pos{3, 2, 2}, "2:2: mismatched ]"},
+		{"[\n[]", Pos{0, 1, 1}, "1:1: extra ["},
+		{"[[\n", Pos{1, 1, 2}, "1:2: extra ["},
+		{"[]\n\n  ]]", Pos{6, 3, 3}, "3:3: mismatched ]"},
+	}
+	for _, tc := range cases {
+		_, e := Compile([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{})
+		se, ok := e.(*SyntaxError)
+		if !ok || se.Pos != tc.pos || se.Error() != tc.msg {
+			t.Errorf("Compile(%q): got %v, expect %q at %+v", tc.prog, e, tc.msg, tc.pos)
+		}
+		if _, e := Interpret([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{}); !reflect.DeepEqual(e, se) {
+			t.Errorf("Interpret(%q): got %v, expect %v", tc.prog, e, se)
+		}
+	}
+}
+
+func TestPositions(t *testing.T) {
+	cases := []struct {
+		prog string
+		opts Options
+		pos  Pos
+	}{
+		{"+++\n[.\n]", Options{MaxSteps: 1}, Pos{7, 3, 1}},
+		{"+++\n[.\n]", Options{MaxSteps: 1, BoundsCheck: true}, Pos{7, 3, 1}},
+		{"+>+<\n[>]", Options{MaxSteps: 1}, Pos{5, 2, 1}},
+		{"+.\n>>>>+", Options{BoundsCheck: true}, Pos{7, 2, 5}},
+		{"+[>+]", Options{Tape: TapeGrowable, MaxTape: 8}, Pos{3, 1, 4}},
+		{"+.\n  <+", Options{BoundsCheck: true, MaxSteps: 5}, Pos{6, 2, 4}},
+	}
+
+	forEachEngine(t, func(t *testing.T, prepare prepareOptions) {
+		for _, tc := range cases {
+			f, e := prepare([]byte(tc.prog), &bytes.Buffer{}, &bytes.Buffer{}, tc.opts)
+			if e != nil {
+				t.Errorf("%q: %s", tc.prog, e.Error())
+				continue
+			}
+			var pos Pos
+			switch e := f(make([]byte, 4)).(type) {
+			case *RangeError:
+				pos = e.Pos
+			case *RuntimeError:
+				pos = e.Pos
+			default:
+				t.Errorf("%q: got %v, expect an error at %v", tc.prog, e, tc.pos)
+				continue
+			}
+			if pos != tc.pos {
+				t.Errorf("%q: got an error at %+v, expect %+v", tc.prog, pos, tc.pos)
+			}
+		}
+	})
+
+	// A fault is at the instruction that faulted.
+	t.Run("Fault", func(t *testing.T) {
+		forEachABI(t, func(t *testing.T) {
+			f, _ := Compile([]byte("\n\n  +"), &bytes.Buffer{}, &bytes.Buffer{})
+			e := f(nil)
+			var fault *gojit.Fault
+			if re, ok := e.(*RuntimeError); !ok || !errors.As(e, &fault) || re.Pos != (Pos{4, 3, 3}) {
+				t.Errorf("Compile: got %v, expect a fault at 3:3", e)
+			}
+		})
+	})
+}
+
+func TestLineTable(t *testing.T) {
+	_, e := CompileOptions([]byte("+\n[-\n.]\n."), &bytes.Buffer{}, &bytes.Buffer{}, Options{Name: "lines.bf"})
+	if e != nil {
+		t.Fatalf("Compile: %s", e.Error())
+	}
+	var lines []int
+	for _, r := range gojit.Regions() {
+		if r.Name == "bf:lines.bf" {
+			for _, l := range r.Lines {
+				if l.File != "lines.bf" {
+					t.Errorf("line %d is in %q", l.Line, l.File)
+				}
+				lines = append(lines, l.Line)
+			}
+		}
+	}
+	if !reflect.DeepEqual(lines, []int{1, 2, 3, 4}) {
+		t.Errorf("got lines %v, expect [1 2 3 4]", lines)
+	}
+}
+
 func TestInterpret(t *testing.T) {
 	testImplementation(t, Interpret)
 }
 
 func testImplementation(t *testing.T,
-	prepare func([]byte, io.Reader, io.Writer) (func([]byte), error)) {
+	prepare func([]byte, io.Reader, io.Writer) (func([]byte) error, error)) {
 	cases := []struct {
 		prog   string
 		mem    []byte
@@ -47,6 +651,13 @@ func testImplementation(t *testing.T,
 		{"++++[>+++<-]", []byte{0, 12}, nil, nil},
 		{"+++[>+++[>+++<-]<-]", []byte{0, 0, 27}, nil, nil},
 		{">+>+[<]", []byte{0, 1, 1}, nil, nil},
+		{"+++[>+>++>-<<<-]", []byte{0, 3, 6, 0xfd}, nil, nil},
+		{"+++++>++<[->>+++<+<]", []byte{0, 7, 15}, nil, nil},
+		{"++[->+<]+>[-<+>]", []byte{3, 0}, nil, nil},
+		{"+>+>+<<[>]+", []byte{1, 1, 1, 1}, nil, nil},
+		{">>+>>+>>+[<<]+", []byte{1, 0, 1, 0, 1, 0, 1}, nil, nil},
+		{"++++[->+++<]>[->+++++++<]>", []byte{0, 0, 84}, nil, nil},
+		{"+++[>+++++<+]", []byte{0, 0xf1}, nil, nil},
 		{helloWorld, nil, nil, []byte("Hello World!\n")},
 		{dbfi, nil, []byte(helloWorld + "!"), []byte("Hello World!\n")},
 	}
@@ -67,7 +678,10 @@ func testImplementation(t *testing.T,
 		runtime.GC()
 
 		mem := make([]byte, 4096)
-		f(mem)
+		if e := f(mem); e != nil {
+			t.Errorf("Compile(%s): %s", tc.prog, e.Error())
+			continue
+		}
 		if tc.mem != nil && !bytes.Equal(mem[:len(tc.mem)], tc.mem) {
 			t.Errorf("Compile(%s): %v != %v (expected)",
 				tc.prog, mem, tc.mem)
@@ -79,25 +693,113 @@ func testImplementation(t *testing.T,
 	}
 }
 
+// withoutPos returns ops with their pos cleared, to compare with the
+// opcodes a test expects.
+func withoutPos(ops []opcode) []opcode {
+	for i := range ops {
+		ops[i].pos, ops[i].dstPos = 0, 0
+	}
+	return ops
+}
+
 func TestOptimize(t *testing.T) {
 	cases := []struct {
 		prog string
 		ops  []opcode
 	}{
-		{"+", []opcode{{'+', 1}}},
-		{"+++++", []opcode{{'+', 5}}},
-		{"++XX+++--<>+", []opcode{{'+', 5}, {'-', 2}, {'<', 1}, {'>', 1}, {'+', 1}}},
+		{"+", []opcode{{op: opAdd, arg: 1}}},
+		{"+++++", []opcode{{op: opAdd, arg: 5}}},
+		{"++XX+++--<>+", []opcode{{op: opAdd, arg: 4}}},
+		{"+-", []opcode{}},
+		{"<<.>", []opcode{{op: opMove, arg: -2}, {op: opOut}, {op: opMove, arg: 1}}},
+		{">+>+<<", []opcode{{op: opAdd, arg: 1, off: 1}, {op: opAdd, arg: 1, off: 2}}},
+		{"+>+<+>>-", []opcode{{op: opAdd, arg: 2}, {op: opAdd, arg: 1, off: 1},
+			{op: opAdd, arg: -1, off: 2}, {op: opMove, arg: 2}}},
+		{"+>+<->-", []opcode{{op: opMove, arg: 1}}},
+		{">+>[-]<<[>>+<<]", []opcode{
+			{op: opAdd, arg: 1, off: 1}, {op: opClear, off: 2},
+			{op: opLoop, jump: 4}, {op: opAdd, arg: 1, off: 2}, {op: opEnd, jump: 2}}},
+		{">>[-<+<++>>]", []opcode{
+			{op: opMul, arg: 1, off: 2, dst: 1}, {op: opMul, arg: 2, off: 2}, {op: opClear, off: 2},
+			{op: opMove, arg: 2}}},
+		{">+.>-,<[>]", []opcode{
+			{op: opAdd, arg: 1, off: 1}, {op: opMove, arg: 1}, {op: opOut},
+			{op: opAdd, arg: -1, off: 1}, {op: opMove, arg: 1}, {op: opIn},
+			{op: opMove, arg: -1}, {op: opScan, arg: 1}}},
+		{"[-]", []opcode{{op: opClear}}},
+		{"[+]", []opcode{{op: opClear}}},
+		{"[->+<]", []opcode{{op: opMul, arg: 1, dst: 1}, {op: opClear}}},
+		{"[>+<-]", []opcode{{op: opMul, arg: 1, dst: 1}, {op: opClear}}},
+		{"[->++>+++<<]", []opcode{
+			{op: opMul, arg: 2, dst: 1}, {op: opMul, arg: 3, dst: 2}, {op: opClear}}},
+		{"[<->+]", []opcode{{op: opMul, arg: 1, dst: -1}, {op: opClear}}},
+		{"[>]", []opcode{{op: opScan, arg: 1}}},
+		{"[<<]", []opcode{{op: opScan, arg: -2}}},
+		{"[-[-]>]", []opcode{
+			{op: opLoop, jump: 4}, {op: opAdd, arg: -1}, {op: opClear},
+			{op: opMove, arg: 1}, {op: opEnd, jump: 0}}},
+		{"[->+>]", []opcode{
+			{op: opLoop, jump: 4}, {op: opAdd, arg: -1}, {op: opAdd, arg: 1, off: 1},
+			{op: opMove, arg: 2}, {op: opEnd, jump: 0}}},
+		{"[--]", []opcode{{op: opLoop, jump: 2}, {op: opAdd, arg: -2}, {op: opEnd, jump: 0}}},
 	}
 
 	for _, tc := range cases {
-		got, _ := optimize([]byte(tc.prog))
-		if !reflect.DeepEqual(got, tc.ops) {
+		got, _ := optimize([]byte(tc.prog), Options{})
+		if !reflect.DeepEqual(withoutPos(got), tc.ops) {
 			t.Errorf("Optimize(%s): got %v, expect %v",
 				tc.prog, got, tc.ops)
 		}
 	}
 }
 
+func TestChecks(t *testing.T) {
+	cases := []struct {
+		prog string
+		ops  []opcode
+	}{
+		{"+>+>+", []opcode{
+			{op: opCheck, dst: 2}, {op: opAdd, arg: 1}, {op: opAdd, arg: 1, off: 1},
+			{op: opAdd, arg: 1, off: 2}, {op: opMove, arg: 2}}},
+		{"<.>>.", []opcode{
+			{op: opMove, arg: -1}, {op: opCheck}, {op: opOut},
+			{op: opMove, arg: 2}, {op: opCheck}, {op: opOut}}},
+		{"[>]+", []opcode{
+			{op: opCheck}, {op: opScan, arg: 1}, {op: opCheck}, {op: opAdd, arg: 1}}},
+		{"[-<.>>>-<<]", []opcode{
+			{op: opCheck}, {op: opLoop, jump: 8}, {op: opCheck, arg: 1, off: -1, dst: 2},
+			{op: opAdd, arg: -1}, {op: opMove, arg: -1}, {op: opOut},
+			{op: opAdd, arg: -1, off: 3}, {op: opMove, arg: 1}, {op: opEnd, jump: 2}}},
+		{"[->[-<+>>]<]", []opcode{
+			{op: opCheck}, {op: opLoop, jump: 15}, {op: opCheck}, {op: opAdd, arg: -1},
+			{op: opMove, arg: 1}, {op: opCheck}, {op: opLoop, jump: 12},
+			{op: opCheck, off: -1}, {op: opAdd, arg: -1}, {op: opAdd, arg: 1, off: -1},
+			{op: opMove, arg: 1}, {op: opCheck}, {op: opEnd, jump: 6},
+			{op: opMove, arg: -1}, {op: opCheck}, {op: opEnd, jump: 1}}},
+		{"[->[-.]<]", []opcode{
+			{op: opCheck}, {op: opLoop, jump: 11}, {op: opCheck, arg: 1, dst: 1},
+			{op: opAdd, arg: -1}, {op: opMove, arg: 1}, {op: opLoop, jump: 9},
+			{op: opCheck, arg: 1}, {op: opAdd, arg: -1}, {op: opOut}, {op: opEnd, jump: 6},
+			{op: opMove, arg: -1}, {op: opEnd, jump: 2}}},
+		{"[>[-.]<<.>]", []opcode{
+			{op: opCheck}, {op: opLoop, jump: 13}, {op: opCheck, arg: 1, dst: 1},
+			{op: opMove, arg: 1}, {op: opLoop, jump: 8}, {op: opCheck, arg: 1},
+			{op: opAdd, arg: -1}, {op: opOut}, {op: opEnd, jump: 5},
+			{op: opMove, arg: -2}, {op: opCheck}, {op: opOut},
+			{op: opMove, arg: 1}, {op: opEnd, jump: 2}}},
+	}
+
+	for _, tc := range cases {
+		got, _ := optimize([]byte(tc.prog), Options{})
+		got = addChecks(got)
+		link(got)
+		if !reflect.DeepEqual(withoutPos(got), tc.ops) {
+			t.Errorf("addChecks(%s): got %v, expect %v",
+				tc.prog, got, tc.ops)
+		}
+	}
+}
+
 func TestGC(t *testing.T) {
 	var rw bytes.Buffer
 	prog, e := Compile([]byte(helloWorld), &rw, &rw)
@@ -111,7 +813,23 @@ func TestGC(t *testing.T) {
 		runtime.ReadMemStats(&m)
 
 		mem := make([]byte, 2048)
-		prog(mem)
+		if e := prog(mem); e != nil {
+			t.Fatalf("running: %s", e.Error())
+		}
+	}
+}
+
+// TestRelease compiles more programs than can be guarded at once,
+// which only works if each is released once it is unreachable.
+func TestRelease(t *testing.T) {
+	for i := 0; i < 20000; i++ {
+		f, e := Compile([]byte("+."), &bytes.Buffer{}, &bytes.Buffer{})
+		if e != nil {
+			t.Fatalf("Compile %d: %s", i, e.Error())
+		}
+		if e := f(make([]byte, 1)); e != nil {
+			t.Fatalf("running %d: %s", i, e.Error())
+		}
 	}
 }
 
@@ -123,7 +841,7 @@ func BenchmarkCompileHello(b *testing.B) {
 }
 
 func benchmark(b *testing.B,
-	prepare func([]byte, io.Reader, io.Writer) (func([]byte), error),
+	prepare func([]byte, io.Reader, io.Writer) (func([]byte) error, error),
 	code, in []byte) {
 
 	var r bytes.Buffer
@@ -180,6 +898,69 @@ func BenchmarkCompiledDbfiHelloCgo(b *testing.B) {
 	benchmark(b, Compile, []byte(dbfi), []byte(helloWorld+"!"))
 }
 
+// The Read and Write benchmarks show the cost of `,' and `.' alone.
+
+// writeLoops writes 4096 bytes.
+var writeLoops = "++++++++++++++++[>++++++++++++++++[>++++++++++++++++[>.<-]<-]<-]"
+
+func BenchmarkCompiledRead(b *testing.B) {
+	use_goabi()
+	defer reset_abi()
+	benchmark(b, Compile, []byte(",[,]"), bytes.Repeat([]byte(helloWorld), 64))
+}
+
+func BenchmarkCompiledReadCgo(b *testing.B) {
+	benchmark(b, Compile, []byte(",[,]"), bytes.Repeat([]byte(helloWorld), 64))
+}
+
+func BenchmarkInterpretRead(b *testing.B) {
+	benchmark(b, Interpret, []byte(",[,]"), bytes.Repeat([]byte(helloWorld), 64))
+}
+
+func BenchmarkCompiledWrite(b *testing.B) {
+	use_goabi()
+	defer reset_abi()
+	benchmark(b, Compile, []byte(writeLoops), nil)
+}
+
+func BenchmarkCompiledWriteCgo(b *testing.B) {
+	benchmark(b, Compile, []byte(writeLoops), nil)
+}
+
+func BenchmarkInterpretWrite(b *testing.B) {
+	benchmark(b, Interpret, []byte(writeLoops), nil)
+}
+
 func BenchmarkInterpretDbfiHello(b *testing.B) {
 	benchmark(b, Interpret, []byte(dbfi), []byte(helloWorld+"!"))
 }
+
+// The NoIdioms benchmarks show what recognizing loop idioms buys.
+// dbfi's compiled time is mostly spent calling back into Go for `,'
+// and `.', so nestedLoops, which does no I/O, shows it better.
+
+var nestedLoops = ">+++++++[<++++++++++>-]<[>++++++++++[>++++++++++[>[-]+++[->++<]>[-<+>]<<-]<-]<-]"
+
+func BenchmarkCompiledLoops(b *testing.B) {
+	benchmark(b, Compile, []byte(nestedLoops), nil)
+}
+
+func BenchmarkCompiledLoopsNoIdioms(b *testing.B) {
+	idioms = false
+	defer func() { idioms = true }()
+	benchmark(b, Compile, []byte(nestedLoops), nil)
+}
+
+func BenchmarkCompiledDbfiHelloNoIdioms(b *testing.B) {
+	use_goabi()
+	defer reset_abi()
+	idioms = false
+	defer func() { idioms = true }()
+	benchmark(b, Compile, []byte(dbfi), []byte(helloWorld+"!"))
+}
+
+func BenchmarkInterpretDbfiHelloNoIdioms(b *testing.B) {
+	idioms = false
+	defer func() { idioms = true }()
+	benchmark(b, Interpret, []byte(dbfi), []byte(helloWorld+"!"))
+}
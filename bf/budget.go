@@ -0,0 +1,74 @@
+package bf
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrStepLimit is the error from a program that would take more steps
+// than Options.MaxSteps.
+var ErrStepLimit = errors.New("bf: step limit reached")
+
+// tickSteps is how many steps a program with a Context takes between
+// checks that it is not done.
+const tickSteps = 1 << 16
+
+// A budget counts down the steps a program has left. They are handed
+// out in slices, which compiled code counts down in place, calling
+// back into Go to tick only between slices.
+type budget struct {
+	n    uint64 // the steps left in this slice
+	left int    // the steps left after this slice, or -1 for no limit
+	max  int
+	ctx  context.Context
+}
+
+// newBudget returns the budget for a program run with opts, or nil
+// if it needs none.
+func newBudget(opts Options) *budget {
+	if opts.MaxSteps <= 0 && opts.Context == nil {
+		return nil
+	}
+	b := &budget{max: opts.MaxSteps, ctx: opts.Context}
+	b.reset()
+	return b
+}
+
+// reset sets b up for a new run.
+func (b *budget) reset() {
+	b.n, b.left = 0, b.max
+	if b.left <= 0 {
+		b.left = -1
+	}
+}
+
+// step takes a step, or returns why the program may take no more.
+func (b *budget) step() error {
+	if b.n > 0 {
+		b.n--
+		return nil
+	}
+	return b.tick()
+}
+
+// tick starts the next slice, taking a step from it, or returns why
+// the program may take no more steps.
+func (b *budget) tick() error {
+	if b.ctx != nil {
+		if e := b.ctx.Err(); e != nil {
+			return e
+		}
+	}
+	n := b.left
+	if n == 0 {
+		return ErrStepLimit
+	}
+	if n < 0 || (b.ctx != nil && n > tickSteps) {
+		n = tickSteps
+	}
+	if b.left > 0 {
+		b.left -= n
+	}
+	b.n = uint64(n - 1)
+	return nil
+}
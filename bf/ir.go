@@ -0,0 +1,478 @@
+package bf
+
+import (
+	"fmt"
+	"sort"
+)
+
+// The intermediate representation shared by Compile, Interpret and
+// WriteExecutable is a list of opcodes. optimize parses a program
+// into it, folding runs of `+-' and `<>', rewrites loops it
+// recognizes into straight-line code, and then folds pointer moves
+// into the offsets of the cells each opcode works on.
+
+type op byte
+
+// The cell an opcode works on is the one off cells from the head.
+const (
+	opAdd   op = iota // add arg to the cell
+	opMove            // move the head arg cells
+	opOut             // `.'
+	opIn              // `,'
+	opLoop            // `['; jump is the index of the matching opEnd
+	opEnd             // `]'; jump is where its loop's body starts; see link
+	opClear           // zero the cell
+	opMul             // add arg times the cell to the cell dst cells from the head
+	opScan            // move the head arg cells at a time until the cell is zero
+	opCheck           // check that the cells off through dst are on the tape
+)
+
+var opNames = []string{"add", "move", "out", "in", "loop", "end", "clear", "mul", "scan", "check"}
+
+func (o op) String() string {
+	return opNames[o]
+}
+
+type opcode struct {
+	op   op
+	arg  int
+	off  int
+	dst  int
+	jump int
+	pos  int // the offset in the source of the instruction it came from
+
+	// dstPos is, for opCheck, the pos of the opcode that uses
+	// the cell dst; pos is that of the one that uses off.
+	dstPos int
+}
+
+func (o opcode) String() string {
+	switch o.op {
+	case opAdd:
+		return fmt.Sprintf("add %d, [%d]", o.arg, o.off)
+	case opMove, opScan:
+		return fmt.Sprintf("%s %d", o.op, o.arg)
+	case opMul:
+		return fmt.Sprintf("mul %d, [%d], [%d]", o.arg, o.off, o.dst)
+	case opLoop, opEnd:
+		return fmt.Sprintf("%s %d", o.op, o.jump)
+	case opCheck:
+		if o.arg != 0 {
+			return fmt.Sprintf("check [%d], [%d] hoisted", o.off, o.dst)
+		}
+		return fmt.Sprintf("check [%d], [%d]", o.off, o.dst)
+	}
+	return fmt.Sprintf("%s [%d]", o.op, o.off)
+}
+
+// idioms controls whether optimize recognizes loop idioms; the
+// benchmarks turn it off for comparison.
+var idioms = true
+
+// optimize returns the IR for prog, to run with opts. On a circular
+// tape, a cell at an offset from the head may have wrapped around, so
+// there every opcode but opMove works on the head's cell.
+func optimize(prog []byte, opts Options) ([]opcode, error) {
+	ops, e := parse(prog)
+	if e != nil {
+		return nil, e
+	}
+	wrap := opts.Tape == TapeCircular
+	if idioms {
+		ops = rewriteLoops(ops, !wrap)
+	}
+	if !wrap {
+		ops = foldOffsets(ops)
+	}
+	link(ops)
+	return ops, nil
+}
+
+// A Pos is a position in the source of a program.
+type Pos struct {
+	Offset int // the byte offset, from 0
+	Line   int // from 1
+	Column int // the byte in the line, from 1
+}
+
+// IsValid returns whether p is a position, rather than the zero Pos.
+func (p Pos) IsValid() bool {
+	return p.Line > 0
+}
+
+func (p Pos) String() string {
+	return fmt.Sprintf("%d:%d", p.Line, p.Column)
+}
+
+// A lineTable has the offset at which each line of a source starts.
+type lineTable []int
+
+func newLineTable(src []byte) lineTable {
+	t := lineTable{0}
+	for i, b := range src {
+		if b == '\n' {
+			t = append(t, i+1)
+		}
+	}
+	return t
+}
+
+// pos returns the Pos of the byte at off.
+func (t lineTable) pos(off int) Pos {
+	i := sort.SearchInts(t, off+1) - 1
+	return Pos{off, i + 1, off - t[i] + 1}
+}
+
+// A SyntaxError is the error from a program with a `[' or `]' that
+// doesn't match.
+type SyntaxError struct {
+	Pos Pos
+	Msg string
+}
+
+func (e *SyntaxError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// parse translates prog to opcodes, folding adjacent `+' and `-',
+// and `<' and `>', and dropping runs that cancel out.
+func parse(prog []byte) ([]opcode, error) {
+	out := make([]opcode, 0, len(prog)/4)
+	var open []int // the offsets of the unmatched `['s
+	for i, b := range prog {
+		var o opcode
+		switch b {
+		case '+':
+			o = opcode{op: opAdd, arg: 1}
+		case '-':
+			o = opcode{op: opAdd, arg: -1}
+		case '>':
+			o = opcode{op: opMove, arg: 1}
+		case '<':
+			o = opcode{op: opMove, arg: -1}
+		case '.':
+			o = opcode{op: opOut}
+		case ',':
+			o = opcode{op: opIn}
+		case '[':
+			open = append(open, i)
+			o = opcode{op: opLoop}
+		case ']':
+			if len(open) == 0 {
+				return nil, &SyntaxError{newLineTable(prog).pos(i), "mismatched ]"}
+			}
+			open = open[:len(open)-1]
+			o = opcode{op: opEnd}
+		default:
+			continue
+		}
+		o.pos = i
+
+		if n := len(out); n > 0 && (o.op == opAdd || o.op == opMove) && out[n-1].op == o.op {
+			out[n-1].arg += o.arg
+			if out[n-1].arg == 0 {
+				out = out[:n-1]
+			}
+			continue
+		}
+		out = append(out, o)
+	}
+
+	if n := len(open); n != 0 {
+		return nil, &SyntaxError{newLineTable(prog).pos(open[n-1]), "extra ["}
+	}
+
+	return out, nil
+}
+
+// rewriteLoops replaces each innermost loop that is an idiom with
+// straight-line code:
+//
+//    [-] and [+]              clear
+//    [->+<], [->++>+++<<] ... mul for each other cell touched, then clear
+//    [>], [<<] ...            scan
+//
+// The mul idiom is only used if muls is set.
+func rewriteLoops(ops []opcode, muls bool) []opcode {
+	out := make([]opcode, 0, len(ops))
+	start := -1
+	for _, o := range ops {
+		out = append(out, o)
+		switch o.op {
+		case opLoop:
+			start = len(out) - 1
+		case opEnd:
+			if start >= 0 {
+				if r, ok := rewriteLoop(out[start+1:len(out)-1], muls); ok {
+					for i := range r {
+						r[i].pos = out[start].pos
+					}
+					out = append(out[:start], r...)
+				}
+			}
+			start = -1
+		case opAdd, opMove:
+		default:
+			// Only loops of nothing but adds and moves
+			// are idioms.
+			start = -1
+		}
+	}
+	return out
+}
+
+// rewriteLoop returns the replacement for a loop with the given body,
+// which has only opAdd and opMove, or false if it isn't an idiom.
+func rewriteLoop(body []opcode, muls bool) ([]opcode, bool) {
+	if len(body) == 1 {
+		switch o := body[0]; {
+		case o.op == opAdd && (o.arg == 1 || o.arg == -1):
+			return []opcode{{op: opClear}}, true
+		case o.op == opMove:
+			return []opcode{{op: opScan, arg: o.arg}}, true
+		}
+	}
+	if !muls {
+		return nil, false
+	}
+
+	// Sum the changes to each cell, relative to the head on entry.
+	head := 0
+	deltas := make(map[int]int)
+	var offs []int
+	for _, o := range body {
+		if o.op == opMove {
+			head += o.arg
+			continue
+		}
+		if _, ok := deltas[head]; !ok {
+			offs = append(offs, head)
+		}
+		deltas[head] += o.arg
+	}
+	// The loop must end where it started, and count the cell down
+	// or up by one, so it runs cell or -cell times.
+	step := deltas[0]
+	if head != 0 || (step != 1 && step != -1) {
+		return nil, false
+	}
+
+	var out []opcode
+	for _, off := range offs {
+		if off != 0 && deltas[off] != 0 {
+			out = append(out, opcode{op: opMul, arg: -step * deltas[off], dst: off})
+		}
+	}
+	return append(out, opcode{op: opClear}), true
+}
+
+// foldOffsets delays each opMove until the next opcode that needs the
+// head where the program has it: a loop, I/O or a scan. Opcodes in
+// between address their cells relative to the head as it was before
+// the moves. Adds to the same cell with only other adds between them
+// are merged.
+func foldOffsets(ops []opcode) []opcode {
+	out := make([]opcode, 0, len(ops))
+	pending, pendingPos := 0, 0
+	for _, o := range ops {
+		switch o.op {
+		case opMove:
+			if pending == 0 {
+				pendingPos = o.pos
+			}
+			pending += o.arg
+			continue
+		case opAdd:
+			o.off += pending
+			var merged bool
+			if out, merged = mergeAdd(out, o); merged {
+				continue
+			}
+		case opClear:
+			o.off += pending
+		case opMul:
+			o.off += pending
+			o.dst += pending
+		default:
+			if pending != 0 {
+				out = append(out, opcode{op: opMove, arg: pending, pos: pendingPos})
+				pending = 0
+			}
+		}
+		out = append(out, o)
+	}
+	if pending != 0 {
+		out = append(out, opcode{op: opMove, arg: pending, pos: pendingPos})
+	}
+	return out
+}
+
+// mergeAdd adds o into an opAdd to the same cell in the run of opAdds
+// at the end of out, if there is one, dropping it if they cancel out.
+func mergeAdd(out []opcode, o opcode) ([]opcode, bool) {
+	for i := len(out) - 1; i >= 0 && out[i].op == opAdd; i-- {
+		if out[i].off == o.off {
+			out[i].arg += o.arg
+			if out[i].arg == 0 {
+				out = append(out[:i], out[i+1:]...)
+			}
+			return out, true
+		}
+	}
+	return out, false
+}
+
+// balancedLoops returns whether each loop, by the index of its
+// opLoop, leaves the head where it found it on every iteration: it
+// has no scans, the moves in its body add up to zero, and the loops
+// in its body are balanced.
+func balancedLoops(ops []opcode) map[int]bool {
+	type loop struct {
+		start, move int
+		ok          bool
+	}
+	balanced := make(map[int]bool)
+	var stack []loop
+	for i, o := range ops {
+		switch o.op {
+		case opLoop:
+			stack = append(stack, loop{i, 0, true})
+		case opMove:
+			if len(stack) > 0 {
+				stack[len(stack)-1].move += o.arg
+			}
+		case opScan:
+			for j := range stack {
+				stack[j].ok = false
+			}
+		case opEnd:
+			l := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			balanced[l.start] = l.ok && l.move == 0
+			if !balanced[l.start] && len(stack) > 0 {
+				stack[len(stack)-1].ok = false
+			}
+		}
+	}
+	return balanced
+}
+
+// addChecks inserts an opCheck ahead of the opcodes that use cells
+// between each move of the head, covering the cells they use. The
+// body of a balanced loop uses the same cells on every iteration, so
+// instead gets a single check, with arg set, that runs once on entry
+// to the loop. It covers the cells the body uses up to the end of its
+// first inner loop; since the inner loop may not run, or may never
+// end, its body has its own check, and the cells the outer body uses
+// after it that the entry check doesn't cover are checked each time
+// round. An opScan checks each cell it visits itself.
+//
+// A program that goes off the tape may so fail a few opcodes before
+// it gets to the cell that is off the tape.
+func addChecks(ops []opcode) []opcode {
+	balanced := balancedLoops(ops)
+
+	type level struct {
+		hoist bool
+		entry int  // if hoist, the index in out of the entry check
+		shift int  // if hoist, how far the head has moved since entry
+		late  bool // if hoist, whether an inner loop has ended
+		check int  // the index in out of the current opCheck, or -1
+	}
+	out := make([]opcode, 0, len(ops)+len(ops)/4)
+	levels := []*level{{check: -1}}
+	cur := levels[0]
+
+	// widen widens the check at i to cover the cell off.
+	widen := func(i, off, pos int) {
+		c := &out[i]
+		if off < c.off {
+			c.off, c.pos = off, pos
+		}
+		if off > c.dst {
+			c.dst, c.dstPos = off, pos
+		}
+	}
+	// use adds the cell off to the current check, or starts one
+	// ahead of the opcode at pos.
+	use := func(off, pos int) {
+		if cur.hoist {
+			c, e := out[cur.entry], off+cur.shift
+			if !cur.late {
+				widen(cur.entry, e, pos)
+				return
+			}
+			if e >= c.off && e <= c.dst {
+				return
+			}
+		}
+		if cur.check < 0 {
+			out = append(out, opcode{op: opCheck, off: off, dst: off, pos: pos, dstPos: pos})
+			cur.check = len(out) - 1
+			return
+		}
+		widen(cur.check, off, pos)
+	}
+
+	for i, o := range ops {
+		switch o.op {
+		case opAdd, opClear, opOut, opIn:
+			use(o.off, o.pos)
+		case opMul:
+			use(o.off, o.pos)
+			use(o.dst, o.pos)
+		case opMove:
+			if cur.hoist {
+				cur.shift += o.arg
+			}
+			cur.check = -1
+		case opScan:
+			use(0, o.pos)
+			cur.check = -1
+		case opLoop:
+			use(0, o.pos)
+			out = append(out, o)
+			l := &level{check: -1}
+			if balanced[i] {
+				out = append(out, opcode{op: opCheck, arg: 1, pos: o.pos, dstPos: o.pos})
+				l.hoist, l.entry = true, len(out)-1
+			}
+			levels = append(levels, l)
+			cur = l
+			continue
+		case opEnd:
+			use(0, o.pos)
+			out = append(out, o)
+			levels = levels[:len(levels)-1]
+			cur = levels[len(levels)-1]
+			cur.check = -1
+			if cur.hoist {
+				cur.late = true
+			}
+			continue
+		}
+		out = append(out, o)
+	}
+	return out
+}
+
+// link sets jump for each opLoop to the index of its matching opEnd,
+// and for each opEnd to the index of the opcode after which its loop
+// body starts: the opLoop, or the opLoop's hoisted opCheck.
+func link(ops []opcode) {
+	var stack []int
+	for i := range ops {
+		switch ops[i].op {
+		case opLoop:
+			stack = append(stack, i)
+		case opEnd:
+			start := stack[len(stack)-1]
+			stack = stack[:len(stack)-1]
+			ops[start].jump = i
+			ops[i].jump = start
+			if next := ops[start+1]; next.op == opCheck && next.arg != 0 {
+				ops[i].jump = start + 1
+			}
+		}
+	}
+}
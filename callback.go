@@ -0,0 +1,87 @@
+package gojit
+
+import (
+	"reflect"
+	"sync"
+	"unsafe"
+
+	"github.com/nelhage/gojit/cgo"
+)
+
+type callback struct {
+	fn    reflect.Value
+	frame *frame
+	code  uintptr
+}
+
+var callbacks struct {
+	sync.RWMutex
+	next uintptr
+	m    map[uintptr]*callback
+}
+
+func init() {
+	callbacks.m = make(map[uintptr]*callback)
+	cgo.Callback = invokeCallback
+}
+
+// RegisterCallback makes the Go function f callable from the JIT'd
+// code in b, and returns a handle identifying it. JIT'd code invokes
+// a callback by calling the C function at CgoCallbackAddr with the
+// handle and a pointer to a 6c-layout frame (see BuildTo) holding
+// f's arguments and result slots.
+//
+// The registration is dropped when b is passed to Release.
+func RegisterCallback(b []byte, f interface{}) uintptr {
+	fn := reflect.ValueOf(f)
+	if fn.Kind() != reflect.Func {
+		panic("RegisterCallback: must pass a func")
+	}
+	cb := &callback{fn, newFrame(fn.Type()), Addr(b)}
+
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	callbacks.next++
+	callbacks.m[callbacks.next] = cb
+	return callbacks.next
+}
+
+// CgoCallbackAddr returns the address of the C function
+//
+//     void gojitCallback(uintptr_t handle, void *frame);
+//
+// which JIT'd code calls to invoke a callback registered with
+// RegisterCallback.
+func CgoCallbackAddr() uintptr {
+	return cgo.CallbackAddr()
+}
+
+func releaseCallbacks(b []byte) {
+	start, end := Addr(b), Addr(b)+uintptr(len(b))
+
+	callbacks.Lock()
+	defer callbacks.Unlock()
+	for h, cb := range callbacks.m {
+		if cb.code >= start && cb.code < end {
+			delete(callbacks.m, h)
+		}
+	}
+}
+
+func invokeCallback(handle uintptr, p unsafe.Pointer) {
+	callbacks.RLock()
+	cb := callbacks.m[handle]
+	callbacks.RUnlock()
+	if cb == nil {
+		panic("gojit: call to unregistered callback")
+	}
+
+	frame := cb.frame.at(p)
+	args := make([]reflect.Value, len(cb.frame.in))
+	for i, j := range cb.frame.in {
+		args[i] = frame.Field(j)
+	}
+	for i, r := range cb.fn.Call(args) {
+		frame.Field(cb.frame.out[i]).Set(r)
+	}
+}
@@ -0,0 +1,42 @@
+// Package cgo contains the C glue gojit uses to enter JIT'd code
+// through the cgo runtime, to call back out of it into Go, and to
+// catch hardware faults raised by it.
+//
+// Importing it also makes sure the cgo runtime is linked into the
+// binary, which the callback path relies on.
+package cgo
+
+// #include "gojit.h"
+import "C"
+
+import "unsafe"
+
+// A Fault records a hardware fault caught in a guarded region. Sig
+// is zero if no fault occurred.
+type Fault struct {
+	Sig      int
+	PC, Addr uintptr
+}
+
+// Call calls the C-ABI function at code, passing frame as its only
+// argument. If the code faults inside a guarded region, Call returns
+// early and reports the fault.
+//
+// frame may point into the Go heap, as long as it follows the rules
+// for passing Go pointers to C: the memory it points to must not hold
+// unpinned Go pointers.
+func Call(code uintptr, frame unsafe.Pointer) Fault {
+	var f C.struct_gojit_fault
+	C.gojit_call(C.uintptr_t(code), frame, &f)
+	return Fault{int(f.sig), uintptr(f.pc), uintptr(f.addr)}
+}
+
+// CallbackAddr returns the address of a C function with the
+// prototype
+//
+//     void gojitCallback(uintptr_t handle, void *frame);
+//
+// which calls into Go by way of Callback.
+func CallbackAddr() uintptr {
+	return uintptr(C.gojit_callback_addr())
+}
@@ -0,0 +1,14 @@
+package cgo
+
+import "C"
+
+import "unsafe"
+
+// Callback is invoked, on the calling goroutine, whenever C code
+// calls the function at CallbackAddr. It is set by package gojit.
+var Callback func(handle uintptr, frame unsafe.Pointer)
+
+//export gojitCallback
+func gojitCallback(handle uintptr, frame unsafe.Pointer) {
+	Callback(handle, frame)
+}
@@ -1,3 +0,0 @@
-package cgo
-
-import "C"
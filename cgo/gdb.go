@@ -0,0 +1,42 @@
+package cgo
+
+// #include "gojit.h"
+import "C"
+
+import (
+	"errors"
+	"unsafe"
+)
+
+// GDBRegister hands a copy of image, an in-memory ELF object
+// describing some JIT'd code, to gdb through its JIT compilation
+// interface. It returns a handle for GDBUnregister.
+func GDBRegister(image []byte) (uintptr, error) {
+	if len(image) == 0 {
+		return 0, errors.New("gojit: empty debug image")
+	}
+	h := C.gojit_gdb_register(unsafe.Pointer(&image[0]), C.uint64_t(len(image)))
+	if h == 0 {
+		return 0, errors.New("gojit: out of memory registering debug image")
+	}
+	return uintptr(h), nil
+}
+
+// GDBUnregister withdraws an image registered by GDBRegister.
+func GDBUnregister(h uintptr) {
+	C.gojit_gdb_unregister(C.uintptr_t(h))
+}
+
+// GDBImages returns copies of the images currently registered with
+// gdb, most recent first.
+func GDBImages() [][]byte {
+	const max = 1024
+	images := make([]*C.char, max)
+	sizes := make([]C.uint64_t, max)
+	n := C.gojit_gdb_entries(&images[0], &sizes[0], max)
+	out := make([][]byte, n)
+	for i := range out {
+		out[i] = C.GoBytes(unsafe.Pointer(images[i]), C.int(sizes[i]))
+	}
+	return out
+}
@@ -0,0 +1,311 @@
+#define _GNU_SOURCE
+#include <pthread.h>
+#include <setjmp.h>
+#include <signal.h>
+#include <stdlib.h>
+#include <string.h>
+#include <ucontext.h>
+
+#include "gojit.h"
+
+extern void gojitCallback(uintptr_t handle, void *frame);
+
+uintptr_t gojit_callback_addr(void) {
+	return (uintptr_t)&gojitCallback;
+}
+
+// A table of address ranges, which the signal handler reads without
+// locking. Writers hold table_lock, and never reuse a slot without
+// first clearing its end.
+#define TABLE_SIZE 16384
+
+struct range {
+	uintptr_t start;
+	uintptr_t end;
+};
+
+struct table {
+	struct range r[TABLE_SIZE];
+};
+
+static pthread_mutex_t table_lock = PTHREAD_MUTEX_INITIALIZER;
+static struct table regions;
+static struct table stacks;
+
+static int table_add(struct table *t, uintptr_t start, uintptr_t end) {
+	int i, ok = -1;
+	pthread_mutex_lock(&table_lock);
+	for (i = 0; i < TABLE_SIZE; i++) {
+		if (__atomic_load_n(&t->r[i].end, __ATOMIC_RELAXED) == 0) {
+			__atomic_store_n(&t->r[i].start, start, __ATOMIC_RELAXED);
+			__atomic_store_n(&t->r[i].end, end, __ATOMIC_RELEASE);
+			ok = 0;
+			break;
+		}
+	}
+	pthread_mutex_unlock(&table_lock);
+	return ok;
+}
+
+static void table_remove(struct table *t, uintptr_t start) {
+	int i;
+	pthread_mutex_lock(&table_lock);
+	for (i = 0; i < TABLE_SIZE; i++) {
+		if (__atomic_load_n(&t->r[i].end, __ATOMIC_RELAXED) != 0 &&
+		    __atomic_load_n(&t->r[i].start, __ATOMIC_RELAXED) == start) {
+			__atomic_store_n(&t->r[i].end, 0, __ATOMIC_RELEASE);
+			break;
+		}
+	}
+	pthread_mutex_unlock(&table_lock);
+}
+
+static int table_contains(struct table *t, uintptr_t addr) {
+	int i;
+	for (i = 0; i < TABLE_SIZE; i++) {
+		uintptr_t end = __atomic_load_n(&t->r[i].end, __ATOMIC_ACQUIRE);
+		if (end != 0 && t->r[i].start <= addr && addr < end)
+			return 1;
+	}
+	return 0;
+}
+
+int gojit_region_add(uintptr_t start, uintptr_t end) {
+	return table_add(&regions, start, end);
+}
+
+void gojit_region_remove(uintptr_t start) {
+	table_remove(&regions, start);
+}
+
+int gojit_stack_add(uintptr_t base) {
+	return table_add(&stacks, base, base + GOJIT_STACK_SIZE);
+}
+
+void gojit_stack_remove(uintptr_t base) {
+	table_remove(&stacks, base);
+}
+
+// Every call made by gojit_call pushes a guard, so that a fault in
+// code it (transitively) runs on this thread's C stack can be
+// unwound back to it. A Go panic out of a callback can leave stale
+// guards behind, but only ever below a live one.
+struct guard {
+	sigjmp_buf jb;
+	struct guard *prev;
+	struct gojit_fault *fault;
+};
+
+static __thread struct guard *cur_guard;
+
+void gojit_call(uintptr_t code, void *frame, struct gojit_fault *fault) {
+	struct guard g;
+	g.prev = cur_guard;
+	g.fault = fault;
+	fault->sig = 0;
+	if (sigsetjmp(g.jb, 0) == 0) {
+		cur_guard = &g;
+		((void (*)(void *))code)(frame);
+	}
+	cur_guard = g.prev;
+}
+
+#if defined(__APPLE__)
+#define UC_PC(uc) ((uc)->uc_mcontext->__ss.__rip)
+#define UC_SP(uc) ((uc)->uc_mcontext->__ss.__rsp)
+#else
+#define UC_PC(uc) ((uc)->uc_mcontext.gregs[REG_RIP])
+#define UC_SP(uc) ((uc)->uc_mcontext.gregs[REG_RSP])
+#endif
+
+static const int guarded_signals[] = {SIGSEGV, SIGBUS, SIGILL, SIGFPE};
+#define NGUARDED (sizeof(guarded_signals) / sizeof(guarded_signals[0]))
+
+static struct sigaction old_action[NGUARDED];
+
+static void chain(int sig, siginfo_t *info, void *uctx) {
+	unsigned i;
+	for (i = 0; i < NGUARDED; i++) {
+		struct sigaction *sa = &old_action[i];
+		if (guarded_signals[i] != sig)
+			continue;
+		if (sa->sa_flags & SA_SIGINFO) {
+			sa->sa_sigaction(sig, info, uctx);
+		} else if (sa->sa_handler == SIG_DFL) {
+			// Returning re-executes the faulting
+			// instruction, which now kills us.
+			signal(sig, SIG_DFL);
+		} else if (sa->sa_handler != SIG_IGN) {
+			sa->sa_handler(sig);
+		}
+		return;
+	}
+}
+
+static void handler(int sig, siginfo_t *info, void *uctx) {
+	ucontext_t *uc = uctx;
+	uintptr_t pc = UC_PC(uc);
+	uintptr_t sp = UC_SP(uc);
+	uintptr_t base = sp & ~(uintptr_t)(GOJIT_STACK_SIZE - 1);
+
+	if (!table_contains(&regions, pc)) {
+		chain(sig, info, uctx);
+		return;
+	}
+
+	if (table_contains(&stacks, base)) {
+		// GoABI code: make the JIT'd code return to
+		// jitcallOn, whose return address sits just below
+		// the context block.
+		uintptr_t *ctx = (uintptr_t *)(base + GOJIT_STACK_SIZE - GOJIT_STACK_CTX_SIZE);
+		ctx[GOJIT_CTX_FAULT] = sig;
+		ctx[GOJIT_CTX_FAULT + 1] = pc;
+		ctx[GOJIT_CTX_FAULT + 2] = (uintptr_t)info->si_addr;
+		UC_SP(uc) = (uintptr_t)ctx;
+		UC_PC(uc) = ctx[-1];
+		return;
+	}
+
+	if (cur_guard != NULL) {
+		cur_guard->fault->sig = sig;
+		cur_guard->fault->pc = pc;
+		cur_guard->fault->addr = (uintptr_t)info->si_addr;
+		pthread_sigmask(SIG_SETMASK, &uc->uc_sigmask, NULL);
+		siglongjmp(cur_guard->jb, 1);
+	}
+
+	chain(sig, info, uctx);
+}
+
+static int install_err;
+
+static void install(void) {
+	struct sigaction sa;
+	unsigned i;
+
+	memset(&sa, 0, sizeof(sa));
+	sa.sa_sigaction = handler;
+	sa.sa_flags = SA_SIGINFO | SA_ONSTACK | SA_RESTART;
+	sigfillset(&sa.sa_mask);
+	for (i = 0; i < NGUARDED; i++) {
+		if (sigaction(guarded_signals[i], &sa, &old_action[i]) != 0) {
+			install_err = -1;
+			return;
+		}
+	}
+}
+
+int gojit_guard_install(void) {
+	static pthread_once_t once = PTHREAD_ONCE_INIT;
+	pthread_once(&once, install);
+	return install_err;
+}
+
+struct traceback_arg {
+	uintptr_t context;
+	uintptr_t sig_context;
+	uintptr_t *buf;
+	uintptr_t max;
+};
+
+void gojit_traceback(void *p) {
+	struct traceback_arg *arg = p;
+	ucontext_t *uc = (ucontext_t *)arg->sig_context;
+	uintptr_t n = 0;
+
+	if (uc != NULL && arg->max > 0)
+		arg->buf[n++] = UC_PC(uc);
+	if (n < arg->max)
+		arg->buf[n] = 0;
+}
+
+// The GDB JIT compilation interface. gdb sets a breakpoint on
+// __jit_debug_register_code, and reads the entry named by
+// __jit_debug_descriptor whenever it is hit. See "JIT Interface" in
+// the gdb manual.
+typedef enum {
+	JIT_NOACTION = 0,
+	JIT_REGISTER_FN,
+	JIT_UNREGISTER_FN
+} jit_actions_t;
+
+struct jit_code_entry {
+	struct jit_code_entry *next_entry;
+	struct jit_code_entry *prev_entry;
+	const char *symfile_addr;
+	uint64_t symfile_size;
+};
+
+struct jit_descriptor {
+	uint32_t version;
+	uint32_t action_flag;
+	struct jit_code_entry *relevant_entry;
+	struct jit_code_entry *first_entry;
+};
+
+void __attribute__((noinline)) __jit_debug_register_code(void) {
+	__asm__ volatile("" ::: "memory");
+}
+
+struct jit_descriptor __jit_debug_descriptor = { 1, JIT_NOACTION, NULL, NULL };
+
+static pthread_mutex_t gdb_lock = PTHREAD_MUTEX_INITIALIZER;
+
+uintptr_t gojit_gdb_register(const void *image, uint64_t size) {
+	struct jit_code_entry *e = malloc(sizeof *e);
+	char *copy = malloc(size);
+	if (e == NULL || copy == NULL) {
+		free(e);
+		free(copy);
+		return 0;
+	}
+	memcpy(copy, image, size);
+	e->symfile_addr = copy;
+	e->symfile_size = size;
+	e->prev_entry = NULL;
+
+	pthread_mutex_lock(&gdb_lock);
+	e->next_entry = __jit_debug_descriptor.first_entry;
+	if (e->next_entry != NULL)
+		e->next_entry->prev_entry = e;
+	__jit_debug_descriptor.first_entry = e;
+	__jit_debug_descriptor.relevant_entry = e;
+	__jit_debug_descriptor.action_flag = JIT_REGISTER_FN;
+	__jit_debug_register_code();
+	__jit_debug_descriptor.action_flag = JIT_NOACTION;
+	pthread_mutex_unlock(&gdb_lock);
+	return (uintptr_t)e;
+}
+
+void gojit_gdb_unregister(uintptr_t entry) {
+	struct jit_code_entry *e = (struct jit_code_entry *)entry;
+
+	pthread_mutex_lock(&gdb_lock);
+	if (e->prev_entry != NULL)
+		e->prev_entry->next_entry = e->next_entry;
+	else
+		__jit_debug_descriptor.first_entry = e->next_entry;
+	if (e->next_entry != NULL)
+		e->next_entry->prev_entry = e->prev_entry;
+	__jit_debug_descriptor.relevant_entry = e;
+	__jit_debug_descriptor.action_flag = JIT_UNREGISTER_FN;
+	__jit_debug_register_code();
+	__jit_debug_descriptor.action_flag = JIT_NOACTION;
+	pthread_mutex_unlock(&gdb_lock);
+
+	free((void *)e->symfile_addr);
+	free(e);
+}
+
+size_t gojit_gdb_entries(const char **images, uint64_t *sizes, size_t n) {
+	struct jit_code_entry *e;
+	size_t i = 0;
+
+	pthread_mutex_lock(&gdb_lock);
+	for (e = __jit_debug_descriptor.first_entry; e != NULL && i < n; e = e->next_entry, i++) {
+		images[i] = e->symfile_addr;
+		sizes[i] = e->symfile_size;
+	}
+	pthread_mutex_unlock(&gdb_lock);
+	return i;
+}
@@ -0,0 +1,33 @@
+#ifndef GOJIT_H
+#define GOJIT_H
+
+#include <stddef.h>
+#include <stdint.h>
+
+// These must match the definitions in gojit's stack.go.
+#define GOJIT_STACK_SIZE     65536
+#define GOJIT_STACK_CTX_SIZE 64
+#define GOJIT_CTX_FAULT      4
+
+struct gojit_fault {
+	uintptr_t sig;
+	uintptr_t pc;
+	uintptr_t addr;
+};
+
+void gojit_call(uintptr_t code, void *frame, struct gojit_fault *fault);
+uintptr_t gojit_callback_addr(void);
+
+int gojit_guard_install(void);
+int gojit_region_add(uintptr_t start, uintptr_t end);
+void gojit_region_remove(uintptr_t start);
+int gojit_stack_add(uintptr_t base);
+void gojit_stack_remove(uintptr_t base);
+
+void gojit_traceback(void *arg);
+
+uintptr_t gojit_gdb_register(const void *image, uint64_t size);
+void gojit_gdb_unregister(uintptr_t entry);
+size_t gojit_gdb_entries(const char **images, uint64_t *sizes, size_t n);
+
+#endif
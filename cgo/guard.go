@@ -0,0 +1,44 @@
+package cgo
+
+// #include "gojit.h"
+import "C"
+
+import "errors"
+
+// InstallGuard installs handlers for SIGSEGV, SIGBUS, SIGILL and
+// SIGFPE that catch faults raised inside guarded regions, and pass
+// any other signal on to the Go runtime's handlers. It is safe to
+// call more than once.
+func InstallGuard() error {
+	if C.gojit_guard_install() != 0 {
+		return errors.New("gojit: installing signal handlers failed")
+	}
+	return nil
+}
+
+// AddRegion marks the code in [start, end) as guarded.
+func AddRegion(start, end uintptr) error {
+	if C.gojit_region_add(C.uintptr_t(start), C.uintptr_t(end)) != 0 {
+		return errors.New("gojit: too many guarded regions")
+	}
+	return nil
+}
+
+// RemoveRegion removes the guarded region starting at start.
+func RemoveRegion(start uintptr) {
+	C.gojit_region_remove(C.uintptr_t(start))
+}
+
+// AddStack tells the signal handler about the GoABI stack at base,
+// so that faults on it can be unwound through its context block.
+func AddStack(base uintptr) error {
+	if C.gojit_stack_add(C.uintptr_t(base)) != 0 {
+		return errors.New("gojit: too many live stacks")
+	}
+	return nil
+}
+
+// RemoveStack undoes AddStack.
+func RemoveStack(base uintptr) {
+	C.gojit_stack_remove(C.uintptr_t(base))
+}
@@ -0,0 +1,16 @@
+package cgo
+
+// #include "gojit.h"
+import "C"
+
+import (
+	"runtime"
+	"unsafe"
+)
+
+// SetTraceback installs gojit_traceback as the cgo traceback
+// function. It reports only the interrupted PC: JIT'd code has no
+// unwind information.
+func SetTraceback() {
+	runtime.SetCgoTraceback(0, unsafe.Pointer(C.gojit_traceback), nil, nil)
+}
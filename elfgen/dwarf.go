@@ -0,0 +1,171 @@
+package elfgen
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"sort"
+)
+
+// A Line maps an address to a source position.
+type Line struct {
+	Addr uint64
+	File string
+	Line int
+}
+
+// DWARF constants, from the DWARF 4 standard.
+const (
+	dwTagCompileUnit = 0x11
+	dwChildrenNo     = 0
+
+	dwAtName     = 0x03
+	dwAtStmtList = 0x10
+	dwAtLowPC    = 0x11
+	dwAtHighPC   = 0x12
+	dwAtProducer = 0x25
+
+	dwFormAddr      = 0x01
+	dwFormData8     = 0x07
+	dwFormString    = 0x08
+	dwFormSecOffset = 0x17
+
+	dwLnsCopy        = 1
+	dwLnsAdvancePC   = 2
+	dwLnsAdvanceLine = 3
+	dwLnsSetFile     = 4
+
+	dwLneEndSequence = 1
+	dwLneSetAddress  = 2
+
+	lineBase   = -5
+	lineRange  = 14
+	opcodeBase = 13
+)
+
+// AddDebugLines adds .debug_abbrev, .debug_info and .debug_line
+// sections to f, describing a single compilation unit named name
+// that covers [low, high) and has the given line table.
+func (f *File) AddDebugLines(name string, low, high uint64, lines []Line) {
+	abbrev := []byte{
+		1, dwTagCompileUnit, dwChildrenNo,
+		dwAtName, dwFormString,
+		dwAtProducer, dwFormString,
+		dwAtStmtList, dwFormSecOffset,
+		dwAtLowPC, dwFormAddr,
+		dwAtHighPC, dwFormData8,
+		0, 0,
+		0,
+	}
+
+	var die bytes.Buffer
+	die.WriteByte(1)
+	die.WriteString(name)
+	die.WriteByte(0)
+	die.WriteString("gojit")
+	die.WriteByte(0)
+	binary.Write(&die, binary.LittleEndian, uint32(0))
+	binary.Write(&die, binary.LittleEndian, low)
+	binary.Write(&die, binary.LittleEndian, high-low)
+
+	var info bytes.Buffer
+	binary.Write(&info, binary.LittleEndian, uint32(2+4+1+die.Len()))
+	binary.Write(&info, binary.LittleEndian, uint16(4))
+	binary.Write(&info, binary.LittleEndian, uint32(0))
+	info.WriteByte(8)
+	info.Write(die.Bytes())
+
+	f.AddSection(&Section{Name: ".debug_abbrev", Type: elf.SHT_PROGBITS, Align: 1, Data: abbrev})
+	f.AddSection(&Section{Name: ".debug_info", Type: elf.SHT_PROGBITS, Align: 1, Data: info.Bytes()})
+	f.AddSection(&Section{Name: ".debug_line", Type: elf.SHT_PROGBITS, Align: 1, Data: lineProgram(low, high, lines)})
+}
+
+func lineProgram(low, high uint64, lines []Line) []byte {
+	lines = append([]Line(nil), lines...)
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Addr < lines[j].Addr })
+
+	files := make(map[string]uint64)
+	var names []string
+	for _, l := range lines {
+		if _, ok := files[l.File]; !ok {
+			names = append(names, l.File)
+			files[l.File] = uint64(len(names))
+		}
+	}
+
+	var hdr bytes.Buffer
+	hdr.Write([]byte{1, 1, 1, byte(lineBase & 0xff), lineRange, opcodeBase})
+	hdr.Write([]byte{0, 1, 1, 1, 1, 0, 0, 0, 1, 0, 0, 1})
+	hdr.WriteByte(0) // no include directories
+	for _, name := range names {
+		hdr.WriteString(name)
+		hdr.Write([]byte{0, 0, 0, 0})
+	}
+	hdr.WriteByte(0)
+
+	var prog bytes.Buffer
+	prog.Write([]byte{0, 9, dwLneSetAddress})
+	binary.Write(&prog, binary.LittleEndian, low)
+	addr, file, line := low, uint64(1), 1
+	for _, l := range lines {
+		if l.Addr < low || l.Addr >= high {
+			continue
+		}
+		if l.Addr != addr {
+			prog.WriteByte(dwLnsAdvancePC)
+			prog.Write(uleb128(l.Addr - addr))
+			addr = l.Addr
+		}
+		if files[l.File] != file {
+			file = files[l.File]
+			prog.WriteByte(dwLnsSetFile)
+			prog.Write(uleb128(file))
+		}
+		if l.Line != line {
+			prog.WriteByte(dwLnsAdvanceLine)
+			prog.Write(sleb128(int64(l.Line - line)))
+			line = l.Line
+		}
+		prog.WriteByte(dwLnsCopy)
+	}
+	if high != addr {
+		prog.WriteByte(dwLnsAdvancePC)
+		prog.Write(uleb128(high - addr))
+	}
+	prog.Write([]byte{0, 1, dwLneEndSequence})
+
+	var out bytes.Buffer
+	binary.Write(&out, binary.LittleEndian, uint32(2+4+hdr.Len()+prog.Len()))
+	binary.Write(&out, binary.LittleEndian, uint16(4))
+	binary.Write(&out, binary.LittleEndian, uint32(hdr.Len()))
+	out.Write(hdr.Bytes())
+	out.Write(prog.Bytes())
+	return out.Bytes()
+}
+
+func uleb128(v uint64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if v != 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if v == 0 {
+			return out
+		}
+	}
+}
+
+func sleb128(v int64) []byte {
+	var out []byte
+	for {
+		b := byte(v & 0x7f)
+		v >>= 7
+		if (v == 0 && b&0x40 == 0) || (v == -1 && b&0x40 != 0) {
+			return append(out, b)
+		}
+		out = append(out, b|0x80)
+	}
+}
@@ -0,0 +1,280 @@
+// Package elfgen writes ELF64 files for amd64. It knows just enough
+// of the format to describe JIT'd code to debuggers and to emit
+// object files and executables from it.
+package elfgen
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+)
+
+// A File is an ELF file under construction.
+type File struct {
+	Type     elf.Type
+	Entry    uint64
+	Sections []*Section
+	Symbols  []*Symbol
+	Progs    []*Prog
+}
+
+// A Prog is a segment of an executable File, mapping a run of its
+// Sections, which must have consecutive addresses and appear in
+// that order in the File. Bytes places the contents of sections
+// with an address at a file offset congruent to it modulo PageSize.
+type Prog struct {
+	Type     elf.ProgType
+	Flags    elf.ProgFlag
+	Sections []*Section
+}
+
+// PageSize is the alignment of the segments of executable Files.
+const PageSize = 4096
+
+// A Section is a section of a File.
+type Section struct {
+	Name  string
+	Type  elf.SectionType
+	Flags elf.SectionFlag
+	Addr  uint64
+	Align uint64
+	Data  []byte
+	// Size is the size of a SHT_NOBITS section, which has no
+	// Data.
+	Size uint64
+	// Relocs are written to a SHT_RELA section named
+	// ".rela<Name>".
+	Relocs []Reloc
+
+	index  int
+	offset uint64
+}
+
+// A Symbol is an entry in a File's symbol table. Symbols with a nil
+// Section are undefined.
+type Symbol struct {
+	Name    string
+	Section *Section
+	Value   uint64
+	Size    uint64
+	Type    elf.SymType
+	Bind    elf.SymBind
+}
+
+// A Reloc is a relocation entry, applying to the field at Off within
+// its section.
+type Reloc struct {
+	Off    uint64
+	Sym    *Symbol
+	Type   elf.R_X86_64
+	Addend int64
+}
+
+// AddSection appends s to f, and returns it.
+func (f *File) AddSection(s *Section) *Section {
+	f.Sections = append(f.Sections, s)
+	return s
+}
+
+// AddProg appends p to f, and returns it.
+func (f *File) AddProg(p *Prog) *Prog {
+	f.Progs = append(f.Progs, p)
+	return p
+}
+
+// AddSymbol appends s to f, and returns it.
+func (f *File) AddSymbol(s *Symbol) *Symbol {
+	f.Symbols = append(f.Symbols, s)
+	return s
+}
+
+const (
+	ehdrSize = 64
+	shdrSize = 64
+	phdrSize = 56
+	symSize  = 24
+	relaSize = 24
+)
+
+type strtab struct {
+	buf bytes.Buffer
+}
+
+func newStrtab() *strtab {
+	t := &strtab{}
+	t.buf.WriteByte(0)
+	return t
+}
+
+func (t *strtab) add(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := uint32(t.buf.Len())
+	t.buf.WriteString(s)
+	t.buf.WriteByte(0)
+	return off
+}
+
+func (s *Section) size() uint64 {
+	if s.Type == elf.SHT_NOBITS {
+		return s.Size
+	}
+	return uint64(len(s.Data))
+}
+
+// Bytes lays out and encodes f.
+func (f *File) Bytes() []byte {
+	le := binary.LittleEndian
+
+	// Locals must precede globals in the symbol table.
+	var syms []*Symbol
+	for _, s := range f.Symbols {
+		if s.Bind == elf.STB_LOCAL {
+			syms = append(syms, s)
+		}
+	}
+	nlocal := len(syms) + 1
+	for _, s := range f.Symbols {
+		if s.Bind != elf.STB_LOCAL {
+			syms = append(syms, s)
+		}
+	}
+
+	strs := newStrtab()
+	symtab := &Section{Name: ".symtab", Type: elf.SHT_SYMTAB, Align: 8}
+	strtab := &Section{Name: ".strtab", Type: elf.SHT_STRTAB, Align: 1}
+	shstrtab := &Section{Name: ".shstrtab", Type: elf.SHT_STRTAB, Align: 1}
+	sections := append([]*Section(nil), f.Sections...)
+	relas := make(map[*Section]*Section)
+	for _, s := range f.Sections {
+		if len(s.Relocs) > 0 {
+			rela := &Section{
+				Name:  ".rela" + s.Name,
+				Type:  elf.SHT_RELA,
+				Flags: elf.SHF_INFO_LINK,
+				Align: 8,
+			}
+			relas[rela] = s
+			sections = append(sections, rela)
+		}
+	}
+	sections = append(sections, symtab, strtab, shstrtab)
+	for i, s := range sections {
+		s.index = i + 1
+	}
+	symIndex := make(map[*Symbol]int)
+	for i, s := range syms {
+		symIndex[s] = i + 1
+	}
+	for rela, s := range relas {
+		for _, r := range s.Relocs {
+			var ent [relaSize]byte
+			le.PutUint64(ent[0:], r.Off)
+			le.PutUint64(ent[8:], uint64(symIndex[r.Sym])<<32|uint64(r.Type))
+			le.PutUint64(ent[16:], uint64(r.Addend))
+			rela.Data = append(rela.Data, ent[:]...)
+		}
+	}
+
+	symtab.Data = make([]byte, symSize, symSize*(len(syms)+1))
+	for _, s := range syms {
+		var ent [symSize]byte
+		le.PutUint32(ent[0:], strs.add(s.Name))
+		ent[4] = byte(s.Bind)<<4 | byte(s.Type)&0xf
+		if s.Section != nil {
+			le.PutUint16(ent[6:], uint16(s.Section.index))
+		}
+		le.PutUint64(ent[8:], s.Value)
+		le.PutUint64(ent[16:], s.Size)
+		symtab.Data = append(symtab.Data, ent[:]...)
+	}
+	strtab.Data = strs.buf.Bytes()
+
+	shstrs := newStrtab()
+	names := make([]uint32, len(sections))
+	for i, s := range sections {
+		names[i] = shstrs.add(s.Name)
+	}
+	shstrtab.Data = shstrs.buf.Bytes()
+
+	off := uint64(ehdrSize + phdrSize*len(f.Progs))
+	for _, s := range sections {
+		if s.Align > 1 {
+			off = (off + s.Align - 1) &^ (s.Align - 1)
+		}
+		if len(f.Progs) > 0 && s.Addr != 0 {
+			off += (s.Addr - off) % PageSize
+		}
+		s.offset = off
+		if s.Type != elf.SHT_NOBITS {
+			off += uint64(len(s.Data))
+		}
+	}
+	shoff := (off + 7) &^ 7
+
+	out := make([]byte, shoff+shdrSize*uint64(len(sections)+1))
+	copy(out, elf.ELFMAG)
+	out[elf.EI_CLASS] = byte(elf.ELFCLASS64)
+	out[elf.EI_DATA] = byte(elf.ELFDATA2LSB)
+	out[elf.EI_VERSION] = byte(elf.EV_CURRENT)
+	le.PutUint16(out[16:], uint16(f.Type))
+	le.PutUint16(out[18:], uint16(elf.EM_X86_64))
+	le.PutUint32(out[20:], uint32(elf.EV_CURRENT))
+	le.PutUint64(out[24:], f.Entry)
+	le.PutUint64(out[40:], shoff)
+	le.PutUint16(out[52:], ehdrSize)
+	le.PutUint16(out[58:], shdrSize)
+	if len(f.Progs) > 0 {
+		le.PutUint64(out[32:], ehdrSize)
+		le.PutUint16(out[54:], phdrSize)
+		le.PutUint16(out[56:], uint16(len(f.Progs)))
+	}
+	for i, p := range f.Progs {
+		first, last := p.Sections[0], p.Sections[len(p.Sections)-1]
+		var filesz uint64
+		for _, s := range p.Sections {
+			if s.Type != elf.SHT_NOBITS {
+				filesz = s.offset + uint64(len(s.Data)) - first.offset
+			}
+		}
+		memsz := last.Addr + last.size() - first.Addr
+		h := out[ehdrSize+phdrSize*i:]
+		le.PutUint32(h[0:], uint32(p.Type))
+		le.PutUint32(h[4:], uint32(p.Flags))
+		le.PutUint64(h[8:], first.offset)
+		le.PutUint64(h[16:], first.Addr)
+		le.PutUint64(h[24:], first.Addr)
+		le.PutUint64(h[32:], filesz)
+		le.PutUint64(h[40:], memsz)
+		le.PutUint64(h[48:], PageSize)
+	}
+	le.PutUint16(out[60:], uint16(len(sections)+1))
+	le.PutUint16(out[62:], uint16(shstrtab.index))
+
+	for i, s := range sections {
+		if s.Type != elf.SHT_NOBITS {
+			copy(out[s.offset:], s.Data)
+		}
+		size := s.size()
+		h := out[shoff+shdrSize*uint64(s.index):]
+		le.PutUint32(h[0:], names[i])
+		le.PutUint32(h[4:], uint32(s.Type))
+		le.PutUint64(h[8:], uint64(s.Flags))
+		le.PutUint64(h[16:], s.Addr)
+		le.PutUint64(h[24:], s.offset)
+		le.PutUint64(h[32:], size)
+		le.PutUint64(h[48:], s.Align)
+		if s == symtab {
+			le.PutUint32(h[40:], uint32(strtab.index))
+			le.PutUint32(h[44:], uint32(nlocal))
+			le.PutUint64(h[56:], symSize)
+		}
+		if target, ok := relas[s]; ok {
+			le.PutUint32(h[40:], uint32(symtab.index))
+			le.PutUint32(h[44:], uint32(target.index))
+			le.PutUint64(h[56:], relaSize)
+		}
+	}
+	return out
+}
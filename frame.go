@@ -0,0 +1,111 @@
+package gojit
+
+import (
+	"fmt"
+	"reflect"
+	"runtime"
+	"unsafe"
+
+	"github.com/nelhage/gojit/cgo"
+)
+
+// frame describes the 6c-style argument frame used to pass
+// arguments to and from JIT'd code: each argument is laid out at
+// its natural alignment, and the results follow, starting at the
+// next pointer-aligned offset.
+type frame struct {
+	typ     reflect.Type
+	in, out []int
+}
+
+func newFrame(fn reflect.Type) *frame {
+	var fields []reflect.StructField
+	f := &frame{}
+	off := uintptr(0)
+
+	add := func(t reflect.Type) int {
+		fields = append(fields, reflect.StructField{
+			Name: fmt.Sprintf("F%d", len(fields)),
+			Type: t,
+		})
+		off = align(off, uintptr(t.Align())) + t.Size()
+		return len(fields) - 1
+	}
+
+	for i := 0; i < fn.NumIn(); i++ {
+		f.in = append(f.in, add(fn.In(i)))
+	}
+	if pad := align(off, ptrSize) - off; pad != 0 && fn.NumOut() > 0 {
+		add(reflect.ArrayOf(int(pad), reflect.TypeOf(byte(0))))
+	}
+	for i := 0; i < fn.NumOut(); i++ {
+		f.out = append(f.out, add(fn.Out(i)))
+	}
+
+	f.typ = reflect.StructOf(fields)
+	return f
+}
+
+// pin pins each Go object that the addressable value v points to.
+func pin(p *runtime.Pinner, v reflect.Value) {
+	word := func(i int) unsafe.Pointer {
+		return (*[2]unsafe.Pointer)(unsafe.Pointer(v.UnsafeAddr()))[i]
+	}
+	var w unsafe.Pointer
+	switch v.Kind() {
+	case reflect.Ptr, reflect.UnsafePointer, reflect.Map, reflect.Chan,
+		reflect.Func, reflect.Slice, reflect.String:
+		w = word(0)
+	case reflect.Interface:
+		w = word(1)
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			pin(p, v.Field(i))
+		}
+	case reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			pin(p, v.Index(i))
+		}
+	}
+	if w != nil {
+		p.Pin(w)
+	}
+}
+
+const ptrSize = unsafe.Sizeof(uintptr(0))
+
+func align(off, a uintptr) uintptr {
+	return (off + a - 1) &^ (a - 1)
+}
+
+// at returns the frame located at p, which must not be in the Go
+// heap.
+func (f *frame) at(p unsafe.Pointer) reflect.Value {
+	return reflect.NewAt(f.typ, p).Elem()
+}
+
+// call builds a frame from args, invokes the JIT'd code at code on
+// it using call, and returns the results it left in the frame.
+func (f *frame) call(code uintptr, args []reflect.Value,
+	call func(code uintptr, frame unsafe.Pointer) cgo.Fault) []reflect.Value {
+	p := reflect.New(f.typ)
+	v := p.Elem()
+	for i, a := range args {
+		v.Field(f.in[i]).Set(a)
+	}
+
+	// The frame, and what the arguments in it point to, stay
+	// put until the code returns, which is what cgo asks of Go
+	// memory passed to C.
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	pinner.Pin(p.UnsafePointer())
+	pin(&pinner, v)
+	checkFault(call(code, p.UnsafePointer()))
+
+	results := make([]reflect.Value, len(f.out))
+	for i, j := range f.out {
+		results[i] = v.Field(j)
+	}
+	return results
+}
@@ -0,0 +1,85 @@
+package gojit
+
+import (
+	"debug/elf"
+
+	"github.com/nelhage/gojit/cgo"
+	"github.com/nelhage/gojit/elfgen"
+)
+
+// EnableGDB registers every live region, and every region registered
+// from then on, with gdb's JIT compilation interface. gdb can then
+// set breakpoints on region names, show them in backtraces, and step
+// through them by source line if they were registered with
+// RegisterLines. Regions are unregistered when they are released.
+//
+// A region named in gdb whose name contains characters special to
+// gdb's linespec syntax, such as "bf:hello.bf", must be quoted:
+//
+//    (gdb) break 'bf:hello.bf'
+//
+// Once gdb registration is enabled, EnableGDB returns the first error
+// registering a region, if any.
+func EnableGDB() error {
+	regions.Lock()
+	defer regions.Unlock()
+	if regions.gdb != nil {
+		return regions.gdbErr
+	}
+	regions.gdb = make(map[uintptr]uintptr)
+	for _, r := range regions.r {
+		if err := gdbRegister(r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// gdbRegister must be called with regions locked.
+func gdbRegister(r Region) error {
+	h, err := cgo.GDBRegister(gdbImage(r))
+	if err != nil {
+		if regions.gdbErr == nil {
+			regions.gdbErr = err
+		}
+		return err
+	}
+	if old, ok := regions.gdb[r.Addr]; ok {
+		cgo.GDBUnregister(old)
+	}
+	regions.gdb[r.Addr] = h
+	return nil
+}
+
+// gdbImage builds an ELF object describing r. Its .text section
+// has no contents, but its address is r's, which is all gdb needs.
+func gdbImage(r Region) []byte {
+	low, high := uint64(r.Addr), uint64(r.Addr)+uint64(r.Len)
+
+	var f elfgen.File
+	f.Type = elf.ET_REL
+	text := f.AddSection(&elfgen.Section{
+		Name:  ".text",
+		Type:  elf.SHT_NOBITS,
+		Flags: elf.SHF_ALLOC | elf.SHF_EXECINSTR,
+		Addr:  low,
+		Align: 16,
+		Size:  uint64(r.Len),
+	})
+	f.AddSymbol(&elfgen.Symbol{
+		Name:    r.Name,
+		Section: text,
+		Value:   low,
+		Size:    uint64(r.Len),
+		Type:    elf.STT_FUNC,
+		Bind:    elf.STB_GLOBAL,
+	})
+	if len(r.Lines) > 0 {
+		lines := make([]elfgen.Line, len(r.Lines))
+		for i, l := range r.Lines {
+			lines[i] = elfgen.Line{Addr: low + uint64(l.Off), File: l.File, Line: l.Line}
+		}
+		f.AddDebugLines(r.Name, low, high, lines)
+	}
+	return f.Bytes()
+}
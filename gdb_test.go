@@ -0,0 +1,99 @@
+package gojit
+
+import (
+	"bytes"
+	"debug/dwarf"
+	"debug/elf"
+	"testing"
+
+	"github.com/nelhage/gojit/cgo"
+)
+
+// gdbImageFor returns the image registered with gdb whose symbol
+// table defines name, if any.
+func gdbImageFor(t *testing.T, name string) *elf.File {
+	for _, img := range cgo.GDBImages() {
+		f, e := elf.NewFile(bytes.NewReader(img))
+		if e != nil {
+			t.Fatalf("elf.NewFile: %s", e.Error())
+		}
+		syms, e := f.Symbols()
+		if e != nil {
+			t.Fatalf("Symbols: %s", e.Error())
+		}
+		for _, s := range syms {
+			if s.Name == name {
+				return f
+			}
+		}
+	}
+	return nil
+}
+
+func TestGDB(t *testing.T) {
+	if e := EnableGDB(); e != nil {
+		t.Fatalf("EnableGDB: %s", e.Error())
+	}
+
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	RegisterLines(b[:32], "gdbtest", []Line{
+		{0, "prog.src", 3},
+		{4, "prog.src", 5},
+		{20, "other.src", 1},
+	})
+
+	f := gdbImageFor(t, "gdbtest")
+	if f == nil {
+		t.Fatal("gdbtest not registered with gdb")
+	}
+	syms, _ := f.Symbols()
+	for _, s := range syms {
+		if s.Name == "gdbtest" && (s.Value != uint64(Addr(b)) || s.Size != 32 || elf.ST_TYPE(s.Info) != elf.STT_FUNC) {
+			t.Errorf("symbol = %+v", s)
+		}
+	}
+	if text := f.Section(".text"); text == nil || text.Addr != uint64(Addr(b)) || text.Size != 32 {
+		t.Errorf(".text = %+v", text)
+	}
+
+	d, e := f.DWARF()
+	if e != nil {
+		t.Fatalf("DWARF: %s", e.Error())
+	}
+	cu, e := d.Reader().Next()
+	if e != nil {
+		t.Fatalf("reading compile unit: %s", e.Error())
+	}
+	lr, e := d.LineReader(cu)
+	if e != nil || lr == nil {
+		t.Fatalf("LineReader: %v", e)
+	}
+	expect := []struct {
+		off  uint64
+		file string
+		line int
+	}{
+		{0, "prog.src", 3},
+		{4, "prog.src", 5},
+		{20, "other.src", 1},
+	}
+	for _, ex := range expect {
+		var le dwarf.LineEntry
+		if e := lr.SeekPC(uint64(Addr(b))+ex.off+1, &le); e != nil {
+			t.Errorf("SeekPC(+%d): %s", ex.off+1, e.Error())
+			continue
+		}
+		if le.File.Name != ex.file || le.Line != ex.line {
+			t.Errorf("+%d: got %s:%d, expected %s:%d",
+				ex.off+1, le.File.Name, le.Line, ex.file, ex.line)
+		}
+	}
+
+	Release(b)
+	if gdbImageFor(t, "gdbtest") != nil {
+		t.Error("gdbtest still registered after Release")
+	}
+}
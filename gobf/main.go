@@ -2,22 +2,37 @@ package main
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"flag"
 	"io"
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
 
+	"github.com/nelhage/gojit"
 	"github.com/nelhage/gojit/bf"
 )
 
+// tapeSize is the number of cells on the tape.
+const tapeSize = 4096
+
 func main() {
 	var (
-		buffer = flag.Bool("buffer", false, "buffer stdout")
+		buffer  = flag.Bool("buffer", false, "buffer stdout")
+		perfMap = flag.Bool("perfmap", false, "write a perf map file for the compiled code")
+		output  = flag.String("o", "", "write a standalone executable to `file` instead of running")
+		check   = flag.Bool("check", false, "check that the program stays on the tape")
+		tape    = flag.String("tape", "fixed", "the tape `policy`: fixed, circular or grow")
+		bits    = flag.Int("cellbits", 8, "the size of a cell: 8, 16 or 32 bits")
+		eof     = flag.String("eof", "0", "what the , instruction does at EOF: 0, -1 or unchanged")
+		steps   = flag.Int("steps", 0, "stop the program after `n` loop iterations")
+		timeout = flag.Duration("timeout", 0, "stop the program after `duration`")
 	)
 	flag.Parse()
 	if len(flag.Args()) != 1 {
-		log.Fatalf("Usage: %s file.bf\n", os.Args[0])
+		log.Fatalf("Usage: %s [-o prog] file.bf\n", os.Args[0])
 	}
 
 	data, err := ioutil.ReadFile(flag.Arg(0))
@@ -25,15 +40,64 @@ func main() {
 		log.Fatalf("Reading %s: %s\n", flag.Arg(0), err.Error())
 	}
 
+	opts := bf.Options{Name: filepath.Base(flag.Arg(0)), CellBits: *bits, BoundsCheck: *check, MaxSteps: *steps}
+	if *timeout != 0 {
+		ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+		defer cancel()
+		opts.Context = ctx
+	}
+	switch *tape {
+	case "fixed":
+		opts.Tape = bf.TapeFixed
+	case "circular":
+		opts.Tape = bf.TapeCircular
+	case "grow":
+		opts.Tape = bf.TapeGrowable
+	default:
+		log.Fatalf("unknown tape policy %q", *tape)
+	}
+	switch *eof {
+	case "0":
+		opts.EOF = bf.EOFZero
+	case "-1":
+		opts.EOF = bf.EOFMinusOne
+	case "unchanged":
+		opts.EOF = bf.EOFUnchanged
+	default:
+		log.Fatalf("unknown EOF behaviour %q", *eof)
+	}
+
+	if *output != "" {
+		if *buffer || *perfMap {
+			log.Fatalf("-o can't be used with -buffer or -perfmap")
+		}
+		var exe bytes.Buffer
+		if e := bf.WriteExecutableOptions(&exe, data, tapeSize*(*bits)/8, opts); e != nil {
+			log.Fatalf("compiling: %s", e.Error())
+		}
+		if e := ioutil.WriteFile(*output, exe.Bytes(), 0755); e != nil {
+			log.Fatalf("writing %s: %s", *output, e.Error())
+		}
+		return
+	}
+
 	out := io.Writer(os.Stdout)
 	if *buffer {
 		out = bufio.NewWriter(out)
 	}
 
-	f, e := bf.Compile(data, os.Stdin, out)
+	if *perfMap {
+		if e := gojit.EnablePerfMap(); e != nil {
+			log.Fatalf("perf map: %s", e.Error())
+		}
+	}
+
+	f, e := bf.CompileOptions(data, os.Stdin, out, opts)
 	if e != nil {
 		log.Fatalf("compiling: %s", e.Error())
 	}
-	var memory [4096]byte
-	f(memory[:])
+	memory := make([]byte, tapeSize*(*bits)/8)
+	if e := f(memory); e != nil {
+		log.Fatalf("running: %s", e.Error())
+	}
 }
@@ -0,0 +1,98 @@
+package gojit
+
+import (
+	"fmt"
+	"sync"
+	"syscall"
+
+	"github.com/nelhage/gojit/cgo"
+)
+
+// A Fault describes a hardware fault raised by JIT'd code in a
+// buffer registered with Guard.
+type Fault struct {
+	Sig  syscall.Signal
+	Off  int     // offset of the faulting instruction into the buffer
+	Addr uintptr // faulting address, for SIGSEGV and SIGBUS
+}
+
+func (f *Fault) Error() string {
+	return fmt.Sprintf("gojit: %s at pc=+%#x (addr=%#x)", f.Sig, f.Off, f.Addr)
+}
+
+var guarded struct {
+	sync.Mutex
+	m map[uintptr]int
+}
+
+// Guard registers b as a guarded code region. If code in b raises
+// SIGSEGV, SIGBUS, SIGILL or SIGFPE while running under a function
+// returned by any of the Build functions, the fault is caught instead
+// of crashing the process: the function abandons the JIT'd code and
+// panics with a *Fault. Use Catch to turn that into an error.
+//
+// Only faults in b itself are caught; a fault in Go code called back
+// from b is handled as usual by the Go runtime. The registration is
+// dropped when b is passed to Release.
+func Guard(b []byte) error {
+	if err := cgo.InstallGuard(); err != nil {
+		return err
+	}
+
+	guarded.Lock()
+	defer guarded.Unlock()
+	if guarded.m == nil {
+		guarded.m = make(map[uintptr]int)
+	}
+	start := Addr(b)
+	if _, ok := guarded.m[start]; ok {
+		return nil
+	}
+	if err := cgo.AddRegion(start, start+uintptr(len(b))); err != nil {
+		return err
+	}
+	guarded.m[start] = len(b)
+	return nil
+}
+
+func unguard(b []byte) {
+	guarded.Lock()
+	defer guarded.Unlock()
+	start := Addr(b)
+	if _, ok := guarded.m[start]; ok {
+		cgo.RemoveRegion(start)
+		delete(guarded.m, start)
+	}
+}
+
+func checkFault(f cgo.Fault) {
+	if f.Sig == 0 {
+		return
+	}
+
+	fault := &Fault{Sig: syscall.Signal(f.Sig), Off: -1, Addr: f.Addr}
+	guarded.Lock()
+	for start, n := range guarded.m {
+		if f.PC >= start && f.PC < start+uintptr(n) {
+			fault.Off = int(f.PC - start)
+		}
+	}
+	guarded.Unlock()
+	panic(fault)
+}
+
+// Catch calls f, and returns the *Fault it panics with, if
+// any. Other panics are passed through.
+func Catch(f func()) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			fault, ok := r.(*Fault)
+			if !ok {
+				panic(r)
+			}
+			err = fault
+		}
+	}()
+	f()
+	return nil
+}
@@ -5,7 +5,7 @@ package gojit
 
 import (
 	"github.com/edsrzf/mmap-go"
-	_ "github.com/nelhage/gojit/cgo"
+	"github.com/nelhage/gojit/cgo"
 	"reflect"
 	"unsafe"
 )
@@ -22,8 +22,13 @@ func Alloc(len int) ([]byte, error) {
 	return b, err
 }
 
-// Release frees a buffer allocated by Alloc
+// Release frees a buffer allocated by Alloc, along with any
+// callbacks, guards and regions registered against it.
 func Release(b []byte) error {
+	unseal(b)
+	releaseCallbacks(b)
+	unguard(b)
+	unregister(b)
 	m := mmap.MMap(b)
 	return m.Unmap()
 }
@@ -38,14 +43,14 @@ func Addr(b []byte) uintptr {
 // into the specified byte slice. The slice should in most cases be a
 // slice returned by Alloc, although you could also use syscall.Mmap
 // or syscall.Mprotect directly.
+//
+// The code runs on a separate stack of 64KB, so it need not worry
+// about the size of the goroutine stack, and may call back into Go by
+// way of GoCallbackAddr. Any other Go function must not be called
+// directly.
 func Build(b []byte) func() {
-	dummy := jitcall
-	fn := &struct {
-		trampoline uintptr
-		jitcode    uintptr
-	}{**(**uintptr)(unsafe.Pointer(&dummy)), Addr(b)}
-
-	return *(*func())(unsafe.Pointer(&fn))
+	code := Addr(b)
+	return func() { checkFault(jitcall(code, nil)) }
 }
 
 // BuildCgo is like Build, but the resulting provided code will be
@@ -54,13 +59,8 @@ func Build(b []byte) func() {
 // conform to your platform's C ABI), at the cost of significant
 // overhead for each call into your code.
 func BuildCgo(b []byte) func() {
-	dummy := cgocall
-	fn := &struct {
-		trampoline uintptr
-		jitcode    uintptr
-	}{**(**uintptr)(unsafe.Pointer(&dummy)), Addr(b)}
-
-	return *(*func())(unsafe.Pointer(&fn))
+	code := Addr(b)
+	return func() { checkFault(cgo.Call(code, nil)) }
 }
 
 // BuildTo converts a byte-slice into an arbitrary-signatured
@@ -79,15 +79,15 @@ func BuildCgo(b []byte) func() {
 //     8(%rdi)  [  len(slice)  ]
 //     0(%rdi)  [ uint8* data  ]
 func BuildTo(b []byte, out interface{}) {
-	buildToInternal(b, out, Build)
+	buildToInternal(b, out, jitcall)
 }
 
 // BuildToCgo is as Build, but uses cgo like BuildCGo
 func BuildToCgo(b []byte, out interface{}) {
-	buildToInternal(b, out, BuildCgo)
+	buildToInternal(b, out, cgo.Call)
 }
 
-func buildToInternal(b []byte, out interface{}, build func([]byte) func()) {
+func buildToInternal(b []byte, out interface{}, call func(code uintptr, frame unsafe.Pointer) cgo.Fault) {
 	v := reflect.ValueOf(out)
 	if v.Type().Kind() != reflect.Ptr {
 		panic("BuildTo: must pass a pointer")
@@ -96,19 +96,35 @@ func buildToInternal(b []byte, out interface{}, build func([]byte) func()) {
 		panic("BuildTo: must pass a pointer to func")
 	}
 
-	f := build(b)
+	code := Addr(b)
+	frame := newFrame(v.Elem().Type())
+	f := reflect.MakeFunc(v.Elem().Type(), func(args []reflect.Value) []reflect.Value {
+		return frame.call(code, args, call)
+	})
+	v.Elem().Set(f)
+}
 
-	ival := *(*struct {
-		typ uintptr
-		val uintptr
-	})(unsafe.Pointer(&out))
+// jitcall calls code with frame in %rdi, on a stack obtained from
+// getStack.
+func jitcall(code uintptr, frame unsafe.Pointer) cgo.Fault {
+	s := getStack()
+	defer putStack(s)
+	s.ctx.fault.Sig = 0
+	jitcallOn(code, frame, uintptr(unsafe.Pointer(s.ctx)))
+	return s.ctx.fault
+}
 
-	// Since we know that out has concrete type of *func(..) ...,
-	// we know it fits into a word, and thus `val' is just the
-	// pointer itself (http://research.swtch.com/interfaces)
+// jitcallOn switches to the stack whose context block is at ctx and
+// calls code with frame in %rdi.
+func jitcallOn(code uintptr, frame unsafe.Pointer, ctx uintptr)
 
-	*(*func())(unsafe.Pointer(ival.val)) = f
+// GoCallbackAddr returns the address of the entry point that GoABI
+// code calls to invoke a callback registered with RegisterCallback.
+// It expects the handle in %rdi and a pointer to the 6c frame in
+// %rsi, and clobbers all registers but %rsp and %rbp.
+func GoCallbackAddr() uintptr {
+	return jitcallbackAddr()
 }
 
-func jitcall()
-func cgocall()
+func jitcallback()
+func jitcallbackAddr() uintptr
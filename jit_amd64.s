@@ -1,18 +1,74 @@
 #include "funcdata.h"
 #include "textflag.h"
 
-// cgocall(*args) with jitcode in the context blob
-//   -> runtime·cgocall(jitcode, frame)
-TEXT ·cgocall(SB),NOSPLIT,$16
+#define stackSize 65536
+#define stackCtxSize 64
+
+// MOVQ BX, SP, spelled out so that the assembler doesn't mark the
+// function SPWRITE: the runtime refuses to unwind through SPWRITE
+// functions, and both of the functions below appear in the middle of
+// the goroutine's stack while a callback runs.
+#define MOVQ_BX_SP BYTE $0x48; BYTE $0x89; BYTE $0xdc
+
+// jitcallOn(code uintptr, frame unsafe.Pointer, ctx uintptr)
+//
+// Saves our %rsp and %rbp in the context block at ctx, switches to
+// the stack below it and calls code. jitcallback finds the context
+// block by masking the JIT %rsp, and uses it to make the call back
+// into Go look, to the runtime, like a call made from right here.
+TEXT ·jitcallOn(SB),0,$8-24
+        NO_LOCAL_POINTERS
+        MOVQ code+0(FP), AX
+        MOVQ frame+8(FP), DI
+        MOVQ ctx+16(FP), BX
+        MOVQ SP, 0(BX)
+        MOVQ BP, 16(BX)
+        MOVQ_BX_SP
+        CALL AX
+        // Callbacks may have moved the goroutine stack; 0(ctx)
+        // always holds the current %rsp.
+        MOVQ 0(SP), BX
+        MOVQ_BX_SP
+        RET
+
+// jitcallback is called from GoABI code, on a JIT stack, with a
+// callback handle in DI and a frame pointer in SI.
+TEXT ·jitcallback(SB),NOSPLIT|NOFRAME,$0-0
         NO_LOCAL_POINTERS
-        LEAQ argframe+0(FP), AX
-        MOVQ AX, 8(SP)
-        MOVQ 8(DX), AX
-        MOVQ AX, 0(SP)
-        CALL runtime·cgocall(SB)
+        MOVQ SP, AX
+        ANDQ $~(stackSize-1), AX
+        ADDQ $(stackSize-stackCtxSize), AX
+        MOVQ SP, 8(AX)
+        MOVQ BP, 24(AX)
+        // The return address jitcallOn's CALL pushed just below
+        // the context block.
+        MOVQ -8(AX), CX
+        MOVQ 0(AX), BX
+        LEAQ -8(BX), BX
+        MOVQ_BX_SP
+        MOVQ CX, 0(SP)
+        MOVQ 16(AX), BP
+        PUSHQ BP
+        MOVQ SP, BP
+        ADJSP $24
+        MOVQ DI, 0(SP)
+        MOVQ SI, 8(SP)
+        MOVQ AX, 16(SP)
+        CALL ·invokeCallback(SB)
+        MOVQ 16(SP), AX
+        ADJSP $-24
+        POPQ BP
+        // The stack may have moved under us; record where
+        // jitcallOn's frame is now.
+        MOVQ BP, 16(AX)
+        LEAQ 8(SP), BX
+        MOVQ BX, 0(AX)
+        MOVQ 24(AX), BP
+        MOVQ 8(AX), BX
+        MOVQ_BX_SP
         RET
 
-TEXT ·jitcall(SB),NOSPLIT,$0
-        LEAQ argframe+0(FP), DI
-        MOVQ 8(DX), AX
-        JMP AX
+TEXT ·jitcallbackAddr(SB),NOSPLIT,$0-8
+        LEAQ ·jitcallback(SB), AX
+        MOVQ AX, ret+0(FP)
+        RET
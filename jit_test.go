@@ -1,6 +1,8 @@
 package gojit
 
 import (
+	"strings"
+	"syscall"
 	"testing"
 )
 
@@ -46,6 +48,37 @@ func TestBuildTo(t *testing.T) {
 	}
 }
 
+// TestBuildToPointers passes Go pointers of each shape to the code,
+// which cgo only allows if they are pinned.
+func TestBuildToPointers(t *testing.T) {
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer Release(b)
+	// 0000000000000000 <first>:
+	//    0:	48 8b 07             	mov    (%rdi),%rax
+	//    3:	48 89 47 40          	mov    %rax,0x40(%rdi)
+	//    7:	c3                   	retq
+	copy(b, []byte{
+		0x48, 0x8b, 0x07,
+		0x48, 0x89, 0x47, 0x40,
+		0xc3,
+	})
+
+	type ptr struct{ p *int }
+	for _, buildTo := range []func([]byte, interface{}){BuildTo, BuildToCgo} {
+		var f func(*int, [2]string, interface{}, ptr) *int
+		buildTo(b, &f)
+
+		x := new(int)
+		s := strings.Repeat("x", 2)
+		if got := f(x, [2]string{s, s + s}, &ptr{new(int)}, ptr{new(int)}); got != x {
+			t.Errorf("expected %p, got %p", x, got)
+		}
+	}
+}
+
 func BenchmarkEmptyCall(b *testing.B) {
 	benchmarkEmptyCall(b, Build)
 }
@@ -70,3 +103,80 @@ func benchmarkEmptyCall(b *testing.B, build func([]byte) func()) {
 		f()
 	}
 }
+
+func TestGuard(t *testing.T) {
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer Release(b)
+	// 0000000000000000 <load>:
+	//    0:	48 8b 07             	mov    (%rdi),%rax
+	//    3:	48 8b 00             	mov    (%rax),%rax
+	//    6:	48 89 47 08          	mov    %rax,0x8(%rdi)
+	//    a:	c3                   	retq
+	copy(b, []byte{
+		0x48, 0x8b, 0x07,
+		0x48, 0x8b, 0x00,
+		0x48, 0x89, 0x47, 0x08,
+		0xc3,
+	})
+	if e := Guard(b); e != nil {
+		t.Fatalf("Guard: %s", e.Error())
+	}
+
+	word := uintptr(0xdeadbeef)
+	for _, buildTo := range []func([]byte, interface{}){BuildTo, BuildToCgo} {
+		var load func(*uintptr) uintptr
+		buildTo(b, &load)
+
+		for i := 0; i < 100; i++ {
+			var got uintptr
+			e := Catch(func() { got = load(&word) })
+			if e != nil || got != word {
+				t.Fatalf("load(&word) = %x, %v", got, e)
+			}
+			e = Catch(func() { load(nil) })
+			f, ok := e.(*Fault)
+			if !ok {
+				t.Fatalf("load(nil): expected a *Fault, got %v", e)
+			}
+			if f.Sig != syscall.SIGSEGV || f.Off != 3 || f.Addr != 0 {
+				t.Fatalf("load(nil): bad fault %v", f)
+			}
+		}
+	}
+
+	// Faults in Go code still go to the Go runtime.
+	func() {
+		defer func() {
+			if r := recover(); r == nil {
+				t.Error("nil dereference did not panic")
+			}
+		}()
+		var p *uintptr
+		word = *p
+	}()
+}
+
+func TestGuardBuild(t *testing.T) {
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer Release(b)
+	//    0:	90                   	nop
+	//    1:	0f 0b                	ud2
+	copy(b, []byte{0x90, 0x0f, 0x0b})
+	if e := Guard(b); e != nil {
+		t.Fatalf("Guard: %s", e.Error())
+	}
+
+	for _, build := range []func([]byte) func(){Build, BuildCgo} {
+		f := build(b)
+		e := Catch(f)
+		if fault, ok := e.(*Fault); !ok || fault.Sig != syscall.SIGILL || fault.Off != 1 {
+			t.Errorf("expected SIGILL at +1, got %v", e)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package gojit
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// A span is the address range [start, end).
+type span struct {
+	start, end uintptr
+}
+
+// sealed holds the sealed buffers, which don't overlap, sorted by
+// address.
+var sealed struct {
+	sync.Mutex
+	s []span
+}
+
+// findSealed returns the index of the first sealed span ending after addr,
+// or len(sealed.s) if there is none. It must be called with sealed
+// locked.
+func findSealed(addr uintptr) int {
+	return sort.Search(len(sealed.s), func(i int) bool { return sealed.s[i].end > addr })
+}
+
+// Seal makes b, which must be a whole buffer returned by Alloc,
+// read-only and executable, so that stray writes to the code fault.
+// Sealed code may still be changed with PatchUint32 and PatchUint64,
+// but only by briefly mapping the page being patched readable,
+// writable and executable at once, which systems enforcing W^X
+// refuse. Release unseals b.
+func Seal(b []byte) error {
+	if err := syscall.Mprotect(b, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return err
+	}
+	sp := span{Addr(b), Addr(b) + uintptr(len(b))}
+
+	sealed.Lock()
+	defer sealed.Unlock()
+	i := findSealed(sp.start)
+	if i < len(sealed.s) && sealed.s[i].start == sp.start {
+		sealed.s[i] = sp
+		return nil
+	}
+	sealed.s = append(sealed.s, span{})
+	copy(sealed.s[i+1:], sealed.s[i:])
+	sealed.s[i] = sp
+	return nil
+}
+
+func unseal(b []byte) {
+	sealed.Lock()
+	defer sealed.Unlock()
+	i := findSealed(Addr(b))
+	if i < len(sealed.s) && sealed.s[i].start == Addr(b) {
+		sealed.s = append(sealed.s[:i], sealed.s[i+1:]...)
+	}
+}
+
+// isSealed must be called with sealed locked.
+func isSealed(addr uintptr) bool {
+	i := findSealed(addr)
+	return i < len(sealed.s) && sealed.s[i].start <= addr
+}
+
+// A ResealError reports that a patch to sealed code was made, but
+// that its page could not be made read-only again, and so is still
+// writable.
+type ResealError struct {
+	Addr uintptr // the page that is still writable
+	Err  error
+}
+
+func (e *ResealError) Error() string {
+	return fmt.Sprintf("gojit: resealing page %#x after patch: %s", e.Addr, e.Err)
+}
+
+func (e *ResealError) Unwrap() error { return e.Err }
+
+func mprotect(addr, len uintptr, prot int) error {
+	_, _, e := syscall.Syscall(syscall.SYS_MPROTECT, addr, len, uintptr(prot))
+	if e != 0 {
+		return e
+	}
+	return nil
+}
+
+// patch runs store on the naturally-aligned n-byte field at b[off:],
+// making its page writable for the duration if b is sealed. The page
+// stays executable throughout, so other threads may keep running the
+// code while it is patched. If the page can't be made writable, the
+// field is left alone; if it can't be made read-only again, patch
+// returns a *ResealError.
+func patch(b []byte, off, n int, store func(p unsafe.Pointer)) error {
+	if off < 0 || off+n > len(b) {
+		return fmt.Errorf("gojit: patch at %d outside of buffer", off)
+	}
+	addr := Addr(b) + uintptr(off)
+	if addr%uintptr(n) != 0 {
+		return fmt.Errorf("gojit: misaligned %d-byte patch at %#x", n, addr)
+	}
+
+	sealed.Lock()
+	defer sealed.Unlock()
+	if !isSealed(addr) {
+		store(unsafe.Pointer(&b[off]))
+		return nil
+	}
+	page := addr &^ (PageSize - 1)
+	if err := mprotect(page, PageSize, syscall.PROT_READ|syscall.PROT_WRITE|syscall.PROT_EXEC); err != nil {
+		return err
+	}
+	store(unsafe.Pointer(&b[off]))
+	if err := mprotect(page, PageSize, syscall.PROT_READ|syscall.PROT_EXEC); err != nil {
+		return &ResealError{page, err}
+	}
+	return nil
+}
+
+// PatchUint32 atomically replaces the 4-byte little-endian value at
+// b[off:], which must be 4-byte aligned in memory, with v. Another
+// thread executing an instruction containing it sees either the old
+// or the new value, never a mix of the two. See Seal for patching
+// sealed code.
+func PatchUint32(b []byte, off int, v uint32) error {
+	return patch(b, off, 4, func(p unsafe.Pointer) {
+		atomic.StoreUint32((*uint32)(p), v)
+	})
+}
+
+// PatchUint64 is like PatchUint32, for an 8-byte aligned 8-byte
+// value.
+func PatchUint64(b []byte, off int, v uint64) error {
+	return patch(b, off, 8, func(p unsafe.Pointer) {
+		atomic.StoreUint64((*uint64)(p), v)
+	})
+}
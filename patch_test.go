@@ -0,0 +1,34 @@
+package gojit
+
+import (
+	"testing"
+)
+
+func TestSealedRanges(t *testing.T) {
+	var bufs [][]byte
+	for i := 0; i < 4; i++ {
+		b, e := Alloc(PageSize * 2)
+		if e != nil {
+			t.Fatalf("Alloc: %s", e.Error())
+		}
+		defer Release(b)
+		bufs = append(bufs, b)
+	}
+	for _, i := range []int{2, 0, 3} {
+		if e := Seal(bufs[i]); e != nil {
+			t.Fatalf("Seal: %s", e.Error())
+		}
+	}
+	unseal(bufs[3])
+
+	sealed.Lock()
+	defer sealed.Unlock()
+	for i, b := range bufs {
+		expect := i == 0 || i == 2
+		for _, off := range []uintptr{0, PageSize, 2*PageSize - 1} {
+			if got := isSealed(Addr(b) + off); got != expect {
+				t.Errorf("isSealed(buffer %d + %#x) = %v, expected %v", i, off, got, expect)
+			}
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package gojit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+// SymbolizeProfile copies the pprof-format profile in r to w,
+// attributing every location that falls in a live registered region
+// (see Register) to a function named after the region. Profiles of
+// JIT'd code otherwise show up as bare addresses; see also
+// SetCgoTraceback.
+//
+// Run it before releasing the code in question, since only live
+// regions are consulted.
+func SymbolizeProfile(w io.Writer, r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) > 2 && data[0] == 0x1f && data[1] == 0x8b {
+		gz, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		if data, err = ioutil.ReadAll(gz); err != nil {
+			return err
+		}
+	}
+
+	out, err := symbolizeProfile(data, Regions())
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(w)
+	if _, err := gz.Write(out); err != nil {
+		return err
+	}
+	return gz.Close()
+}
+
+// Field numbers from pprof's profile.proto.
+const (
+	profileLocation = 4
+	profileFunction = 5
+	profileString   = 6
+
+	locationAddress = 3
+	locationLine    = 4
+
+	lineFunctionID = 1
+
+	functionID         = 1
+	functionName       = 2
+	functionSystemName = 3
+)
+
+func symbolizeProfile(data []byte, rs []Region) ([]byte, error) {
+	fields, err := pbParse(data)
+	if err != nil {
+		return nil, err
+	}
+
+	nstrings := 0
+	maxFunc := uint64(0)
+	for _, f := range fields {
+		switch f.num {
+		case profileString:
+			nstrings++
+		case profileFunction:
+			fn, err := pbParse(f.body)
+			if err != nil {
+				return nil, err
+			}
+			for _, ff := range fn {
+				if ff.num == functionID && ff.val > maxFunc {
+					maxFunc = ff.val
+				}
+			}
+		}
+	}
+
+	funcs := make(map[string]uint64)
+	var names []string
+	var out []byte
+	for _, f := range fields {
+		if f.num != profileLocation {
+			out = append(out, f.raw...)
+			continue
+		}
+		loc, err := pbParse(f.body)
+		if err != nil {
+			return nil, err
+		}
+		r, ok := Region{}, false
+		for _, lf := range loc {
+			if lf.num == locationAddress {
+				r, ok = findRegion(rs, uintptr(lf.val))
+			}
+		}
+		if !ok {
+			out = append(out, f.raw...)
+			continue
+		}
+
+		id, ok := funcs[r.Name]
+		if !ok {
+			id = maxFunc + uint64(len(names)) + 1
+			funcs[r.Name] = id
+			names = append(names, r.Name)
+		}
+
+		var body []byte
+		for _, lf := range loc {
+			if lf.num != locationLine {
+				body = append(body, lf.raw...)
+			}
+		}
+		body = pbBytes(body, locationLine, pbVarint(nil, lineFunctionID, id))
+		out = pbBytes(out, profileLocation, body)
+	}
+
+	for i, name := range names {
+		out = pbBytes(out, profileString, []byte(name))
+		str := uint64(nstrings + i)
+		var fn []byte
+		fn = pbVarint(fn, functionID, maxFunc+uint64(i)+1)
+		fn = pbVarint(fn, functionName, str)
+		fn = pbVarint(fn, functionSystemName, str)
+		out = pbBytes(out, profileFunction, fn)
+	}
+	return out, nil
+}
+
+func findRegion(rs []Region, pc uintptr) (Region, bool) {
+	i := sort.Search(len(rs), func(i int) bool { return rs[i].Addr > pc })
+	if i == 0 {
+		return Region{}, false
+	}
+	r := rs[i-1]
+	return r, pc < r.Addr+uintptr(r.Len)
+}
+
+// A pbField is one field of an encoded protocol buffer message. raw
+// holds the field's complete encoding, tag included.
+type pbField struct {
+	num  int
+	val  uint64
+	body []byte
+	raw  []byte
+}
+
+var errBadProfile = errors.New("gojit: malformed profile")
+
+func pbParse(b []byte) ([]pbField, error) {
+	var fields []pbField
+	for len(b) > 0 {
+		start := b
+		tag, n := binary.Uvarint(b)
+		if n <= 0 {
+			return nil, errBadProfile
+		}
+		b = b[n:]
+		f := pbField{num: int(tag >> 3)}
+		switch tag & 7 {
+		case 0:
+			if f.val, n = binary.Uvarint(b); n <= 0 {
+				return nil, errBadProfile
+			}
+			b = b[n:]
+		case 1:
+			if len(b) < 8 {
+				return nil, errBadProfile
+			}
+			f.val, b = binary.LittleEndian.Uint64(b), b[8:]
+		case 2:
+			l, n := binary.Uvarint(b)
+			if n <= 0 || uint64(len(b)-n) < l {
+				return nil, errBadProfile
+			}
+			f.body, b = b[n:n+int(l)], b[n+int(l):]
+		case 5:
+			if len(b) < 4 {
+				return nil, errBadProfile
+			}
+			f.val, b = uint64(binary.LittleEndian.Uint32(b)), b[4:]
+		default:
+			return nil, errBadProfile
+		}
+		f.raw = start[:len(start)-len(b)]
+		fields = append(fields, f)
+	}
+	return fields, nil
+}
+
+func pbUvarint(b []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func pbVarint(b []byte, num int, v uint64) []byte {
+	return pbUvarint(pbUvarint(b, uint64(num)<<3), v)
+}
+
+func pbBytes(b []byte, num int, body []byte) []byte {
+	b = pbUvarint(pbUvarint(b, uint64(num)<<3|2), uint64(len(body)))
+	return append(b, body...)
+}
@@ -0,0 +1,172 @@
+package gojit
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"sync"
+
+	"github.com/nelhage/gojit/cgo"
+)
+
+// A Region is a named range of JIT'd code.
+type Region struct {
+	Name  string
+	Addr  uintptr
+	Len   int
+	Lines []Line
+}
+
+// A Line maps an offset within a Region to a source position. The
+// position applies up to the offset of the next Line.
+type Line struct {
+	Off  int
+	File string
+	Line int
+}
+
+var regions struct {
+	sync.Mutex
+	r       []Region
+	gdb     map[uintptr]uintptr
+	perfMap io.Writer
+	// perfMapErr is the first error writing to perfMap, which
+	// EnablePerfMap reports if it is called again.
+	perfMapErr error
+	// gdbErr is the first error registering a region with gdb,
+	// which EnableGDB reports if it is called again.
+	gdbErr error
+}
+
+// Register records that b holds the JIT'd code for name, for the
+// benefit of profilers and debuggers: see WritePerfMap,
+// EnablePerfMap, SymbolizeProfile and EnableGDB. Names need not be
+// unique. The registration is dropped when the buffer containing b
+// is passed to Release.
+//
+// The region is recorded even if the error, from writing it to the
+// perf map or registering it with gdb, is not nil.
+func Register(b []byte, name string) error {
+	return RegisterLines(b, name, nil)
+}
+
+// RegisterLines is like Register, but also records a line table for
+// the code in b, which EnableGDB passes on to gdb.
+func RegisterLines(b []byte, name string, lines []Line) error {
+	r := Region{name, Addr(b), len(b), append([]Line(nil), lines...)}
+
+	regions.Lock()
+	defer regions.Unlock()
+	regions.r = append(regions.r, r)
+	var err error
+	if regions.perfMap != nil {
+		err = writePerfMapEntry(regions.perfMap, r)
+		if err != nil && regions.perfMapErr == nil {
+			regions.perfMapErr = err
+		}
+	}
+	if regions.gdb != nil {
+		if e := gdbRegister(r); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Regions returns the live registered regions, sorted by address.
+func Regions() []Region {
+	regions.Lock()
+	out := append([]Region(nil), regions.r...)
+	regions.Unlock()
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// Lookup returns the live registered region containing pc, if any.
+func Lookup(pc uintptr) (Region, bool) {
+	regions.Lock()
+	defer regions.Unlock()
+	for _, r := range regions.r {
+		if pc >= r.Addr && pc < r.Addr+uintptr(r.Len) {
+			return r, true
+		}
+	}
+	return Region{}, false
+}
+
+func unregister(b []byte) {
+	start, end := Addr(b), Addr(b)+uintptr(len(b))
+
+	regions.Lock()
+	defer regions.Unlock()
+	live := regions.r[:0]
+	for _, r := range regions.r {
+		if r.Addr < start || r.Addr >= end {
+			live = append(live, r)
+		} else if h, ok := regions.gdb[r.Addr]; ok {
+			cgo.GDBUnregister(h)
+			delete(regions.gdb, r.Addr)
+		}
+	}
+	regions.r = live
+}
+
+func writePerfMapEntry(w io.Writer, r Region) error {
+	_, err := fmt.Fprintf(w, "%x %x %s\n", r.Addr, r.Len, r.Name)
+	return err
+}
+
+// WritePerfMap writes the live registered regions to w in the format
+// of a Linux perf map file (/tmp/perf-<pid>.map).
+func WritePerfMap(w io.Writer) error {
+	for _, r := range Regions() {
+		if err := writePerfMapEntry(w, r); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// EnablePerfMap creates /tmp/perf-<pid>.map, which perf(1) consults
+// to symbolize samples in anonymous memory, and writes the live
+// registered regions to it. Every region registered from then on is
+// appended to it as well. Entries are never removed, since perf
+// reads the file after the fact.
+//
+// Once the perf map is enabled, EnablePerfMap returns the first
+// error writing a region to it, if any.
+func EnablePerfMap() error {
+	regions.Lock()
+	defer regions.Unlock()
+	if regions.perfMap != nil {
+		return regions.perfMapErr
+	}
+	path := fmt.Sprintf("/tmp/perf-%d.map", os.Getpid())
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	for _, r := range regions.r {
+		if err := writePerfMapEntry(f, r); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	regions.perfMap = f
+	return nil
+}
+
+// SetCgoTraceback installs a cgo traceback function (see
+// runtime.SetCgoTraceback) that records the PC at which a profiling
+// signal interrupted C code, which includes JIT'd code running under
+// BuildCgo. Without it, CPU profiles attribute such samples to the
+// Go function that made the cgo call. SymbolizeProfile can then put
+// names to the recorded PCs.
+//
+// Samples in code running under Build can't be recovered this way;
+// the Go runtime reports them as runtime._ExternalCode. Use perf
+// with EnablePerfMap to profile such code.
+func SetCgoTraceback() {
+	cgo.SetTraceback()
+}
@@ -0,0 +1,167 @@
+package gojit
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"runtime/pprof"
+	"testing"
+	"time"
+)
+
+func TestRegister(t *testing.T) {
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	Register(b[:16], "foo")
+	Register(b[16:48], "bar")
+
+	if r, ok := Lookup(Addr(b) + 20); !ok || r.Name != "bar" {
+		t.Errorf("Lookup(+20) = %v, %v", r, ok)
+	}
+	if r, ok := Lookup(Addr(b) + 48); ok {
+		t.Errorf("Lookup(+48) = %v, expected nothing", r)
+	}
+
+	var w bytes.Buffer
+	if e := WritePerfMap(&w); e != nil {
+		t.Fatalf("WritePerfMap: %s", e.Error())
+	}
+	expect := fmt.Sprintf("%x 10 foo\n%x 20 bar\n", Addr(b), Addr(b)+16)
+	if !bytes.Contains(w.Bytes(), []byte(expect)) {
+		t.Errorf("perf map %q does not contain %q", w.String(), expect)
+	}
+
+	Release(b)
+	if r, ok := Lookup(Addr(b)); ok {
+		t.Errorf("Lookup after Release = %v", r)
+	}
+}
+
+func TestRegisterPerfMapError(t *testing.T) {
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer Release(b)
+
+	errWrite := errors.New("write failed")
+	regions.Lock()
+	regions.perfMap = failWriter{errWrite}
+	regions.Unlock()
+	defer func() {
+		regions.Lock()
+		regions.perfMap, regions.perfMapErr = nil, nil
+		regions.Unlock()
+	}()
+
+	if e := Register(b[:16], "foo"); e != errWrite {
+		t.Errorf("Register: got %v, expected %v", e, errWrite)
+	}
+	if _, ok := Lookup(Addr(b)); !ok {
+		t.Errorf("Lookup: region not registered")
+	}
+	if e := EnablePerfMap(); e != errWrite {
+		t.Errorf("EnablePerfMap: got %v, expected %v", e, errWrite)
+	}
+}
+
+type failWriter struct{ err error }
+
+func (w failWriter) Write([]byte) (int, error) { return 0, w.err }
+
+func TestSymbolizeProfile(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping CPU profile in short mode")
+	}
+
+	b, e := Alloc(PageSize)
+	if e != nil {
+		t.Fatalf("Alloc: %s", e.Error())
+	}
+	defer Release(b)
+	// 0000000000000000 <spin>:
+	//    0:	b9 00 e1 f5 05       	mov    $0x5f5e100,%ecx
+	//    5:	48 ff c9             	dec    %rcx
+	//    8:	75 fb                	jne    5 <spin+0x5>
+	//    a:	c3                   	retq
+	copy(b, []byte{
+		0xb9, 0x00, 0xe1, 0xf5, 0x05,
+		0x48, 0xff, 0xc9,
+		0x75, 0xfb,
+		0xc3,
+	})
+	Register(b[:11], "spin")
+	SetCgoTraceback()
+
+	var prof bytes.Buffer
+	if e := pprof.StartCPUProfile(&prof); e != nil {
+		t.Fatalf("StartCPUProfile: %s", e.Error())
+	}
+	spin := BuildCgo(b)
+	for start := time.Now(); time.Since(start) < 500*time.Millisecond; {
+		spin()
+	}
+	pprof.StopCPUProfile()
+
+	var out bytes.Buffer
+	if e := SymbolizeProfile(&out, &prof); e != nil {
+		t.Fatalf("SymbolizeProfile: %s", e.Error())
+	}
+
+	gz, e := gzip.NewReader(&out)
+	if e != nil {
+		t.Fatalf("gzip: %s", e.Error())
+	}
+	data, e := ioutil.ReadAll(gz)
+	if e != nil {
+		t.Fatalf("gzip: %s", e.Error())
+	}
+	fields, e := pbParse(data)
+	if e != nil {
+		t.Fatalf("parsing profile: %s", e.Error())
+	}
+
+	var strings []string
+	funcs := make(map[uint64]uint64)
+	var locs [][]pbField
+	for _, f := range fields {
+		switch f.num {
+		case profileString:
+			strings = append(strings, string(f.body))
+		case profileFunction:
+			fn, _ := pbParse(f.body)
+			var id, name uint64
+			for _, ff := range fn {
+				switch ff.num {
+				case functionID:
+					id = ff.val
+				case functionName:
+					name = ff.val
+				}
+			}
+			funcs[id] = name
+		case profileLocation:
+			loc, _ := pbParse(f.body)
+			locs = append(locs, loc)
+		}
+	}
+
+	for _, loc := range locs {
+		for _, lf := range loc {
+			if lf.num != locationLine {
+				continue
+			}
+			line, _ := pbParse(lf.body)
+			for _, l := range line {
+				if l.num == lineFunctionID && strings[funcs[l.val]] == "spin" {
+					return
+				}
+			}
+		}
+	}
+	t.Errorf("no location attributed to spin")
+}
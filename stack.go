@@ -0,0 +1,87 @@
+package gojit
+
+import (
+	"sync"
+	"syscall"
+	"unsafe"
+
+	"github.com/edsrzf/mmap-go"
+	"github.com/nelhage/gojit/cgo"
+)
+
+// GoABI code runs on a stack of its own, rather than on the
+// goroutine stack, so that the Go runtime never has to unwind
+// through JIT'd frames. Each stack is stackSize bytes, aligned to
+// stackSize, so that code running on it can find the stack's
+// context block by masking %rsp. The lowest page is a guard page.
+//
+// The context block occupies the top stackCtxSize bytes of the
+// stack:
+//
+//     0(ctx)  goroutine %rsp at the point of the switch
+//     8(ctx)  JIT %rsp, saved while calling back into Go
+//     16(ctx) goroutine %rbp
+//     24(ctx) JIT %rbp, saved while calling back into Go
+//     32(ctx) signal number, if the JIT'd code faulted
+//     40(ctx) faulting PC
+//     48(ctx) faulting address
+//
+// These must match jit_amd64.s and cgo/gojit.h.
+const (
+	stackSize    = 64 << 10
+	stackCtxSize = 64
+	maxFreeStack = 16
+)
+
+type stack struct {
+	mem  mmap.MMap
+	base uintptr
+	ctx  *stackCtx
+}
+
+type stackCtx struct {
+	goSP, jitSP, goBP, jitBP uintptr
+	fault                    cgo.Fault
+}
+
+var stacks struct {
+	sync.Mutex
+	free []*stack
+}
+
+func getStack() *stack {
+	stacks.Lock()
+	if n := len(stacks.free); n > 0 {
+		s := stacks.free[n-1]
+		stacks.free = stacks.free[:n-1]
+		stacks.Unlock()
+		return s
+	}
+	stacks.Unlock()
+
+	mem, err := mmap.MapRegion(nil, 2*stackSize, mmap.RDWR, mmap.ANON, 0)
+	if err != nil {
+		panic("gojit: allocating stack: " + err.Error())
+	}
+	base := align(Addr(mem), stackSize)
+	off := int(base - Addr(mem))
+	if err := syscall.Mprotect(mem[off:off+PageSize], syscall.PROT_NONE); err != nil {
+		panic("gojit: protecting stack guard: " + err.Error())
+	}
+	if err := cgo.AddStack(base); err != nil {
+		panic(err.Error())
+	}
+	ctx := (*stackCtx)(unsafe.Pointer(&mem[off+stackSize-stackCtxSize]))
+	return &stack{mem, base, ctx}
+}
+
+func putStack(s *stack) {
+	stacks.Lock()
+	defer stacks.Unlock()
+	if len(stacks.free) < maxFreeStack {
+		stacks.free = append(stacks.free, s)
+		return
+	}
+	cgo.RemoveStack(s.base)
+	s.mem.Unmap()
+}